@@ -8,12 +8,14 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/formancehq/go-libs/v2/httpclient"
 	"github.com/formancehq/go-libs/v2/licence"
 	"github.com/formancehq/go-libs/v2/logging"
 	"github.com/formancehq/go-libs/v2/otlp"
+	"github.com/formancehq/go-libs/v2/otlp/otlpmetrics"
 	"github.com/formancehq/go-libs/v2/otlp/otlptraces"
 	"github.com/formancehq/go-libs/v2/service"
 	"github.com/formancehq/stack/components/agent/internal"
@@ -23,6 +25,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"k8s.io/client-go/transport"
 	"k8s.io/client-go/util/homedir"
 )
@@ -35,21 +38,39 @@ var (
 )
 
 const (
-	kubeConfigFlag                 = "kube-config"
-	serverAddressFlag              = "server-address"
-	tlsEnabledFlag                 = "tls-enabled"
-	tlsInsecureSkipVerifyFlag      = "tls-insecure-skip-verify"
-	tlsCACertificateFlag           = "tls-ca-cert"
-	idFlag                         = "id"
-	authenticationModeFlag         = "authentication-mode"
-	authenticationTokenFlag        = "authentication-token"
-	authenticationIssuerFlag       = "authentication-issuer"
-	authenticationClientSecretFlag = "authentication-client-secret"
-	baseUrlFlag                    = "base-url"
-	additionalBaseUrlsFlag         = "additional-base-urls"
-	productionFlag                 = "production"
-	outdatedFlag                   = "outdated"
-	resyncPeriodFlag               = "resync-period"
+	kubeConfigFlag                   = "kube-config"
+	serverAddressFlag                = "server-address"
+	tlsEnabledFlag                   = "tls-enabled"
+	tlsInsecureSkipVerifyFlag        = "tls-insecure-skip-verify"
+	tlsCACertificateFlag             = "tls-ca-cert"
+	idFlag                           = "id"
+	authenticationModeFlag           = "authentication-mode"
+	authenticationTokenFlag          = "authentication-token"
+	authenticationIssuerFlag         = "authentication-issuer"
+	authenticationClientSecretFlag   = "authentication-client-secret"
+	baseUrlFlag                      = "base-url"
+	additionalBaseUrlsFlag           = "additional-base-urls"
+	productionFlag                   = "production"
+	outdatedFlag                     = "outdated"
+	resyncPeriodFlag                 = "resync-period"
+	reconnectMinBackoffFlag          = "reconnect-min-backoff"
+	reconnectMaxBackoffFlag          = "reconnect-max-backoff"
+	stateDirFlag                     = "state-dir"
+	resetRuntimeConfigFlag           = "reset-runtime-config"
+	inFlightWindowFlag               = "in-flight-window"
+	failoverThresholdFlag            = "failover-threshold"
+	primaryProbeIntervalFlag         = "primary-probe-interval"
+	pongIntervalFlag                 = "pong-interval"
+	livenessTimeoutFlag              = "liveness-timeout"
+	keepaliveTimeFlag                = "keepalive-time"
+	keepaliveTimeoutFlag             = "keepalive-timeout"
+	keepalivePermitWithoutStreamFlag = "keepalive-permit-without-stream"
+	sendRateFlag                     = "send-rate"
+	sendBurstFlag                    = "send-burst"
+	maxBatchSizeFlag                 = "max-batch-size"
+	negotiationTimeoutFlag           = "negotiation-timeout"
+	outboxMaxSizeFlag                = "outbox-max-size"
+	shutdownTimeoutFlag              = "shutdown-timeout"
 )
 
 var rootCmd = &cobra.Command{
@@ -66,10 +87,11 @@ func init() {
 	service.AddFlags(rootCmd.PersistentFlags())
 	otlp.AddFlags(rootCmd.PersistentFlags())
 	otlptraces.AddFlags(rootCmd.PersistentFlags())
+	otlpmetrics.AddFlags(rootCmd.PersistentFlags())
 	licence.AddFlags(rootCmd.PersistentFlags())
 
 	rootCmd.Flags().String(kubeConfigFlag, kubeConfigFilePath, "")
-	rootCmd.Flags().String(serverAddressFlag, "localhost:8081", "")
+	rootCmd.Flags().StringSlice(serverAddressFlag, []string{"localhost:8081"}, "Ordered list of server addresses, an address prefixed with srv:// is resolved using DNS SRV records")
 	rootCmd.Flags().Bool(tlsEnabledFlag, false, "")
 	rootCmd.Flags().Bool(tlsInsecureSkipVerifyFlag, false, "")
 	rootCmd.Flags().String(tlsCACertificateFlag, "", "")
@@ -83,6 +105,24 @@ func init() {
 	rootCmd.Flags().Bool(productionFlag, false, "Is a production agent")
 	rootCmd.Flags().Bool(outdatedFlag, false, "Set the region as outdated when connecting")
 	rootCmd.Flags().Duration(resyncPeriodFlag, 5*time.Minute, "Resync period of K8S resources")
+	rootCmd.Flags().Duration(reconnectMinBackoffFlag, time.Second, "Delay before the first reconnection attempt to the server")
+	rootCmd.Flags().Duration(reconnectMaxBackoffFlag, time.Minute, "Maximum delay between two reconnection attempts to the server")
+	rootCmd.Flags().Int(inFlightWindowFlag, 0, "Number of messages sent to the server without being acknowledged, acknowledgements are disabled if 0, requires --state-dir")
+	rootCmd.Flags().String(stateDirFlag, "", "Directory where the agent persists its state, messages not yet sent to the server are kept in memory only if empty")
+	rootCmd.Flags().Bool(resetRuntimeConfigFlag, false, "Drop the configuration updates received from the server and persisted in --state-dir, which otherwise take precedence over the flags")
+	rootCmd.Flags().Int(failoverThresholdFlag, 3, "Number of failed connections to a server address before trying the next one")
+	rootCmd.Flags().Duration(primaryProbeIntervalFlag, time.Minute, "Interval between checks of the first server address while connected to another one, failback is disabled if 0")
+	rootCmd.Flags().Duration(pongIntervalFlag, 5*time.Second, "Interval between two pongs sent to the server")
+	rootCmd.Flags().Duration(livenessTimeoutFlag, 0, "Reconnect if nothing is received from the server for this duration, disabled if 0")
+	rootCmd.Flags().Duration(keepaliveTimeFlag, 0, "Interval of gRPC keepalive pings when the connection is idle, disabled if 0")
+	rootCmd.Flags().Duration(keepaliveTimeoutFlag, 20*time.Second, "Time to wait for a gRPC keepalive ping acknowledgement before closing the connection")
+	rootCmd.Flags().Bool(keepalivePermitWithoutStreamFlag, false, "Send gRPC keepalive pings even without active stream")
+	rootCmd.Flags().Float64(sendRateFlag, 100, "Number of frames per second sent to the server, unlimited if 0")
+	rootCmd.Flags().Int(sendBurstFlag, 100, "Number of frames which can be sent at once above the send rate")
+	rootCmd.Flags().Int(maxBatchSizeFlag, 100, "Maximum number of messages packed in a single frame when the server supports batches")
+	rootCmd.Flags().Duration(negotiationTimeoutFlag, 10*time.Second, "Time to wait for the server to negotiate optional features before going on without them")
+	rootCmd.Flags().Int(outboxMaxSizeFlag, 10000, "Maximum number of messages waiting to be sent to the server, version events then status updates are dropped first, unbounded if 0")
+	rootCmd.Flags().Duration(shutdownTimeoutFlag, 30*time.Second, "Maximum time spent waiting for running orders and sending pending messages on shutdown")
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
@@ -91,8 +131,8 @@ func Execute() {
 }
 
 func runAgent(cmd *cobra.Command, _ []string) error {
-	serverAddress, _ := cmd.Flags().GetString(serverAddressFlag)
-	if serverAddress == "" {
+	serverAddresses, _ := cmd.Flags().GetStringSlice(serverAddressFlag)
+	if len(serverAddresses) == 0 {
 		return errors.New("missing server address")
 	}
 
@@ -109,6 +149,17 @@ func runAgent(cmd *cobra.Command, _ []string) error {
 	dialOptions := make([]grpc.DialOption, 0)
 	dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials))
 
+	keepaliveTime, _ := cmd.Flags().GetDuration(keepaliveTimeFlag)
+	if keepaliveTime > 0 {
+		keepaliveTimeout, _ := cmd.Flags().GetDuration(keepaliveTimeoutFlag)
+		permitWithoutStream, _ := cmd.Flags().GetBool(keepalivePermitWithoutStreamFlag)
+		dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: permitWithoutStream,
+		}))
+	}
+
 	baseUrlString, _ := cmd.Flags().GetString(baseUrlFlag)
 	if baseUrlString == "" {
 		return errors.New("missing base url")
@@ -146,6 +197,27 @@ func runAgent(cmd *cobra.Command, _ []string) error {
 	resyncPeriod, _ := cmd.Flags().GetDuration(resyncPeriodFlag)
 	outdated, _ := cmd.Flags().GetBool(outdatedFlag)
 	additionalBaseUrls, _ := cmd.Flags().GetStringSlice(additionalBaseUrlsFlag)
+	reconnectMinBackoff, _ := cmd.Flags().GetDuration(reconnectMinBackoffFlag)
+	reconnectMaxBackoff, _ := cmd.Flags().GetDuration(reconnectMaxBackoffFlag)
+	stateDir, _ := cmd.Flags().GetString(stateDirFlag)
+	resetRuntimeConfig, _ := cmd.Flags().GetBool(resetRuntimeConfigFlag)
+	inFlightWindow, _ := cmd.Flags().GetInt(inFlightWindowFlag)
+	if inFlightWindow > 0 && stateDir == "" {
+		// Sequences would start over after a restart
+		return errors.Errorf("--%s requires --%s", inFlightWindowFlag, stateDirFlag)
+	}
+	failoverThreshold, _ := cmd.Flags().GetInt(failoverThresholdFlag)
+	primaryProbeInterval, _ := cmd.Flags().GetDuration(primaryProbeIntervalFlag)
+	pongInterval, _ := cmd.Flags().GetDuration(pongIntervalFlag)
+	livenessTimeout, _ := cmd.Flags().GetDuration(livenessTimeoutFlag)
+	sendRate, _ := cmd.Flags().GetFloat64(sendRateFlag)
+	sendBurst, _ := cmd.Flags().GetInt(sendBurstFlag)
+	maxBatchSize, _ := cmd.Flags().GetInt(maxBatchSizeFlag)
+	negotiationTimeout, _ := cmd.Flags().GetDuration(negotiationTimeoutFlag)
+	outboxMaxSize, _ := cmd.Flags().GetInt(outboxMaxSizeFlag)
+	shutdownTimeout, _ := cmd.Flags().GetDuration(shutdownTimeoutFlag)
+
+	logger, setDebug := newLogger(cmd)
 
 	options := []fx.Option{
 		fx.Supply(restConfig),
@@ -155,7 +227,8 @@ func runAgent(cmd *cobra.Command, _ []string) error {
 		}),
 		internal.NewModule(
 			service.IsDebug(cmd),
-			serverAddress,
+			setDebug,
+			serverAddresses,
 			authenticator,
 			internal.ClientInfo{
 				ID:                 agentID,
@@ -164,15 +237,79 @@ func runAgent(cmd *cobra.Command, _ []string) error {
 				Production:         isProduction,
 				Outdated:           outdated,
 				Version:            Version,
-			}, resyncPeriod,
+			},
+			internal.ConnectionConfig{
+				MinReconnectBackoff:  reconnectMinBackoff,
+				MaxReconnectBackoff:  reconnectMaxBackoff,
+				InFlightWindow:       inFlightWindow,
+				StateDir:             stateDir,
+				ResetRuntimeConfig:   resetRuntimeConfig,
+				FailoverThreshold:    failoverThreshold,
+				PrimaryProbeInterval: primaryProbeInterval,
+				PongInterval:         pongInterval,
+				LivenessTimeout:      livenessTimeout,
+				SendRate:             sendRate,
+				SendBurst:            sendBurst,
+				MaxBatchSize:         maxBatchSize,
+				NegotiationTimeout:   negotiationTimeout,
+				OutboxMaxSize:        outboxMaxSize,
+				ShutdownTimeout:      shutdownTimeout,
+			},
+			resyncPeriod,
 			dialOptions...,
 		),
 		otlp.FXModuleFromFlags(cmd, otlp.WithServiceVersion(Version)),
 		otlptraces.FXModuleFromFlags(cmd),
+		otlpmetrics.FXModuleFromFlags(cmd),
 		licence.FXModuleFromFlags(cmd, ServiceName),
 	}
 
-	return service.New(cmd.OutOrStdout(), options...).Run(cmd)
+	return service.NewWithLogger(logger, options...).Run(cmd)
+}
+
+// switchableLogger drops debug logs unless debug is enabled, so that
+// membership can switch the level of the logger created by go-libs.
+type switchableLogger struct {
+	logging.Logger
+	debug *atomic.Bool
+}
+
+func (l switchableLogger) Debugf(format string, args ...any) {
+	if l.debug.Load() {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l switchableLogger) Debug(args ...any) {
+	if l.debug.Load() {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l switchableLogger) WithFields(fields map[string]any) logging.Logger {
+	return switchableLogger{Logger: l.Logger.WithFields(fields), debug: l.debug}
+}
+
+func (l switchableLogger) WithField(key string, value any) logging.Logger {
+	return switchableLogger{Logger: l.Logger.WithField(key, value), debug: l.debug}
+}
+
+func (l switchableLogger) WithContext(ctx context.Context) logging.Logger {
+	return switchableLogger{Logger: l.Logger.WithContext(ctx), debug: l.debug}
+}
+
+// newLogger creates the logger as the service would, with debug logs
+// enabled and filtered by a switch membership can toggle.
+func newLogger(cmd *cobra.Command) (logging.Logger, internal.SetDebugFn) {
+	otelTraces, _ := cmd.Flags().GetString(otlptraces.OtelTracesExporterFlag)
+	jsonFormatting, _ := cmd.Flags().GetBool(logging.JsonFormattingLoggerFlag)
+
+	debug := &atomic.Bool{}
+	debug.Store(service.IsDebug(cmd))
+	return switchableLogger{
+		Logger: logging.NewDefaultLogger(cmd.OutOrStdout(), true, jsonFormatting, otelTraces != ""),
+		debug:  debug,
+	}, debug.Store
 }
 
 func createAuthenticator(cmd *cobra.Command) (internal.Authenticator, error) {
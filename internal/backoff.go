@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes jittered exponential delays between reconnection attempts.
+// Each call to next doubles the base delay, up to max, and returns a random
+// duration between half and the whole of it so that a fleet of agents
+// disconnected by the same server restart does not reconnect in lockstep.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.min
+	for i := 0; i < b.attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempt++
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min: min,
+		max: max,
+	}
+}
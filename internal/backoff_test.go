@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := newBackoff(100*time.Millisecond, time.Second)
+
+	expectedCeilings := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for _, ceiling := range expectedCeilings {
+		delay := b.next()
+		require.LessOrEqual(t, delay, ceiling)
+		require.GreaterOrEqual(t, delay, ceiling/2)
+	}
+
+	b.reset()
+	require.LessOrEqual(t, b.next(), 100*time.Millisecond)
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const defaultRotationTimeout = 5 * time.Minute
+
+// credentialsTarget is an object of a stack holding the client secret of the
+// delegated OIDC server.
+type credentialsTarget struct {
+	gvk      schema.GroupVersionKind
+	resource string
+	// path of the secret in the object
+	path []string
+}
+
+func (c *membershipListener) credentialsTargets() []credentialsTarget {
+	targets := make([]credentialsTarget, 0, 2)
+	for _, crd := range c.modules {
+		if crd.Spec.Names.Kind != "Auth" {
+			continue
+		}
+		targets = append(targets, credentialsTarget{
+			gvk: schema.GroupVersionKind{
+				Group:   crd.Spec.Group,
+				Version: crd.Spec.Versions[0].Name,
+				Kind:    crd.Spec.Names.Kind,
+			},
+			resource: crd.Status.AcceptedNames.Plural,
+			path:     []string{"spec", "delegatedOIDCServer", "clientSecret"},
+		})
+	}
+	return append(targets, credentialsTarget{
+		gvk:      formanceGroupVersion.WithKind("Stargate"),
+		resource: "Stargates",
+		path:     []string{"spec", "auth", "clientSecret"},
+	})
+}
+
+func (t credentialsTarget) patch(secret string) ([]byte, error) {
+	var content any = secret
+	for i := len(t.path) - 1; i >= 0; i-- {
+		content = map[string]any{t.path[i]: content}
+	}
+	return json.Marshal(content)
+}
+
+// reconciled tells whether the operator reconciled a generation of an object
+// and found it ready. The operator records the generation it reconciled on
+// each condition of the status, objects without conditions are never
+// considered reconciled.
+func reconciled(object *unstructured.Unstructured, generation int64) bool {
+	ready, _, _ := unstructured.NestedBool(object.Object, "status", "ready")
+	conditions, _, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
+	if !ready || len(conditions) == 0 {
+		return false
+	}
+	for _, condition := range conditions {
+		condition, ok := condition.(map[string]any)
+		if !ok {
+			return false
+		}
+		observedGeneration, _, _ := unstructured.NestedInt64(condition, "observedGeneration")
+		if observedGeneration < generation {
+			return false
+		}
+	}
+	return true
+}
+
+// uncached returns a client reading objects from the API server: right after
+// a patch, the informer cache may still hold the previous generation.
+func uncached(client K8SClient) K8SClient {
+	if cached, ok := client.(cachedK8SClient); ok {
+		return cached.K8SClient
+	}
+	return client
+}
+
+// rotatedObject is an object whose secret was replaced.
+type rotatedObject struct {
+	target   credentialsTarget
+	previous string
+	// generation of the object holding the new secret
+	generation int64
+}
+
+func (c *membershipListener) setSecret(ctx context.Context, stackName string, target credentialsTarget, secret string) error {
+	patch, err := target.patch(secret)
+	if err != nil {
+		return errors.Wrap(err, "marshalling patch")
+	}
+	return errors.Wrap(c.client.Patch(ctx, target.resource, stackName, patch), "patching object")
+}
+
+// rotateSecret replaces the secret of an object and returns the generation
+// holding it.
+func (c *membershipListener) rotateSecret(ctx context.Context, stackName string, target credentialsTarget, secret string) (int64, error) {
+	if err := c.setSecret(ctx, stackName, target, secret); err != nil {
+		return 0, err
+	}
+	object, err := uncached(c.client).Get(ctx, target.resource, stackName)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading patched object")
+	}
+	return object.GetGeneration(), nil
+}
+
+// rollbackSecrets restores the previous secret of the rotated objects, the
+// errors are reported on each object along with the cause of the rollback.
+func (c *membershipListener) rollbackSecrets(ctx context.Context, stackName string, rotated []rotatedObject, cause error) {
+	logger := logging.FromContext(ctx)
+	// The rollback must happen even if the order timed out
+	ctx = context.WithoutCancel(ctx)
+
+	for _, object := range rotated {
+		err := errors.Wrap(cause, "previous secret restored")
+		if rollbackErr := c.setSecret(ctx, stackName, object.target, object.previous); rollbackErr != nil {
+			logger.Errorf("Unable to restore the previous secret of %s: %s", object.target.gvk.Kind, rollbackErr)
+			err = errors.Wrapf(cause, "unable to restore previous secret: %s", rollbackErr)
+		}
+		recordObject(ctx, object.target.gvk, stackName, generated.ObjectAction_ObjectUpdated, err)
+	}
+}
+
+// rotateStackCredentials replaces the client secret of the delegated OIDC
+// server in the objects of a stack as one operation: either all of them are
+// ready with the new secret, or all of them get the previous one back.
+func (c *membershipListener) rotateStackCredentials(ctx context.Context, order *generated.RotateStackCredentials) {
+	logger := logging.FromContext(ctx)
+	stackGVK := formanceGroupVersion.WithKind("Stack")
+
+	if order.ClientSecret == "" {
+		err := errors.New("missing client secret")
+		logger.Errorf("Unable to rotate stack credentials: %s", err)
+		recordObject(ctx, stackGVK, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+
+	rotated := make([]rotatedObject, 0)
+	for _, target := range c.credentialsTargets() {
+		object, err := c.client.Get(ctx, target.resource, order.ClusterName)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err == nil {
+			previous, _, _ := unstructured.NestedString(object.Object, target.path...)
+			logger.Infof("Rotating the secret of %s", target.gvk.Kind)
+			var generation int64
+			generation, err = c.rotateSecret(ctx, order.ClusterName, target, order.ClientSecret)
+			if err == nil {
+				rotated = append(rotated, rotatedObject{
+					target:     target,
+					previous:   previous,
+					generation: generation,
+				})
+				continue
+			}
+		}
+
+		logger.Errorf("Unable to rotate the secret of %s: %s", target.gvk.Kind, err)
+		recordObject(ctx, target.gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		c.rollbackSecrets(ctx, order.ClusterName, rotated, errors.Errorf("rotation of %s failed", target.gvk.Kind))
+		return
+	}
+	if len(rotated) == 0 {
+		err := errors.New("no object uses the stack credentials")
+		logger.Errorf("Unable to rotate stack credentials: %s", err)
+		recordObject(ctx, stackGVK, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+
+	waitCtx, cancel := c.rolloutContext(ctx, order.TimeoutSeconds, defaultRotationTimeout)
+	defer cancel()
+
+	for _, object := range rotated {
+		err := wait.PollUntilContextCancel(waitCtx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+			u, err := uncached(c.client).Get(ctx, object.target.resource, order.ClusterName)
+			if err != nil {
+				return false, err
+			}
+			return reconciled(u, object.generation), nil
+		})
+		if err != nil {
+			err = errors.Wrapf(waitError(waitCtx, err), "waiting for %s to be ready", object.target.gvk.Kind)
+			logger.Errorf("Rolling back stack credentials: %s", err)
+			c.rollbackSecrets(ctx, order.ClusterName, rotated, err)
+			return
+		}
+	}
+
+	for _, object := range rotated {
+		recordObject(ctx, object.target.gvk, order.ClusterName, generated.ObjectAction_ObjectUpdated, nil)
+	}
+	logger.Infof("Stack credentials rotated")
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRotateStackCredentials(t *testing.T) {
+	t.Parallel()
+
+	crd := v1.CustomResourceDefinition{}
+	crd.Spec.Group = formanceGroupVersion.Group
+	crd.Spec.Names.Kind = "Auth"
+	crd.Spec.Versions = []v1.CustomResourceDefinitionVersion{{Name: formanceGroupVersion.Version}}
+	crd.Status.AcceptedNames = v1.CustomResourceDefinitionNames{Singular: "auth", Plural: "auths"}
+
+	// Objects start ready, the operator reconciled their first generation
+	newObject := func(kind, stackName string, spec map[string]any) *unstructured.Unstructured {
+		object := newTestObject(kind, stackName, nil, map[string]any{
+			"spec": spec,
+			"status": map[string]any{
+				"ready": true,
+				"conditions": []any{
+					map[string]any{"type": "Ready", "observedGeneration": int64(1)},
+				},
+			},
+		})
+		object.SetGeneration(1)
+		return object
+	}
+	client := newFakeK8SClient()
+	client.reconcile = func(resource string, object *unstructured.Unstructured) {
+		// The stargate of stack2 never reconciles the new secret
+		if resource == "Stargates" && object.GetName() == "stack2" {
+			return
+		}
+		require.NoError(t, unstructured.SetNestedSlice(object.Object, []any{
+			map[string]any{"type": "Ready", "observedGeneration": object.GetGeneration()},
+		}, "status", "conditions"))
+	}
+	for _, stackName := range []string{"stack1", "stack2"} {
+		require.NoError(t, client.Create(context.Background(), "auths", newObject("Auth", stackName, map[string]any{
+			"delegatedOIDCServer": map[string]any{"clientSecret": "old"},
+		})))
+		require.NoError(t, client.Create(context.Background(), "Stargates", newObject("Stargate", stackName, map[string]any{
+			"auth": map[string]any{"clientSecret": "old"},
+		})))
+	}
+	membershipClient := startTestListener(t, client, nil, nil, crd)
+
+	rotate := func(correlationID, stackName string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_RotateStackCredentials{
+				RotateStackCredentials: &generated.RotateStackCredentials{
+					ClusterName:    stackName,
+					ClientSecret:   "new",
+					TimeoutSeconds: 1,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	secrets := func(stackName string) []string {
+		auth, err := client.Get(context.Background(), "auths", stackName)
+		require.NoError(t, err)
+		authSecret, _, _ := unstructured.NestedString(auth.Object, "spec", "delegatedOIDCServer", "clientSecret")
+		stargate, err := client.Get(context.Background(), "Stargates", stackName)
+		require.NoError(t, err)
+		stargateSecret, _, _ := unstructured.NestedString(stargate.Object, "spec", "auth", "clientSecret")
+		return []string{authSecret, stargateSecret}
+	}
+
+	result := rotate("rotate", "stack1")
+	require.True(t, result.Success)
+	require.Len(t, result.Objects, 2)
+	require.Equal(t, []string{"new", "new"}, secrets("stack1"))
+
+	result = rotate("rollback", "stack2")
+	require.False(t, result.Success)
+	require.Len(t, result.Objects, 2)
+	for _, object := range result.Objects {
+		require.Contains(t, object.Error, "previous secret restored")
+		require.Contains(t, object.Error, "waiting for Stargate to be ready")
+	}
+	require.Equal(t, []string{"old", "old"}, secrets("stack2"))
+
+	result = rotate("missing", "stack3")
+	require.False(t, result.Success)
+}
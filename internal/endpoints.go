@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/formancehq/go-libs/v2/logging"
+)
+
+const srvScheme = "srv://"
+
+type lookupSRVFn func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+// endpoints selects the membership server address to connect to. Addresses
+// are tried in order: the client stays on the current one while it connects
+// successfully, and moves to the next one after failoverThreshold failed
+// attempts. An address prefixed with srv:// is a DNS SRV name, expanded to
+// its targets ordered by priority.
+type endpoints struct {
+	mu                sync.Mutex
+	addresses         []string
+	resolved          []string
+	current           int
+	failures          int
+	failoverThreshold int
+	failback          bool
+	lookupSRV         lookupSRVFn
+}
+
+func (e *endpoints) resolve(ctx context.Context) {
+	resolved := make([]string, 0, len(e.addresses))
+	for _, address := range e.addresses {
+		if !strings.HasPrefix(address, srvScheme) {
+			resolved = append(resolved, address)
+			continue
+		}
+
+		_, records, err := e.lookupSRV(ctx, "", "", strings.TrimPrefix(address, srvScheme))
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Unable to resolve %s: %s", address, err)
+			continue
+		}
+		for _, record := range records {
+			resolved = append(resolved, net.JoinHostPort(
+				strings.TrimSuffix(record.Target, "."),
+				fmt.Sprint(record.Port),
+			))
+		}
+	}
+	e.resolved = resolved
+}
+
+// Current returns the address to connect to, resolving the configured
+// addresses when starting over the list.
+func (e *endpoints) Current(ctx context.Context) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current == 0 || e.current >= len(e.resolved) {
+		e.current = 0
+		e.resolve(ctx)
+	}
+	if len(e.resolved) == 0 {
+		return "", false
+	}
+	return e.resolved[e.current], true
+}
+
+// Primary returns the first address of the list, and whether the client is
+// currently connected to another one.
+func (e *endpoints) Primary() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.resolved) == 0 {
+		return "", false
+	}
+	return e.resolved[0], e.current != 0
+}
+
+// Report records the outcome of a session on the current address.
+func (e *endpoints) Report(connected bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if connected {
+		e.failures = 0
+		return
+	}
+
+	e.failures++
+	if e.failures >= e.failoverThreshold {
+		e.failures = 0
+		e.current++
+	}
+}
+
+// Failback goes back to the primary address on the next connection.
+func (e *endpoints) Failback() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.current = 0
+	e.failures = 0
+	e.failback = true
+}
+
+// TakeFailback reports whether the last session was interrupted to fail
+// back to the primary address.
+func (e *endpoints) TakeFailback() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	failback := e.failback
+	e.failback = false
+	return failback
+}
+
+func newEndpoints(addresses []string, failoverThreshold int) *endpoints {
+	if failoverThreshold <= 0 {
+		failoverThreshold = 1
+	}
+	return &endpoints{
+		addresses:         addresses,
+		failoverThreshold: failoverThreshold,
+		lookupSRV:         net.DefaultResolver.LookupSRV,
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpoints(t *testing.T) {
+	t.Parallel()
+
+	endpoints := newEndpoints([]string{"primary:8081", "srv://_membership._tcp.example.com"}, 2)
+	endpoints.lookupSRV = func(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+		require.Equal(t, "_membership._tcp.example.com", name)
+		return "", []*net.SRV{
+			{Target: "a.example.com.", Port: 8081, Priority: 1},
+			{Target: "b.example.com.", Port: 8082, Priority: 2},
+		}, nil
+	}
+	ctx := logging.TestingContext()
+
+	current := func() string {
+		address, ok := endpoints.Current(ctx)
+		require.True(t, ok)
+		return address
+	}
+
+	require.Equal(t, "primary:8081", current())
+
+	// A healthy session keeps the client on the current address
+	endpoints.Report(false)
+	endpoints.Report(true)
+	endpoints.Report(false)
+	require.Equal(t, "primary:8081", current())
+
+	endpoints.Report(false)
+	require.Equal(t, "a.example.com:8081", current())
+	primary, failedOver := endpoints.Primary()
+	require.Equal(t, "primary:8081", primary)
+	require.True(t, failedOver)
+
+	endpoints.Report(false)
+	endpoints.Report(false)
+	require.Equal(t, "b.example.com:8082", current())
+
+	// The list starts over after the last address
+	endpoints.Report(false)
+	endpoints.Report(false)
+	require.Equal(t, "primary:8081", current())
+
+	endpoints.Report(false)
+	endpoints.Report(false)
+	require.Equal(t, "a.example.com:8081", current())
+	endpoints.Failback()
+	require.True(t, endpoints.TakeFailback())
+	require.False(t, endpoints.TakeFailback())
+	require.Equal(t, "primary:8081", current())
+}
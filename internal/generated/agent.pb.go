@@ -10,6 +10,7 @@ import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	structpb "google.golang.org/protobuf/types/known/structpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 	unsafe "unsafe"
@@ -74,6 +75,106 @@ func (StackStatus) EnumDescriptor() ([]byte, []int) {
 	return file_agent_proto_rawDescGZIP(), []int{0}
 }
 
+type DeletionReason int32
+
+const (
+	DeletionReason_DeletionRequested DeletionReason = 0
+	// DeletionExpired is reported for the stacks deleted by the agent once
+	// their expiresAt passed.
+	DeletionReason_DeletionExpired DeletionReason = 1
+)
+
+// Enum value maps for DeletionReason.
+var (
+	DeletionReason_name = map[int32]string{
+		0: "DeletionRequested",
+		1: "DeletionExpired",
+	}
+	DeletionReason_value = map[string]int32{
+		"DeletionRequested": 0,
+		"DeletionExpired":   1,
+	}
+)
+
+func (x DeletionReason) Enum() *DeletionReason {
+	p := new(DeletionReason)
+	*p = x
+	return p
+}
+
+func (x DeletionReason) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DeletionReason) Descriptor() protoreflect.EnumDescriptor {
+	return file_agent_proto_enumTypes[1].Descriptor()
+}
+
+func (DeletionReason) Type() protoreflect.EnumType {
+	return &file_agent_proto_enumTypes[1]
+}
+
+func (x DeletionReason) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DeletionReason.Descriptor instead.
+func (DeletionReason) EnumDescriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{1}
+}
+
+type ObjectAction int32
+
+const (
+	ObjectAction_ObjectUnchanged ObjectAction = 0
+	ObjectAction_ObjectCreated   ObjectAction = 1
+	ObjectAction_ObjectUpdated   ObjectAction = 2
+	ObjectAction_ObjectDeleted   ObjectAction = 3
+)
+
+// Enum value maps for ObjectAction.
+var (
+	ObjectAction_name = map[int32]string{
+		0: "ObjectUnchanged",
+		1: "ObjectCreated",
+		2: "ObjectUpdated",
+		3: "ObjectDeleted",
+	}
+	ObjectAction_value = map[string]int32{
+		"ObjectUnchanged": 0,
+		"ObjectCreated":   1,
+		"ObjectUpdated":   2,
+		"ObjectDeleted":   3,
+	}
+)
+
+func (x ObjectAction) Enum() *ObjectAction {
+	p := new(ObjectAction)
+	*p = x
+	return p
+}
+
+func (x ObjectAction) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ObjectAction) Descriptor() protoreflect.EnumDescriptor {
+	return file_agent_proto_enumTypes[2].Descriptor()
+}
+
+func (ObjectAction) Type() protoreflect.EnumType {
+	return &file_agent_proto_enumTypes[2]
+}
+
+func (x ObjectAction) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ObjectAction.Descriptor instead.
+func (ObjectAction) EnumDescriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{2}
+}
+
 type ConnectRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
@@ -152,8 +253,21 @@ type Order struct {
 	//	*Order_Ping
 	//	*Order_DisabledStack
 	//	*Order_EnabledStack
-	Message       isOrder_Message   `protobuf_oneof:"message"`
-	Metadata      map[string]string `protobuf:"bytes,8,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	//	*Order_Ack
+	//	*Order_Resync
+	//	*Order_ConfigUpdate
+	//	*Order_UpsertVersions
+	//	*Order_DeleteVersions
+	//	*Order_RestartModule
+	//	*Order_RotateStackCredentials
+	Message  isOrder_Message   `protobuf_oneof:"message"`
+	Metadata map[string]string `protobuf:"bytes,8,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// correlationId is reported back in the OrderResult of the order.
+	CorrelationId string `protobuf:"bytes,11,opt,name=correlationId,proto3" json:"correlationId,omitempty"`
+	// sequence is set on orders which must be acknowledged by the agent. It
+	// increases monotonically and is never reused for a given agent, 0 means
+	// the order is not sequenced.
+	Sequence      uint64 `protobuf:"varint,10,opt,name=sequence,proto3" json:"sequence,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -249,6 +363,69 @@ func (x *Order) GetEnabledStack() *EnabledStack {
 	return nil
 }
 
+func (x *Order) GetAck() *Ack {
+	if x != nil {
+		if x, ok := x.Message.(*Order_Ack); ok {
+			return x.Ack
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetResync() *Resync {
+	if x != nil {
+		if x, ok := x.Message.(*Order_Resync); ok {
+			return x.Resync
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetConfigUpdate() *AgentConfig {
+	if x != nil {
+		if x, ok := x.Message.(*Order_ConfigUpdate); ok {
+			return x.ConfigUpdate
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetUpsertVersions() *UpsertVersions {
+	if x != nil {
+		if x, ok := x.Message.(*Order_UpsertVersions); ok {
+			return x.UpsertVersions
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetDeleteVersions() *DeleteVersions {
+	if x != nil {
+		if x, ok := x.Message.(*Order_DeleteVersions); ok {
+			return x.DeleteVersions
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetRestartModule() *RestartModule {
+	if x != nil {
+		if x, ok := x.Message.(*Order_RestartModule); ok {
+			return x.RestartModule
+		}
+	}
+	return nil
+}
+
+func (x *Order) GetRotateStackCredentials() *RotateStackCredentials {
+	if x != nil {
+		if x, ok := x.Message.(*Order_RotateStackCredentials); ok {
+			return x.RotateStackCredentials
+		}
+	}
+	return nil
+}
+
 func (x *Order) GetMetadata() map[string]string {
 	if x != nil {
 		return x.Metadata
@@ -256,6 +433,20 @@ func (x *Order) GetMetadata() map[string]string {
 	return nil
 }
 
+func (x *Order) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+func (x *Order) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
 type isOrder_Message interface {
 	isOrder_Message()
 }
@@ -284,6 +475,34 @@ type Order_EnabledStack struct {
 	EnabledStack *EnabledStack `protobuf:"bytes,7,opt,name=enabledStack,proto3,oneof"`
 }
 
+type Order_Ack struct {
+	Ack *Ack `protobuf:"bytes,9,opt,name=ack,proto3,oneof"`
+}
+
+type Order_Resync struct {
+	Resync *Resync `protobuf:"bytes,12,opt,name=resync,proto3,oneof"`
+}
+
+type Order_ConfigUpdate struct {
+	ConfigUpdate *AgentConfig `protobuf:"bytes,13,opt,name=configUpdate,proto3,oneof"`
+}
+
+type Order_UpsertVersions struct {
+	UpsertVersions *UpsertVersions `protobuf:"bytes,14,opt,name=upsertVersions,proto3,oneof"`
+}
+
+type Order_DeleteVersions struct {
+	DeleteVersions *DeleteVersions `protobuf:"bytes,15,opt,name=deleteVersions,proto3,oneof"`
+}
+
+type Order_RestartModule struct {
+	RestartModule *RestartModule `protobuf:"bytes,16,opt,name=restartModule,proto3,oneof"`
+}
+
+type Order_RotateStackCredentials struct {
+	RotateStackCredentials *RotateStackCredentials `protobuf:"bytes,17,opt,name=rotateStackCredentials,proto3,oneof"`
+}
+
 func (*Order_Connected) isOrder_Message() {}
 
 func (*Order_ExistingStack) isOrder_Message() {}
@@ -296,6 +515,20 @@ func (*Order_DisabledStack) isOrder_Message() {}
 
 func (*Order_EnabledStack) isOrder_Message() {}
 
+func (*Order_Ack) isOrder_Message() {}
+
+func (*Order_Resync) isOrder_Message() {}
+
+func (*Order_ConfigUpdate) isOrder_Message() {}
+
+func (*Order_UpsertVersions) isOrder_Message() {}
+
+func (*Order_DeleteVersions) isOrder_Message() {}
+
+func (*Order_RestartModule) isOrder_Message() {}
+
+func (*Order_RotateStackCredentials) isOrder_Message() {}
+
 type Message struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Message:
@@ -308,8 +541,20 @@ type Message struct {
 	//	*Message_ModuleStatusChanged
 	//	*Message_ModuleDeleted
 	//	*Message_StackDeleted
-	Message       isMessage_Message `protobuf_oneof:"message"`
-	Metadata      map[string]string `protobuf:"bytes,9,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	//	*Message_Snapshot
+	//	*Message_Ack
+	//	*Message_OrderResult
+	//	*Message_MessageBatch
+	//	*Message_GatewayHostsChanged
+	Message  isMessage_Message `protobuf_oneof:"message"`
+	Metadata map[string]string `protobuf:"bytes,9,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// sequence is set on messages which must be acknowledged by the server. It
+	// increases monotonically but may have gaps, and is never reused for a
+	// given agent, even across restarts. A message sent again after a
+	// reconnection or a restart of the agent keeps its sequence, so that the
+	// server can ignore it if it was already received. 0 means the message is
+	// not sequenced.
+	Sequence      uint64 `protobuf:"varint,12,opt,name=sequence,proto3" json:"sequence,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -423,6 +668,51 @@ func (x *Message) GetStackDeleted() *DeletedStack {
 	return nil
 }
 
+func (x *Message) GetSnapshot() *Snapshot {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Snapshot); ok {
+			return x.Snapshot
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetAck() *Ack {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Ack); ok {
+			return x.Ack
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetOrderResult() *OrderResult {
+	if x != nil {
+		if x, ok := x.Message.(*Message_OrderResult); ok {
+			return x.OrderResult
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetMessageBatch() *MessageBatch {
+	if x != nil {
+		if x, ok := x.Message.(*Message_MessageBatch); ok {
+			return x.MessageBatch
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetGatewayHostsChanged() *GatewayHostsChanged {
+	if x != nil {
+		if x, ok := x.Message.(*Message_GatewayHostsChanged); ok {
+			return x.GatewayHostsChanged
+		}
+	}
+	return nil
+}
+
 func (x *Message) GetMetadata() map[string]string {
 	if x != nil {
 		return x.Metadata
@@ -430,6 +720,13 @@ func (x *Message) GetMetadata() map[string]string {
 	return nil
 }
 
+func (x *Message) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
 type isMessage_Message interface {
 	isMessage_Message()
 }
@@ -466,6 +763,26 @@ type Message_StackDeleted struct {
 	StackDeleted *DeletedStack `protobuf:"bytes,8,opt,name=stackDeleted,proto3,oneof"`
 }
 
+type Message_Snapshot struct {
+	Snapshot *Snapshot `protobuf:"bytes,10,opt,name=snapshot,proto3,oneof"`
+}
+
+type Message_Ack struct {
+	Ack *Ack `protobuf:"bytes,11,opt,name=ack,proto3,oneof"`
+}
+
+type Message_OrderResult struct {
+	OrderResult *OrderResult `protobuf:"bytes,13,opt,name=orderResult,proto3,oneof"`
+}
+
+type Message_MessageBatch struct {
+	MessageBatch *MessageBatch `protobuf:"bytes,14,opt,name=messageBatch,proto3,oneof"`
+}
+
+type Message_GatewayHostsChanged struct {
+	GatewayHostsChanged *GatewayHostsChanged `protobuf:"bytes,15,opt,name=gatewayHostsChanged,proto3,oneof"`
+}
+
 func (*Message_StatusChanged) isMessage_Message() {}
 
 func (*Message_Pong) isMessage_Message() {}
@@ -482,10 +799,28 @@ func (*Message_ModuleDeleted) isMessage_Message() {}
 
 func (*Message_StackDeleted) isMessage_Message() {}
 
+func (*Message_Snapshot) isMessage_Message() {}
+
+func (*Message_Ack) isMessage_Message() {}
+
+func (*Message_OrderResult) isMessage_Message() {}
+
+func (*Message_MessageBatch) isMessage_Message() {}
+
+func (*Message_GatewayHostsChanged) isMessage_Message() {}
+
+// Connected must be the first order of a session for the optional features
+// to be negotiated. Agents whose first order is something else, or which do
+// not receive it in time, go on without optional features.
 type Connected struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// capabilities lists the optional features supported by the server, each
+	// one is enabled only if the agent advertised it too.
+	Capabilities []string `protobuf:"bytes,1,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	// protocolVersion is the version of the protocol implemented by the server.
+	ProtocolVersion uint32 `protobuf:"varint,2,opt,name=protocolVersion,proto3" json:"protocolVersion,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
 }
 
 func (x *Connected) Reset() {
@@ -518,26 +853,43 @@ func (*Connected) Descriptor() ([]byte, []int) {
 	return file_agent_proto_rawDescGZIP(), []int{3}
 }
 
-type Ping struct {
+func (x *Connected) GetCapabilities() []string {
+	if x != nil {
+		return x.Capabilities
+	}
+	return nil
+}
+
+func (x *Connected) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+// MessageBatch packs messages sent in a single frame, each of them keeping its
+// own sequence. Only sent to servers advertising the MESSAGE_BATCH capability.
+type MessageBatch struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	Messages      []*Message             `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Ping) Reset() {
-	*x = Ping{}
+func (x *MessageBatch) Reset() {
+	*x = MessageBatch{}
 	mi := &file_agent_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Ping) String() string {
+func (x *MessageBatch) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Ping) ProtoMessage() {}
+func (*MessageBatch) ProtoMessage() {}
 
-func (x *Ping) ProtoReflect() protoreflect.Message {
+func (x *MessageBatch) ProtoReflect() protoreflect.Message {
 	mi := &file_agent_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -549,31 +901,40 @@ func (x *Ping) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Ping.ProtoReflect.Descriptor instead.
-func (*Ping) Descriptor() ([]byte, []int) {
+// Deprecated: Use MessageBatch.ProtoReflect.Descriptor instead.
+func (*MessageBatch) Descriptor() ([]byte, []int) {
 	return file_agent_proto_rawDescGZIP(), []int{4}
 }
 
-type Pong struct {
+func (x *MessageBatch) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+// Ack acknowledges every sequence number up to and including sequence.
+type Ack struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sequence      uint64                 `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Pong) Reset() {
-	*x = Pong{}
+func (x *Ack) Reset() {
+	*x = Ack{}
 	mi := &file_agent_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Pong) String() string {
+func (x *Ack) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Pong) ProtoMessage() {}
+func (*Ack) ProtoMessage() {}
 
-func (x *Pong) ProtoReflect() protoreflect.Message {
+func (x *Ack) ProtoReflect() protoreflect.Message {
 	mi := &file_agent_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -585,41 +946,38 @@ func (x *Pong) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Pong.ProtoReflect.Descriptor instead.
-func (*Pong) Descriptor() ([]byte, []int) {
+// Deprecated: Use Ack.ProtoReflect.Descriptor instead.
+func (*Ack) Descriptor() ([]byte, []int) {
 	return file_agent_proto_rawDescGZIP(), []int{5}
 }
 
-type Stack struct {
-	state                 protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName           string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
-	Seed                  string                 `protobuf:"bytes,2,opt,name=seed,proto3" json:"seed,omitempty"`
-	AuthConfig            *AuthConfig            `protobuf:"bytes,3,opt,name=authConfig,proto3" json:"authConfig,omitempty"`
-	StaticClients         []*AuthClient          `protobuf:"bytes,4,rep,name=staticClients,proto3" json:"staticClients,omitempty"`
-	StargateConfig        *StargateConfig        `protobuf:"bytes,5,opt,name=stargateConfig,proto3" json:"stargateConfig,omitempty"`
-	Disabled              bool                   `protobuf:"varint,6,opt,name=disabled,proto3" json:"disabled,omitempty"`
-	Versions              string                 `protobuf:"bytes,8,opt,name=versions,proto3" json:"versions,omitempty"`
-	AdditionalLabels      map[string]string      `protobuf:"bytes,10,rep,name=additionalLabels,proto3" json:"additionalLabels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	AdditionalAnnotations map[string]string      `protobuf:"bytes,11,rep,name=additionalAnnotations,proto3" json:"additionalAnnotations,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	Modules               []*Module              `protobuf:"bytes,12,rep,name=modules,proto3" json:"modules,omitempty"`
-	unknownFields         protoimpl.UnknownFields
-	sizeCache             protoimpl.SizeCache
+func (x *Ack) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
 }
 
-func (x *Stack) Reset() {
-	*x = Stack{}
+type Ping struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ping) Reset() {
+	*x = Ping{}
 	mi := &file_agent_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Stack) String() string {
+func (x *Ping) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Stack) ProtoMessage() {}
+func (*Ping) ProtoMessage() {}
 
-func (x *Stack) ProtoReflect() protoreflect.Message {
+func (x *Ping) ProtoReflect() protoreflect.Message {
 	mi := &file_agent_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -631,23 +989,131 @@ func (x *Stack) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Stack.ProtoReflect.Descriptor instead.
-func (*Stack) Descriptor() ([]byte, []int) {
+// Deprecated: Use Ping.ProtoReflect.Descriptor instead.
+func (*Ping) Descriptor() ([]byte, []int) {
 	return file_agent_proto_rawDescGZIP(), []int{6}
 }
 
-func (x *Stack) GetClusterName() string {
-	if x != nil {
-		return x.ClusterName
-	}
-	return ""
-}
-
-func (x *Stack) GetSeed() string {
-	if x != nil {
-		return x.Seed
-	}
-	return ""
+type Pong struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Pong) Reset() {
+	*x = Pong{}
+	mi := &file_agent_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Pong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Pong) ProtoMessage() {}
+
+func (x *Pong) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Pong.ProtoReflect.Descriptor instead.
+func (*Pong) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{7}
+}
+
+type Stack struct {
+	state                 protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName           string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	Seed                  string                 `protobuf:"bytes,2,opt,name=seed,proto3" json:"seed,omitempty"`
+	AuthConfig            *AuthConfig            `protobuf:"bytes,3,opt,name=authConfig,proto3" json:"authConfig,omitempty"`
+	StaticClients         []*AuthClient          `protobuf:"bytes,4,rep,name=staticClients,proto3" json:"staticClients,omitempty"`
+	StargateConfig        *StargateConfig        `protobuf:"bytes,5,opt,name=stargateConfig,proto3" json:"stargateConfig,omitempty"`
+	Disabled              bool                   `protobuf:"varint,6,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	Versions              string                 `protobuf:"bytes,8,opt,name=versions,proto3" json:"versions,omitempty"`
+	AdditionalLabels      map[string]string      `protobuf:"bytes,10,rep,name=additionalLabels,proto3" json:"additionalLabels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	AdditionalAnnotations map[string]string      `protobuf:"bytes,11,rep,name=additionalAnnotations,proto3" json:"additionalAnnotations,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Modules               []*Module              `protobuf:"bytes,12,rep,name=modules,proto3" json:"modules,omitempty"`
+	// versionOverrides maps module names to the version used by this stack in
+	// place of the one of its versions. The agent derives a Versions object
+	// named <clusterName>-versions for the stack from them, and derives it
+	// again when the base versions change.
+	VersionOverrides map[string]string `protobuf:"bytes,13,rep,name=versionOverrides,proto3" json:"versionOverrides,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// settings are reconciled into Settings objects owned by the stack.
+	Settings []*StackSetting `protobuf:"bytes,14,rep,name=settings,proto3" json:"settings,omitempty"`
+	// customDomains are served by the gateway of the stack, in addition to the
+	// hosts derived from the base urls of the agent. They are written to the
+	// ingress.additionalHosts field of the Gateway, and reported as a warning
+	// of the order when the Gateway CRD does not declare it.
+	CustomDomains []string `protobuf:"bytes,15,rep,name=customDomains,proto3" json:"customDomains,omitempty"`
+	// organizationId and stackId identify the stack on the platform. When
+	// unset, they are parsed from clusterName, as <organizationId>-<stackId>.
+	OrganizationId string `protobuf:"bytes,16,opt,name=organizationId,proto3" json:"organizationId,omitempty"`
+	StackId        string `protobuf:"bytes,17,opt,name=stackId,proto3" json:"stackId,omitempty"`
+	// nodeSelector, tolerations and affinity constrain the nodes the
+	// deployments of the stack are scheduled on. They are translated into
+	// Settings objects of the stack.
+	NodeSelector map[string]string `protobuf:"bytes,18,rep,name=nodeSelector,proto3" json:"nodeSelector,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Tolerations  []*Toleration     `protobuf:"bytes,19,rep,name=tolerations,proto3" json:"tolerations,omitempty"`
+	// affinity is a Kubernetes Affinity object.
+	Affinity *structpb.Struct `protobuf:"bytes,20,opt,name=affinity,proto3" json:"affinity,omitempty"`
+	// expiresAt is the time after which the agent deletes the stack, even if
+	// it is disconnected from membership. Unset for stacks which do not expire.
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,21,opt,name=expiresAt,proto3" json:"expiresAt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stack) Reset() {
+	*x = Stack{}
+	mi := &file_agent_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stack) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stack) ProtoMessage() {}
+
+func (x *Stack) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stack.ProtoReflect.Descriptor instead.
+func (*Stack) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Stack) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
+}
+
+func (x *Stack) GetSeed() string {
+	if x != nil {
+		return x.Seed
+	}
+	return ""
 }
 
 func (x *Stack) GetAuthConfig() *AuthConfig {
@@ -694,40 +1160,758 @@ func (x *Stack) GetAdditionalLabels() map[string]string {
 
 func (x *Stack) GetAdditionalAnnotations() map[string]string {
 	if x != nil {
-		return x.AdditionalAnnotations
+		return x.AdditionalAnnotations
+	}
+	return nil
+}
+
+func (x *Stack) GetModules() []*Module {
+	if x != nil {
+		return x.Modules
+	}
+	return nil
+}
+
+func (x *Stack) GetVersionOverrides() map[string]string {
+	if x != nil {
+		return x.VersionOverrides
+	}
+	return nil
+}
+
+func (x *Stack) GetSettings() []*StackSetting {
+	if x != nil {
+		return x.Settings
+	}
+	return nil
+}
+
+func (x *Stack) GetCustomDomains() []string {
+	if x != nil {
+		return x.CustomDomains
+	}
+	return nil
+}
+
+func (x *Stack) GetOrganizationId() string {
+	if x != nil {
+		return x.OrganizationId
+	}
+	return ""
+}
+
+func (x *Stack) GetStackId() string {
+	if x != nil {
+		return x.StackId
+	}
+	return ""
+}
+
+func (x *Stack) GetNodeSelector() map[string]string {
+	if x != nil {
+		return x.NodeSelector
+	}
+	return nil
+}
+
+func (x *Stack) GetTolerations() []*Toleration {
+	if x != nil {
+		return x.Tolerations
+	}
+	return nil
+}
+
+func (x *Stack) GetAffinity() *structpb.Struct {
+	if x != nil {
+		return x.Affinity
+	}
+	return nil
+}
+
+func (x *Stack) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+type Toleration struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Key               string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Operator          string                 `protobuf:"bytes,2,opt,name=operator,proto3" json:"operator,omitempty"`
+	Value             string                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	Effect            string                 `protobuf:"bytes,4,opt,name=effect,proto3" json:"effect,omitempty"`
+	TolerationSeconds *int64                 `protobuf:"varint,5,opt,name=tolerationSeconds,proto3,oneof" json:"tolerationSeconds,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *Toleration) Reset() {
+	*x = Toleration{}
+	mi := &file_agent_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Toleration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Toleration) ProtoMessage() {}
+
+func (x *Toleration) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Toleration.ProtoReflect.Descriptor instead.
+func (*Toleration) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Toleration) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Toleration) GetOperator() string {
+	if x != nil {
+		return x.Operator
+	}
+	return ""
+}
+
+func (x *Toleration) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *Toleration) GetEffect() string {
+	if x != nil {
+		return x.Effect
+	}
+	return ""
+}
+
+func (x *Toleration) GetTolerationSeconds() int64 {
+	if x != nil && x.TolerationSeconds != nil {
+		return *x.TolerationSeconds
+	}
+	return 0
+}
+
+type StackSetting struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         string                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StackSetting) Reset() {
+	*x = StackSetting{}
+	mi := &file_agent_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StackSetting) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StackSetting) ProtoMessage() {}
+
+func (x *StackSetting) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StackSetting.ProtoReflect.Descriptor instead.
+func (*StackSetting) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *StackSetting) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *StackSetting) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type Module struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// spec is merged into the spec of the module object. Keys owned by the
+	// agent, like stack, take precedence. Keys sent previously and missing
+	// from spec are removed.
+	Spec *structpb.Struct `protobuf:"bytes,2,opt,name=spec,proto3" json:"spec,omitempty"`
+	// disabled is set on the spec of the module object, which is kept in the
+	// cluster. Modules absent from the stack are deleted. Disabling a module
+	// whose CRD has no disabled field fails and leaves it untouched.
+	Disabled      bool `protobuf:"varint,3,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Module) Reset() {
+	*x = Module{}
+	mi := &file_agent_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Module) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Module) ProtoMessage() {}
+
+func (x *Module) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Module.ProtoReflect.Descriptor instead.
+func (*Module) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Module) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Module) GetSpec() *structpb.Struct {
+	if x != nil {
+		return x.Spec
+	}
+	return nil
+}
+
+func (x *Module) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+type VersionKind struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       string                 `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Kind          string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VersionKind) Reset() {
+	*x = VersionKind{}
+	mi := &file_agent_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VersionKind) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VersionKind) ProtoMessage() {}
+
+func (x *VersionKind) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VersionKind.ProtoReflect.Descriptor instead.
+func (*VersionKind) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *VersionKind) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *VersionKind) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+type ModuleStatusChanged struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	Status        *structpb.Struct       `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	Vk            *VersionKind           `protobuf:"bytes,3,opt,name=vk,proto3" json:"vk,omitempty"`
+	Disabled      bool                   `protobuf:"varint,4,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ModuleStatusChanged) Reset() {
+	*x = ModuleStatusChanged{}
+	mi := &file_agent_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ModuleStatusChanged) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ModuleStatusChanged) ProtoMessage() {}
+
+func (x *ModuleStatusChanged) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ModuleStatusChanged.ProtoReflect.Descriptor instead.
+func (*ModuleStatusChanged) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ModuleStatusChanged) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
+}
+
+func (x *ModuleStatusChanged) GetStatus() *structpb.Struct {
+	if x != nil {
+		return x.Status
+	}
+	return nil
+}
+
+func (x *ModuleStatusChanged) GetVk() *VersionKind {
+	if x != nil {
+		return x.Vk
+	}
+	return nil
+}
+
+func (x *ModuleStatusChanged) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+// GatewayHostsChanged reports the readiness of each host served by the
+// ingresses of a stack.
+type GatewayHostsChanged struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	Hosts         []*HostStatus          `protobuf:"bytes,2,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GatewayHostsChanged) Reset() {
+	*x = GatewayHostsChanged{}
+	mi := &file_agent_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GatewayHostsChanged) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GatewayHostsChanged) ProtoMessage() {}
+
+func (x *GatewayHostsChanged) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GatewayHostsChanged.ProtoReflect.Descriptor instead.
+func (*GatewayHostsChanged) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *GatewayHostsChanged) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
+}
+
+func (x *GatewayHostsChanged) GetHosts() []*HostStatus {
+	if x != nil {
+		return x.Hosts
+	}
+	return nil
+}
+
+type HostStatus struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Host  string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	// ready is set once the ingress serving the host has been assigned an
+	// address by the ingress controller.
+	Ready         bool `protobuf:"varint,2,opt,name=ready,proto3" json:"ready,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HostStatus) Reset() {
+	*x = HostStatus{}
+	mi := &file_agent_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HostStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HostStatus) ProtoMessage() {}
+
+func (x *HostStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HostStatus.ProtoReflect.Descriptor instead.
+func (*HostStatus) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *HostStatus) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *HostStatus) GetReady() bool {
+	if x != nil {
+		return x.Ready
+	}
+	return false
+}
+
+type ModuleDeleted struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	Vk            *VersionKind           `protobuf:"bytes,2,opt,name=vk,proto3" json:"vk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ModuleDeleted) Reset() {
+	*x = ModuleDeleted{}
+	mi := &file_agent_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ModuleDeleted) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ModuleDeleted) ProtoMessage() {}
+
+func (x *ModuleDeleted) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ModuleDeleted.ProtoReflect.Descriptor instead.
+func (*ModuleDeleted) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *ModuleDeleted) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
+}
+
+func (x *ModuleDeleted) GetVk() *VersionKind {
+	if x != nil {
+		return x.Vk
+	}
+	return nil
+}
+
+type StatusChanged struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	Status        StackStatus            `protobuf:"varint,2,opt,name=status,proto3,enum=server.StackStatus" json:"status,omitempty"`
+	Statuses      *structpb.Struct       `protobuf:"bytes,3,opt,name=statuses,proto3" json:"statuses,omitempty"`
+	Vk            *VersionKind           `protobuf:"bytes,4,opt,name=vk,proto3" json:"vk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusChanged) Reset() {
+	*x = StatusChanged{}
+	mi := &file_agent_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusChanged) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusChanged) ProtoMessage() {}
+
+func (x *StatusChanged) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusChanged.ProtoReflect.Descriptor instead.
+func (*StatusChanged) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *StatusChanged) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
+}
+
+func (x *StatusChanged) GetStatus() StackStatus {
+	if x != nil {
+		return x.Status
+	}
+	return StackStatus_Progressing
+}
+
+func (x *StatusChanged) GetStatuses() *structpb.Struct {
+	if x != nil {
+		return x.Statuses
+	}
+	return nil
+}
+
+func (x *StatusChanged) GetVk() *VersionKind {
+	if x != nil {
+		return x.Vk
+	}
+	return nil
+}
+
+type StargateConfig struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Enabled       bool                   `protobuf:"varint,1,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	Url           string                 `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
+	DisableTLS    bool                   `protobuf:"varint,3,opt,name=disableTLS,proto3" json:"disableTLS,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StargateConfig) Reset() {
+	*x = StargateConfig{}
+	mi := &file_agent_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StargateConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StargateConfig) ProtoMessage() {}
+
+func (x *StargateConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StargateConfig.ProtoReflect.Descriptor instead.
+func (*StargateConfig) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *StargateConfig) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+func (x *StargateConfig) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *StargateConfig) GetDisableTLS() bool {
+	if x != nil {
+		return x.DisableTLS
+	}
+	return false
+}
+
+type DeletedStack struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	// reason is only set on the stackDeleted messages sent by the agent.
+	Reason        DeletionReason `protobuf:"varint,2,opt,name=reason,proto3,enum=server.DeletionReason" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeletedStack) Reset() {
+	*x = DeletedStack{}
+	mi := &file_agent_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeletedStack) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeletedStack) ProtoMessage() {}
+
+func (x *DeletedStack) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeletedStack.ProtoReflect.Descriptor instead.
+func (*DeletedStack) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *DeletedStack) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
 	}
-	return nil
+	return ""
 }
 
-func (x *Stack) GetModules() []*Module {
+func (x *DeletedStack) GetReason() DeletionReason {
 	if x != nil {
-		return x.Modules
+		return x.Reason
 	}
-	return nil
+	return DeletionReason_DeletionRequested
 }
 
-type Module struct {
+type DisabledStack struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Module) Reset() {
-	*x = Module{}
-	mi := &file_agent_proto_msgTypes[7]
+func (x *DisabledStack) Reset() {
+	*x = DisabledStack{}
+	mi := &file_agent_proto_msgTypes[20]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Module) String() string {
+func (x *DisabledStack) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Module) ProtoMessage() {}
+func (*DisabledStack) ProtoMessage() {}
 
-func (x *Module) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[7]
+func (x *DisabledStack) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[20]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -738,41 +1922,40 @@ func (x *Module) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Module.ProtoReflect.Descriptor instead.
-func (*Module) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{7}
+// Deprecated: Use DisabledStack.ProtoReflect.Descriptor instead.
+func (*DisabledStack) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{20}
 }
 
-func (x *Module) GetName() string {
+func (x *DisabledStack) GetClusterName() string {
 	if x != nil {
-		return x.Name
+		return x.ClusterName
 	}
 	return ""
 }
 
-type VersionKind struct {
+type EnabledStack struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Version       string                 `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
-	Kind          string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *VersionKind) Reset() {
-	*x = VersionKind{}
-	mi := &file_agent_proto_msgTypes[8]
+func (x *EnabledStack) Reset() {
+	*x = EnabledStack{}
+	mi := &file_agent_proto_msgTypes[21]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *VersionKind) String() string {
+func (x *EnabledStack) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*VersionKind) ProtoMessage() {}
+func (*EnabledStack) ProtoMessage() {}
 
-func (x *VersionKind) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[8]
+func (x *EnabledStack) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[21]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -783,49 +1966,47 @@ func (x *VersionKind) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use VersionKind.ProtoReflect.Descriptor instead.
-func (*VersionKind) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{8}
-}
-
-func (x *VersionKind) GetVersion() string {
-	if x != nil {
-		return x.Version
-	}
-	return ""
+// Deprecated: Use EnabledStack.ProtoReflect.Descriptor instead.
+func (*EnabledStack) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{21}
 }
 
-func (x *VersionKind) GetKind() string {
+func (x *EnabledStack) GetClusterName() string {
 	if x != nil {
-		return x.Kind
+		return x.ClusterName
 	}
 	return ""
 }
 
-type ModuleStatusChanged struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
-	Status        *structpb.Struct       `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
-	Vk            *VersionKind           `protobuf:"bytes,3,opt,name=vk,proto3" json:"vk,omitempty"`
+// UpsertVersions creates or replaces a Versions object managed by the agent.
+// Versions objects applied by hand, or derived for a stack, are left
+// untouched and reported as failed, as is a name reserved for the Versions
+// of an existing stack.
+type UpsertVersions struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// versions maps module names to their image tag.
+	Versions      map[string]string `protobuf:"bytes,2,rep,name=versions,proto3" json:"versions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Deprecated    bool              `protobuf:"varint,3,opt,name=deprecated,proto3" json:"deprecated,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ModuleStatusChanged) Reset() {
-	*x = ModuleStatusChanged{}
-	mi := &file_agent_proto_msgTypes[9]
+func (x *UpsertVersions) Reset() {
+	*x = UpsertVersions{}
+	mi := &file_agent_proto_msgTypes[22]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ModuleStatusChanged) String() string {
+func (x *UpsertVersions) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ModuleStatusChanged) ProtoMessage() {}
+func (*UpsertVersions) ProtoMessage() {}
 
-func (x *ModuleStatusChanged) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[9]
+func (x *UpsertVersions) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[22]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -836,55 +2017,56 @@ func (x *ModuleStatusChanged) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ModuleStatusChanged.ProtoReflect.Descriptor instead.
-func (*ModuleStatusChanged) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{9}
+// Deprecated: Use UpsertVersions.ProtoReflect.Descriptor instead.
+func (*UpsertVersions) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{22}
 }
 
-func (x *ModuleStatusChanged) GetClusterName() string {
+func (x *UpsertVersions) GetName() string {
 	if x != nil {
-		return x.ClusterName
+		return x.Name
 	}
 	return ""
 }
 
-func (x *ModuleStatusChanged) GetStatus() *structpb.Struct {
+func (x *UpsertVersions) GetVersions() map[string]string {
 	if x != nil {
-		return x.Status
+		return x.Versions
 	}
 	return nil
 }
 
-func (x *ModuleStatusChanged) GetVk() *VersionKind {
+func (x *UpsertVersions) GetDeprecated() bool {
 	if x != nil {
-		return x.Vk
+		return x.Deprecated
 	}
-	return nil
+	return false
 }
 
-type ModuleDeleted struct {
+// DeleteVersions deletes a Versions object managed by the agent. The Versions
+// derived for a stack are deleted with its version overrides.
+type DeleteVersions struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
-	Vk            *VersionKind           `protobuf:"bytes,2,opt,name=vk,proto3" json:"vk,omitempty"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ModuleDeleted) Reset() {
-	*x = ModuleDeleted{}
-	mi := &file_agent_proto_msgTypes[10]
+func (x *DeleteVersions) Reset() {
+	*x = DeleteVersions{}
+	mi := &file_agent_proto_msgTypes[23]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ModuleDeleted) String() string {
+func (x *DeleteVersions) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ModuleDeleted) ProtoMessage() {}
+func (*DeleteVersions) ProtoMessage() {}
 
-func (x *ModuleDeleted) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[10]
+func (x *DeleteVersions) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[23]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -895,50 +2077,48 @@ func (x *ModuleDeleted) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ModuleDeleted.ProtoReflect.Descriptor instead.
-func (*ModuleDeleted) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{10}
+// Deprecated: Use DeleteVersions.ProtoReflect.Descriptor instead.
+func (*DeleteVersions) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{23}
 }
 
-func (x *ModuleDeleted) GetClusterName() string {
+func (x *DeleteVersions) GetName() string {
 	if x != nil {
-		return x.ClusterName
+		return x.Name
 	}
 	return ""
 }
 
-func (x *ModuleDeleted) GetVk() *VersionKind {
-	if x != nil {
-		return x.Vk
-	}
-	return nil
-}
-
-type StatusChanged struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
-	Status        StackStatus            `protobuf:"varint,2,opt,name=status,proto3,enum=server.StackStatus" json:"status,omitempty"`
-	Statuses      *structpb.Struct       `protobuf:"bytes,3,opt,name=statuses,proto3" json:"statuses,omitempty"`
-	Vk            *VersionKind           `protobuf:"bytes,4,opt,name=vk,proto3" json:"vk,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
-}
-
-func (x *StatusChanged) Reset() {
-	*x = StatusChanged{}
-	mi := &file_agent_proto_msgTypes[11]
+// RestartModule restarts the deployments of a module of a stack, like
+// kubectl rollout restart. The order result is sent once the rollout is
+// complete, or when the agent stops.
+type RestartModule struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	// kind is the kind of the module, like "Ledger".
+	Kind string `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	// timeoutSeconds bounds the wait for the rollout, 0 means the default of
+	// the agent. It is capped to 10 minutes.
+	TimeoutSeconds uint32 `protobuf:"varint,3,opt,name=timeoutSeconds,proto3" json:"timeoutSeconds,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *RestartModule) Reset() {
+	*x = RestartModule{}
+	mi := &file_agent_proto_msgTypes[24]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *StatusChanged) String() string {
+func (x *RestartModule) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*StatusChanged) ProtoMessage() {}
+func (*RestartModule) ProtoMessage() {}
 
-func (x *StatusChanged) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[11]
+func (x *RestartModule) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[24]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -949,63 +2129,63 @@ func (x *StatusChanged) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use StatusChanged.ProtoReflect.Descriptor instead.
-func (*StatusChanged) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{11}
+// Deprecated: Use RestartModule.ProtoReflect.Descriptor instead.
+func (*RestartModule) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{24}
 }
 
-func (x *StatusChanged) GetClusterName() string {
+func (x *RestartModule) GetClusterName() string {
 	if x != nil {
 		return x.ClusterName
 	}
 	return ""
 }
 
-func (x *StatusChanged) GetStatus() StackStatus {
-	if x != nil {
-		return x.Status
-	}
-	return StackStatus_Progressing
-}
-
-func (x *StatusChanged) GetStatuses() *structpb.Struct {
+func (x *RestartModule) GetKind() string {
 	if x != nil {
-		return x.Statuses
+		return x.Kind
 	}
-	return nil
+	return ""
 }
 
-func (x *StatusChanged) GetVk() *VersionKind {
+func (x *RestartModule) GetTimeoutSeconds() uint32 {
 	if x != nil {
-		return x.Vk
+		return x.TimeoutSeconds
 	}
-	return nil
+	return 0
 }
 
-type StargateConfig struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Enabled       bool                   `protobuf:"varint,1,opt,name=enabled,proto3" json:"enabled,omitempty"`
-	Url           string                 `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
-	DisableTLS    bool                   `protobuf:"varint,3,opt,name=disableTLS,proto3" json:"disableTLS,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+// RotateStackCredentials replaces the client secret of the delegated OIDC
+// server in every object of the stack using it, then waits for them to be
+// ready again. The previous secret is restored if they are not ready within
+// the deadline. The next existingStack orders must carry the new secret in
+// their authConfig.
+type RotateStackCredentials struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName  string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	ClientSecret string                 `protobuf:"bytes,2,opt,name=clientSecret,proto3" json:"clientSecret,omitempty"`
+	// timeoutSeconds bounds the wait for the objects to be ready, 0 means the
+	// default of the agent.
+	TimeoutSeconds uint32 `protobuf:"varint,3,opt,name=timeoutSeconds,proto3" json:"timeoutSeconds,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
-func (x *StargateConfig) Reset() {
-	*x = StargateConfig{}
-	mi := &file_agent_proto_msgTypes[12]
+func (x *RotateStackCredentials) Reset() {
+	*x = RotateStackCredentials{}
+	mi := &file_agent_proto_msgTypes[25]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *StargateConfig) String() string {
+func (x *RotateStackCredentials) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*StargateConfig) ProtoMessage() {}
+func (*RotateStackCredentials) ProtoMessage() {}
 
-func (x *StargateConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[12]
+func (x *RotateStackCredentials) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[25]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1016,54 +2196,61 @@ func (x *StargateConfig) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use StargateConfig.ProtoReflect.Descriptor instead.
-func (*StargateConfig) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{12}
+// Deprecated: Use RotateStackCredentials.ProtoReflect.Descriptor instead.
+func (*RotateStackCredentials) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{25}
 }
 
-func (x *StargateConfig) GetEnabled() bool {
+func (x *RotateStackCredentials) GetClusterName() string {
 	if x != nil {
-		return x.Enabled
+		return x.ClusterName
 	}
-	return false
+	return ""
 }
 
-func (x *StargateConfig) GetUrl() string {
+func (x *RotateStackCredentials) GetClientSecret() string {
 	if x != nil {
-		return x.Url
+		return x.ClientSecret
 	}
 	return ""
 }
 
-func (x *StargateConfig) GetDisableTLS() bool {
+func (x *RotateStackCredentials) GetTimeoutSeconds() uint32 {
 	if x != nil {
-		return x.DisableTLS
+		return x.TimeoutSeconds
 	}
-	return false
+	return 0
 }
 
-type DeletedStack struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+// AgentConfig holds the settings of the agent which can be updated at
+// runtime. Unset fields are left unchanged by a configUpdate order.
+type AgentConfig struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Debug             *bool                  `protobuf:"varint,1,opt,name=debug,proto3,oneof" json:"debug,omitempty"`
+	WorkerConcurrency *uint32                `protobuf:"varint,2,opt,name=workerConcurrency,proto3,oneof" json:"workerConcurrency,omitempty"`
+	// sendRate is the number of frames sent per second, 0 disables the limit.
+	SendRate      *float64 `protobuf:"fixed64,3,opt,name=sendRate,proto3,oneof" json:"sendRate,omitempty"`
+	SendBurst     *uint32  `protobuf:"varint,4,opt,name=sendBurst,proto3,oneof" json:"sendBurst,omitempty"`
+	Outdated      *bool    `protobuf:"varint,5,opt,name=outdated,proto3,oneof" json:"outdated,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *DeletedStack) Reset() {
-	*x = DeletedStack{}
-	mi := &file_agent_proto_msgTypes[13]
+func (x *AgentConfig) Reset() {
+	*x = AgentConfig{}
+	mi := &file_agent_proto_msgTypes[26]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *DeletedStack) String() string {
+func (x *AgentConfig) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*DeletedStack) ProtoMessage() {}
+func (*AgentConfig) ProtoMessage() {}
 
-func (x *DeletedStack) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[13]
+func (x *AgentConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[26]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1074,84 +2261,73 @@ func (x *DeletedStack) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use DeletedStack.ProtoReflect.Descriptor instead.
-func (*DeletedStack) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{13}
+// Deprecated: Use AgentConfig.ProtoReflect.Descriptor instead.
+func (*AgentConfig) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{26}
 }
 
-func (x *DeletedStack) GetClusterName() string {
-	if x != nil {
-		return x.ClusterName
+func (x *AgentConfig) GetDebug() bool {
+	if x != nil && x.Debug != nil {
+		return *x.Debug
 	}
-	return ""
-}
-
-type DisabledStack struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
-}
-
-func (x *DisabledStack) Reset() {
-	*x = DisabledStack{}
-	mi := &file_agent_proto_msgTypes[14]
-	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-	ms.StoreMessageInfo(mi)
+	return false
 }
 
-func (x *DisabledStack) String() string {
-	return protoimpl.X.MessageStringOf(x)
+func (x *AgentConfig) GetWorkerConcurrency() uint32 {
+	if x != nil && x.WorkerConcurrency != nil {
+		return *x.WorkerConcurrency
+	}
+	return 0
 }
 
-func (*DisabledStack) ProtoMessage() {}
-
-func (x *DisabledStack) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[14]
-	if x != nil {
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		if ms.LoadMessageInfo() == nil {
-			ms.StoreMessageInfo(mi)
-		}
-		return ms
+func (x *AgentConfig) GetSendRate() float64 {
+	if x != nil && x.SendRate != nil {
+		return *x.SendRate
 	}
-	return mi.MessageOf(x)
+	return 0
 }
 
-// Deprecated: Use DisabledStack.ProtoReflect.Descriptor instead.
-func (*DisabledStack) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{14}
+func (x *AgentConfig) GetSendBurst() uint32 {
+	if x != nil && x.SendBurst != nil {
+		return *x.SendBurst
+	}
+	return 0
 }
 
-func (x *DisabledStack) GetClusterName() string {
-	if x != nil {
-		return x.ClusterName
+func (x *AgentConfig) GetOutdated() bool {
+	if x != nil && x.Outdated != nil {
+		return *x.Outdated
 	}
-	return ""
+	return false
 }
 
-type EnabledStack struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ClusterName   string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+// Resync asks the agent to report again the state of the matching objects,
+// as read from its informer caches. Empty fields match everything.
+type Resync struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	ClusterName string                 `protobuf:"bytes,1,opt,name=clusterName,proto3" json:"clusterName,omitempty"`
+	// kind is the kind of the objects to report, "Stack", "Versions" or the
+	// kind of a module.
+	Kind          string `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *EnabledStack) Reset() {
-	*x = EnabledStack{}
-	mi := &file_agent_proto_msgTypes[15]
+func (x *Resync) Reset() {
+	*x = Resync{}
+	mi := &file_agent_proto_msgTypes[27]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *EnabledStack) String() string {
+func (x *Resync) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*EnabledStack) ProtoMessage() {}
+func (*Resync) ProtoMessage() {}
 
-func (x *EnabledStack) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[15]
+func (x *Resync) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[27]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1162,14 +2338,21 @@ func (x *EnabledStack) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use EnabledStack.ProtoReflect.Descriptor instead.
-func (*EnabledStack) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{15}
+// Deprecated: Use Resync.ProtoReflect.Descriptor instead.
+func (*Resync) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *Resync) GetClusterName() string {
+	if x != nil {
+		return x.ClusterName
+	}
+	return ""
 }
 
-func (x *EnabledStack) GetClusterName() string {
+func (x *Resync) GetKind() string {
 	if x != nil {
-		return x.ClusterName
+		return x.Kind
 	}
 	return ""
 }
@@ -1185,7 +2368,7 @@ type AuthConfig struct {
 
 func (x *AuthConfig) Reset() {
 	*x = AuthConfig{}
-	mi := &file_agent_proto_msgTypes[16]
+	mi := &file_agent_proto_msgTypes[28]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1197,7 +2380,7 @@ func (x *AuthConfig) String() string {
 func (*AuthConfig) ProtoMessage() {}
 
 func (x *AuthConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[16]
+	mi := &file_agent_proto_msgTypes[28]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1210,7 +2393,7 @@ func (x *AuthConfig) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AuthConfig.ProtoReflect.Descriptor instead.
 func (*AuthConfig) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{16}
+	return file_agent_proto_rawDescGZIP(), []int{28}
 }
 
 func (x *AuthConfig) GetClientId() string {
@@ -1235,16 +2418,23 @@ func (x *AuthConfig) GetIssuer() string {
 }
 
 type AuthClient struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Public        bool                   `protobuf:"varint,1,opt,name=public,proto3" json:"public,omitempty"`
-	Id            string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	state                  protoimpl.MessageState `protogen:"open.v1"`
+	Public                 bool                   `protobuf:"varint,1,opt,name=public,proto3" json:"public,omitempty"`
+	Id                     string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	Name                   string                 `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	RedirectUris           []string               `protobuf:"bytes,4,rep,name=redirectUris,proto3" json:"redirectUris,omitempty"`
+	PostLogoutRedirectUris []string               `protobuf:"bytes,5,rep,name=postLogoutRedirectUris,proto3" json:"postLogoutRedirectUris,omitempty"`
+	Scopes                 []string               `protobuf:"bytes,6,rep,name=scopes,proto3" json:"scopes,omitempty"`
+	// secret is stored in a Secret of the stack namespace, referenced by the
+	// AuthClient object. Empty for public clients.
+	Secret        string `protobuf:"bytes,7,opt,name=secret,proto3" json:"secret,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *AuthClient) Reset() {
 	*x = AuthClient{}
-	mi := &file_agent_proto_msgTypes[17]
+	mi := &file_agent_proto_msgTypes[29]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1256,7 +2446,7 @@ func (x *AuthClient) String() string {
 func (*AuthClient) ProtoMessage() {}
 
 func (x *AuthClient) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[17]
+	mi := &file_agent_proto_msgTypes[29]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1269,7 +2459,7 @@ func (x *AuthClient) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AuthClient.ProtoReflect.Descriptor instead.
 func (*AuthClient) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{17}
+	return file_agent_proto_rawDescGZIP(), []int{29}
 }
 
 func (x *AuthClient) GetPublic() bool {
@@ -1286,6 +2476,41 @@ func (x *AuthClient) GetId() string {
 	return ""
 }
 
+func (x *AuthClient) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AuthClient) GetRedirectUris() []string {
+	if x != nil {
+		return x.RedirectUris
+	}
+	return nil
+}
+
+func (x *AuthClient) GetPostLogoutRedirectUris() []string {
+	if x != nil {
+		return x.PostLogoutRedirectUris
+	}
+	return nil
+}
+
+func (x *AuthClient) GetScopes() []string {
+	if x != nil {
+		return x.Scopes
+	}
+	return nil
+}
+
+func (x *AuthClient) GetSecret() string {
+	if x != nil {
+		return x.Secret
+	}
+	return ""
+}
+
 type AddedVersion struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -1297,7 +2522,7 @@ type AddedVersion struct {
 
 func (x *AddedVersion) Reset() {
 	*x = AddedVersion{}
-	mi := &file_agent_proto_msgTypes[18]
+	mi := &file_agent_proto_msgTypes[30]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1309,7 +2534,7 @@ func (x *AddedVersion) String() string {
 func (*AddedVersion) ProtoMessage() {}
 
 func (x *AddedVersion) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[18]
+	mi := &file_agent_proto_msgTypes[30]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1322,7 +2547,7 @@ func (x *AddedVersion) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AddedVersion.ProtoReflect.Descriptor instead.
 func (*AddedVersion) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{18}
+	return file_agent_proto_rawDescGZIP(), []int{30}
 }
 
 func (x *AddedVersion) GetName() string {
@@ -1357,7 +2582,7 @@ type UpdatedVersion struct {
 
 func (x *UpdatedVersion) Reset() {
 	*x = UpdatedVersion{}
-	mi := &file_agent_proto_msgTypes[19]
+	mi := &file_agent_proto_msgTypes[31]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1369,7 +2594,7 @@ func (x *UpdatedVersion) String() string {
 func (*UpdatedVersion) ProtoMessage() {}
 
 func (x *UpdatedVersion) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[19]
+	mi := &file_agent_proto_msgTypes[31]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1382,7 +2607,7 @@ func (x *UpdatedVersion) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use UpdatedVersion.ProtoReflect.Descriptor instead.
 func (*UpdatedVersion) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{19}
+	return file_agent_proto_rawDescGZIP(), []int{31}
 }
 
 func (x *UpdatedVersion) GetName() string {
@@ -1415,7 +2640,7 @@ type DeletedVersion struct {
 
 func (x *DeletedVersion) Reset() {
 	*x = DeletedVersion{}
-	mi := &file_agent_proto_msgTypes[20]
+	mi := &file_agent_proto_msgTypes[32]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1427,7 +2652,7 @@ func (x *DeletedVersion) String() string {
 func (*DeletedVersion) ProtoMessage() {}
 
 func (x *DeletedVersion) ProtoReflect() protoreflect.Message {
-	mi := &file_agent_proto_msgTypes[20]
+	mi := &file_agent_proto_msgTypes[32]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1440,7 +2665,7 @@ func (x *DeletedVersion) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DeletedVersion.ProtoReflect.Descriptor instead.
 func (*DeletedVersion) Descriptor() ([]byte, []int) {
-	return file_agent_proto_rawDescGZIP(), []int{20}
+	return file_agent_proto_rawDescGZIP(), []int{32}
 }
 
 func (x *DeletedVersion) GetName() string {
@@ -1450,11 +2675,312 @@ func (x *DeletedVersion) GetName() string {
 	return ""
 }
 
+type GroupVersionKind struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Version       string                 `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Kind          string                 `protobuf:"bytes,3,opt,name=kind,proto3" json:"kind,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GroupVersionKind) Reset() {
+	*x = GroupVersionKind{}
+	mi := &file_agent_proto_msgTypes[33]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GroupVersionKind) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GroupVersionKind) ProtoMessage() {}
+
+func (x *GroupVersionKind) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[33]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GroupVersionKind.ProtoReflect.Descriptor instead.
+func (*GroupVersionKind) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{33}
+}
+
+func (x *GroupVersionKind) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *GroupVersionKind) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *GroupVersionKind) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+// ObjectResult is the outcome of an order on one cluster object. error is
+// set when the action failed.
+type ObjectResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Gvk           *GroupVersionKind      `protobuf:"bytes,1,opt,name=gvk,proto3" json:"gvk,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Action        ObjectAction           `protobuf:"varint,3,opt,name=action,proto3,enum=server.ObjectAction" json:"action,omitempty"`
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ObjectResult) Reset() {
+	*x = ObjectResult{}
+	mi := &file_agent_proto_msgTypes[34]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ObjectResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ObjectResult) ProtoMessage() {}
+
+func (x *ObjectResult) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[34]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ObjectResult.ProtoReflect.Descriptor instead.
+func (*ObjectResult) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{34}
+}
+
+func (x *ObjectResult) GetGvk() *GroupVersionKind {
+	if x != nil {
+		return x.Gvk
+	}
+	return nil
+}
+
+func (x *ObjectResult) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ObjectResult) GetAction() ObjectAction {
+	if x != nil {
+		return x.Action
+	}
+	return ObjectAction_ObjectUnchanged
+}
+
+func (x *ObjectResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+// OrderResult is sent once the agent has executed an order.
+type OrderResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CorrelationId string                 `protobuf:"bytes,1,opt,name=correlationId,proto3" json:"correlationId,omitempty"`
+	Success       bool                   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Objects       []*ObjectResult        `protobuf:"bytes,3,rep,name=objects,proto3" json:"objects,omitempty"`
+	// sequence of the order, if it was sequenced
+	Sequence uint64 `protobuf:"varint,4,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// unsupported is set when the agent does not know the order type.
+	Unsupported bool `protobuf:"varint,5,opt,name=unsupported,proto3" json:"unsupported,omitempty"`
+	// config is the effective configuration of the agent, set on the result
+	// of configUpdate orders.
+	Config *AgentConfig `protobuf:"bytes,6,opt,name=config,proto3" json:"config,omitempty"`
+	// warnings report issues which did not prevent the order from being
+	// executed, like scheduling constraints no node satisfies.
+	Warnings []string `protobuf:"bytes,7,rep,name=warnings,proto3" json:"warnings,omitempty"`
+	// notExecuted is set when the agent stopped before starting the order.
+	// The order was acknowledged, the server must send it again.
+	NotExecuted   bool `protobuf:"varint,8,opt,name=notExecuted,proto3" json:"notExecuted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OrderResult) Reset() {
+	*x = OrderResult{}
+	mi := &file_agent_proto_msgTypes[35]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OrderResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OrderResult) ProtoMessage() {}
+
+func (x *OrderResult) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[35]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OrderResult.ProtoReflect.Descriptor instead.
+func (*OrderResult) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{35}
+}
+
+func (x *OrderResult) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+func (x *OrderResult) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *OrderResult) GetObjects() []*ObjectResult {
+	if x != nil {
+		return x.Objects
+	}
+	return nil
+}
+
+func (x *OrderResult) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *OrderResult) GetUnsupported() bool {
+	if x != nil {
+		return x.Unsupported
+	}
+	return false
+}
+
+func (x *OrderResult) GetConfig() *AgentConfig {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+func (x *OrderResult) GetWarnings() []string {
+	if x != nil {
+		return x.Warnings
+	}
+	return nil
+}
+
+func (x *OrderResult) GetNotExecuted() bool {
+	if x != nil {
+		return x.NotExecuted
+	}
+	return false
+}
+
+// Snapshot lists every object the agent knows about. It is sent each time a
+// connection is opened, membership can reconcile its view from it in one pass.
+type Snapshot struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stacks        []*StatusChanged       `protobuf:"bytes,1,rep,name=stacks,proto3" json:"stacks,omitempty"`
+	Modules       []*ModuleStatusChanged `protobuf:"bytes,2,rep,name=modules,proto3" json:"modules,omitempty"`
+	Versions      []*AddedVersion        `protobuf:"bytes,3,rep,name=versions,proto3" json:"versions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Snapshot) Reset() {
+	*x = Snapshot{}
+	mi := &file_agent_proto_msgTypes[36]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Snapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Snapshot) ProtoMessage() {}
+
+func (x *Snapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[36]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{36}
+}
+
+func (x *Snapshot) GetStacks() []*StatusChanged {
+	if x != nil {
+		return x.Stacks
+	}
+	return nil
+}
+
+func (x *Snapshot) GetModules() []*ModuleStatusChanged {
+	if x != nil {
+		return x.Modules
+	}
+	return nil
+}
+
+func (x *Snapshot) GetVersions() []*AddedVersion {
+	if x != nil {
+		return x.Versions
+	}
+	return nil
+}
+
 var File_agent_proto protoreflect.FileDescriptor
 
 const file_agent_proto_rawDesc = "" +
 	"\n" +
-	"\vagent.proto\x12\x06server\x1a\x1cgoogle/protobuf/struct.proto\"\xc9\x01\n" +
+	"\vagent.proto\x12\x06server\x1a\x1cgoogle/protobuf/struct.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xc9\x01\n" +
 	"\x0eConnectRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x124\n" +
 	"\x04tags\x18\x02 \x03(\v2 .server.ConnectRequest.TagsEntryR\x04tags\x12\x18\n" +
@@ -1464,19 +2990,29 @@ const file_agent_proto_rawDesc = "" +
 	"production\x1a7\n" +
 	"\tTagsEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xd3\x03\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xb8\a\n" +
 	"\x05Order\x121\n" +
 	"\tconnected\x18\x01 \x01(\v2\x11.server.ConnectedH\x00R\tconnected\x125\n" +
 	"\rexistingStack\x18\x02 \x01(\v2\r.server.StackH\x00R\rexistingStack\x12:\n" +
 	"\fdeletedStack\x18\x03 \x01(\v2\x14.server.DeletedStackH\x00R\fdeletedStack\x12\"\n" +
 	"\x04ping\x18\x04 \x01(\v2\f.server.PingH\x00R\x04ping\x12=\n" +
 	"\rdisabledStack\x18\x06 \x01(\v2\x15.server.DisabledStackH\x00R\rdisabledStack\x12:\n" +
-	"\fenabledStack\x18\a \x01(\v2\x14.server.EnabledStackH\x00R\fenabledStack\x127\n" +
-	"\bmetadata\x18\b \x03(\v2\x1b.server.Order.MetadataEntryR\bmetadata\x1a;\n" +
+	"\fenabledStack\x18\a \x01(\v2\x14.server.EnabledStackH\x00R\fenabledStack\x12\x1f\n" +
+	"\x03ack\x18\t \x01(\v2\v.server.AckH\x00R\x03ack\x12(\n" +
+	"\x06resync\x18\f \x01(\v2\x0e.server.ResyncH\x00R\x06resync\x129\n" +
+	"\fconfigUpdate\x18\r \x01(\v2\x13.server.AgentConfigH\x00R\fconfigUpdate\x12@\n" +
+	"\x0eupsertVersions\x18\x0e \x01(\v2\x16.server.UpsertVersionsH\x00R\x0eupsertVersions\x12@\n" +
+	"\x0edeleteVersions\x18\x0f \x01(\v2\x16.server.DeleteVersionsH\x00R\x0edeleteVersions\x12=\n" +
+	"\rrestartModule\x18\x10 \x01(\v2\x15.server.RestartModuleH\x00R\rrestartModule\x12X\n" +
+	"\x16rotateStackCredentials\x18\x11 \x01(\v2\x1e.server.RotateStackCredentialsH\x00R\x16rotateStackCredentials\x127\n" +
+	"\bmetadata\x18\b \x03(\v2\x1b.server.Order.MetadataEntryR\bmetadata\x12$\n" +
+	"\rcorrelationId\x18\v \x01(\tR\rcorrelationId\x12\x1a\n" +
+	"\bsequence\x18\n" +
+	" \x01(\x04R\bsequence\x1a;\n" +
 	"\rMetadataEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\t\n" +
-	"\amessageJ\x04\b\x05\x10\x06\"\xfb\x04\n" +
+	"\amessageJ\x04\b\x05\x10\x06\"\xae\a\n" +
 	"\aMessage\x12=\n" +
 	"\rstatusChanged\x18\x01 \x01(\v2\x15.server.StatusChangedH\x00R\rstatusChanged\x12\"\n" +
 	"\x04pong\x18\x02 \x01(\v2\f.server.PongH\x00R\x04pong\x12:\n" +
@@ -1485,15 +3021,28 @@ const file_agent_proto_rawDesc = "" +
 	"\x0eupdatedVersion\x18\x05 \x01(\v2\x16.server.UpdatedVersionH\x00R\x0eupdatedVersion\x12O\n" +
 	"\x13moduleStatusChanged\x18\x06 \x01(\v2\x1b.server.ModuleStatusChangedH\x00R\x13moduleStatusChanged\x12=\n" +
 	"\rmoduleDeleted\x18\a \x01(\v2\x15.server.ModuleDeletedH\x00R\rmoduleDeleted\x12:\n" +
-	"\fstackDeleted\x18\b \x01(\v2\x14.server.DeletedStackH\x00R\fstackDeleted\x129\n" +
-	"\bmetadata\x18\t \x03(\v2\x1d.server.Message.MetadataEntryR\bmetadata\x1a;\n" +
+	"\fstackDeleted\x18\b \x01(\v2\x14.server.DeletedStackH\x00R\fstackDeleted\x12.\n" +
+	"\bsnapshot\x18\n" +
+	" \x01(\v2\x10.server.SnapshotH\x00R\bsnapshot\x12\x1f\n" +
+	"\x03ack\x18\v \x01(\v2\v.server.AckH\x00R\x03ack\x127\n" +
+	"\vorderResult\x18\r \x01(\v2\x13.server.OrderResultH\x00R\vorderResult\x12:\n" +
+	"\fmessageBatch\x18\x0e \x01(\v2\x14.server.MessageBatchH\x00R\fmessageBatch\x12O\n" +
+	"\x13gatewayHostsChanged\x18\x0f \x01(\v2\x1b.server.GatewayHostsChangedH\x00R\x13gatewayHostsChanged\x129\n" +
+	"\bmetadata\x18\t \x03(\v2\x1d.server.Message.MetadataEntryR\bmetadata\x12\x1a\n" +
+	"\bsequence\x18\f \x01(\x04R\bsequence\x1a;\n" +
 	"\rMetadataEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\t\n" +
-	"\amessage\"\v\n" +
-	"\tConnected\"\x06\n" +
+	"\amessage\"Y\n" +
+	"\tConnected\x12\"\n" +
+	"\fcapabilities\x18\x01 \x03(\tR\fcapabilities\x12(\n" +
+	"\x0fprotocolVersion\x18\x02 \x01(\rR\x0fprotocolVersion\";\n" +
+	"\fMessageBatch\x12+\n" +
+	"\bmessages\x18\x01 \x03(\v2\x0f.server.MessageR\bmessages\"!\n" +
+	"\x03Ack\x12\x1a\n" +
+	"\bsequence\x18\x01 \x01(\x04R\bsequence\"\x06\n" +
 	"\x04Ping\"\x06\n" +
-	"\x04Pong\"\x99\x05\n" +
+	"\x04Pong\"\xf4\t\n" +
 	"\x05Stack\x12 \n" +
 	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12\x12\n" +
 	"\x04seed\x18\x02 \x01(\tR\x04seed\x122\n" +
@@ -1507,23 +3056,59 @@ const file_agent_proto_rawDesc = "" +
 	"\x10additionalLabels\x18\n" +
 	" \x03(\v2#.server.Stack.AdditionalLabelsEntryR\x10additionalLabels\x12^\n" +
 	"\x15additionalAnnotations\x18\v \x03(\v2(.server.Stack.AdditionalAnnotationsEntryR\x15additionalAnnotations\x12(\n" +
-	"\amodules\x18\f \x03(\v2\x0e.server.ModuleR\amodules\x1aC\n" +
+	"\amodules\x18\f \x03(\v2\x0e.server.ModuleR\amodules\x12O\n" +
+	"\x10versionOverrides\x18\r \x03(\v2#.server.Stack.VersionOverridesEntryR\x10versionOverrides\x120\n" +
+	"\bsettings\x18\x0e \x03(\v2\x14.server.StackSettingR\bsettings\x12$\n" +
+	"\rcustomDomains\x18\x0f \x03(\tR\rcustomDomains\x12&\n" +
+	"\x0eorganizationId\x18\x10 \x01(\tR\x0eorganizationId\x12\x18\n" +
+	"\astackId\x18\x11 \x01(\tR\astackId\x12C\n" +
+	"\fnodeSelector\x18\x12 \x03(\v2\x1f.server.Stack.NodeSelectorEntryR\fnodeSelector\x124\n" +
+	"\vtolerations\x18\x13 \x03(\v2\x12.server.TolerationR\vtolerations\x123\n" +
+	"\baffinity\x18\x14 \x01(\v2\x17.google.protobuf.StructR\baffinity\x128\n" +
+	"\texpiresAt\x18\x15 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\x1aC\n" +
 	"\x15AdditionalLabelsEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1aH\n" +
 	"\x1aAdditionalAnnotationsEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1aC\n" +
+	"\x15VersionOverridesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a?\n" +
+	"\x11NodeSelectorEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01J\x04\b\a\x10\bJ\x04\b\t\x10\n" +
-	"\"\x1c\n" +
+	"\"\xb1\x01\n" +
+	"\n" +
+	"Toleration\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x1a\n" +
+	"\boperator\x18\x02 \x01(\tR\boperator\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\tR\x05value\x12\x16\n" +
+	"\x06effect\x18\x04 \x01(\tR\x06effect\x121\n" +
+	"\x11tolerationSeconds\x18\x05 \x01(\x03H\x00R\x11tolerationSeconds\x88\x01\x01B\x14\n" +
+	"\x12_tolerationSeconds\"6\n" +
+	"\fStackSetting\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value\"e\n" +
 	"\x06Module\x12\x12\n" +
-	"\x04name\x18\x01 \x01(\tR\x04name\";\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12+\n" +
+	"\x04spec\x18\x02 \x01(\v2\x17.google.protobuf.StructR\x04spec\x12\x1a\n" +
+	"\bdisabled\x18\x03 \x01(\bR\bdisabled\";\n" +
 	"\vVersionKind\x12\x18\n" +
 	"\aversion\x18\x01 \x01(\tR\aversion\x12\x12\n" +
-	"\x04kind\x18\x02 \x01(\tR\x04kind\"\x8d\x01\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\"\xa9\x01\n" +
 	"\x13ModuleStatusChanged\x12 \n" +
 	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12/\n" +
 	"\x06status\x18\x02 \x01(\v2\x17.google.protobuf.StructR\x06status\x12#\n" +
-	"\x02vk\x18\x03 \x01(\v2\x13.server.VersionKindR\x02vk\"V\n" +
+	"\x02vk\x18\x03 \x01(\v2\x13.server.VersionKindR\x02vk\x12\x1a\n" +
+	"\bdisabled\x18\x04 \x01(\bR\bdisabled\"a\n" +
+	"\x13GatewayHostsChanged\x12 \n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12(\n" +
+	"\x05hosts\x18\x02 \x03(\v2\x12.server.HostStatusR\x05hosts\"6\n" +
+	"\n" +
+	"HostStatus\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x14\n" +
+	"\x05ready\x18\x02 \x01(\bR\x05ready\"V\n" +
 	"\rModuleDeleted\x12 \n" +
 	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12#\n" +
 	"\x02vk\x18\x02 \x01(\v2\x13.server.VersionKindR\x02vk\"\xb8\x01\n" +
@@ -1537,22 +3122,62 @@ const file_agent_proto_rawDesc = "" +
 	"\x03url\x18\x02 \x01(\tR\x03url\x12\x1e\n" +
 	"\n" +
 	"disableTLS\x18\x03 \x01(\bR\n" +
-	"disableTLS\"0\n" +
+	"disableTLS\"`\n" +
 	"\fDeletedStack\x12 \n" +
-	"\vclusterName\x18\x01 \x01(\tR\vclusterName\"1\n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12.\n" +
+	"\x06reason\x18\x02 \x01(\x0e2\x16.server.DeletionReasonR\x06reason\"1\n" +
 	"\rDisabledStack\x12 \n" +
 	"\vclusterName\x18\x01 \x01(\tR\vclusterName\"0\n" +
 	"\fEnabledStack\x12 \n" +
-	"\vclusterName\x18\x01 \x01(\tR\vclusterName\"d\n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\"\xc3\x01\n" +
+	"\x0eUpsertVersions\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12@\n" +
+	"\bversions\x18\x02 \x03(\v2$.server.UpsertVersions.VersionsEntryR\bversions\x12\x1e\n" +
+	"\n" +
+	"deprecated\x18\x03 \x01(\bR\n" +
+	"deprecated\x1a;\n" +
+	"\rVersionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"$\n" +
+	"\x0eDeleteVersions\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"m\n" +
+	"\rRestartModule\x12 \n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\x12&\n" +
+	"\x0etimeoutSeconds\x18\x03 \x01(\rR\x0etimeoutSeconds\"\x86\x01\n" +
+	"\x16RotateStackCredentials\x12 \n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12\"\n" +
+	"\fclientSecret\x18\x02 \x01(\tR\fclientSecret\x12&\n" +
+	"\x0etimeoutSeconds\x18\x03 \x01(\rR\x0etimeoutSeconds\"\x88\x02\n" +
+	"\vAgentConfig\x12\x19\n" +
+	"\x05debug\x18\x01 \x01(\bH\x00R\x05debug\x88\x01\x01\x121\n" +
+	"\x11workerConcurrency\x18\x02 \x01(\rH\x01R\x11workerConcurrency\x88\x01\x01\x12\x1f\n" +
+	"\bsendRate\x18\x03 \x01(\x01H\x02R\bsendRate\x88\x01\x01\x12!\n" +
+	"\tsendBurst\x18\x04 \x01(\rH\x03R\tsendBurst\x88\x01\x01\x12\x1f\n" +
+	"\boutdated\x18\x05 \x01(\bH\x04R\boutdated\x88\x01\x01B\b\n" +
+	"\x06_debugB\x14\n" +
+	"\x12_workerConcurrencyB\v\n" +
+	"\t_sendRateB\f\n" +
+	"\n" +
+	"_sendBurstB\v\n" +
+	"\t_outdated\">\n" +
+	"\x06Resync\x12 \n" +
+	"\vclusterName\x18\x01 \x01(\tR\vclusterName\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\"d\n" +
 	"\n" +
 	"AuthConfig\x12\x1a\n" +
 	"\bclientId\x18\x01 \x01(\tR\bclientId\x12\"\n" +
 	"\fclientSecret\x18\x02 \x01(\tR\fclientSecret\x12\x16\n" +
-	"\x06issuer\x18\x03 \x01(\tR\x06issuer\"4\n" +
+	"\x06issuer\x18\x03 \x01(\tR\x06issuer\"\xd4\x01\n" +
 	"\n" +
 	"AuthClient\x12\x16\n" +
 	"\x06public\x18\x01 \x01(\bR\x06public\x12\x0e\n" +
-	"\x02id\x18\x02 \x01(\tR\x02id\"\xbf\x01\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12\"\n" +
+	"\fredirectUris\x18\x04 \x03(\tR\fredirectUris\x126\n" +
+	"\x16postLogoutRedirectUris\x18\x05 \x03(\tR\x16postLogoutRedirectUris\x12\x16\n" +
+	"\x06scopes\x18\x06 \x03(\tR\x06scopes\x12\x16\n" +
+	"\x06secret\x18\a \x01(\tR\x06secret\"\xbf\x01\n" +
 	"\fAddedVersion\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12>\n" +
 	"\bversions\x18\x02 \x03(\v2\".server.AddedVersion.VersionsEntryR\bversions\x12\x1e\n" +
@@ -1572,12 +3197,42 @@ const file_agent_proto_rawDesc = "" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"$\n" +
 	"\x0eDeletedVersion\x12\x12\n" +
-	"\x04name\x18\x01 \x01(\tR\x04name*D\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"V\n" +
+	"\x10GroupVersionKind\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\tR\aversion\x12\x12\n" +
+	"\x04kind\x18\x03 \x01(\tR\x04kind\"\x92\x01\n" +
+	"\fObjectResult\x12*\n" +
+	"\x03gvk\x18\x01 \x01(\v2\x18.server.GroupVersionKindR\x03gvk\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12,\n" +
+	"\x06action\x18\x03 \x01(\x0e2\x14.server.ObjectActionR\x06action\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\"\xa6\x02\n" +
+	"\vOrderResult\x12$\n" +
+	"\rcorrelationId\x18\x01 \x01(\tR\rcorrelationId\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x12.\n" +
+	"\aobjects\x18\x03 \x03(\v2\x14.server.ObjectResultR\aobjects\x12\x1a\n" +
+	"\bsequence\x18\x04 \x01(\x04R\bsequence\x12 \n" +
+	"\vunsupported\x18\x05 \x01(\bR\vunsupported\x12+\n" +
+	"\x06config\x18\x06 \x01(\v2\x13.server.AgentConfigR\x06config\x12\x1a\n" +
+	"\bwarnings\x18\a \x03(\tR\bwarnings\x12 \n" +
+	"\vnotExecuted\x18\b \x01(\bR\vnotExecuted\"\xa2\x01\n" +
+	"\bSnapshot\x12-\n" +
+	"\x06stacks\x18\x01 \x03(\v2\x15.server.StatusChangedR\x06stacks\x125\n" +
+	"\amodules\x18\x02 \x03(\v2\x1b.server.ModuleStatusChangedR\amodules\x120\n" +
+	"\bversions\x18\x03 \x03(\v2\x14.server.AddedVersionR\bversions*D\n" +
 	"\vStackStatus\x12\x0f\n" +
 	"\vProgressing\x10\x00\x12\t\n" +
 	"\x05Ready\x10\x01\x12\v\n" +
 	"\aDeleted\x10\x02\x12\f\n" +
-	"\bDisabled\x10\x0326\n" +
+	"\bDisabled\x10\x03*<\n" +
+	"\x0eDeletionReason\x12\x15\n" +
+	"\x11DeletionRequested\x10\x00\x12\x13\n" +
+	"\x0fDeletionExpired\x10\x01*\\\n" +
+	"\fObjectAction\x12\x13\n" +
+	"\x0fObjectUnchanged\x10\x00\x12\x11\n" +
+	"\rObjectCreated\x10\x01\x12\x11\n" +
+	"\rObjectUpdated\x10\x02\x12\x11\n" +
+	"\rObjectDeleted\x10\x0326\n" +
 	"\x06Server\x12,\n" +
 	"\x04Join\x12\x0f.server.Message\x1a\r.server.Order\"\x00(\x010\x01B:Z8github.com/formancehq/membership/internal/grpc/generatedb\x06proto3"
 
@@ -1593,79 +3248,131 @@ func file_agent_proto_rawDescGZIP() []byte {
 	return file_agent_proto_rawDescData
 }
 
-var file_agent_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 28)
+var file_agent_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 47)
 var file_agent_proto_goTypes = []any{
-	(StackStatus)(0),            // 0: server.StackStatus
-	(*ConnectRequest)(nil),      // 1: server.ConnectRequest
-	(*Order)(nil),               // 2: server.Order
-	(*Message)(nil),             // 3: server.Message
-	(*Connected)(nil),           // 4: server.Connected
-	(*Ping)(nil),                // 5: server.Ping
-	(*Pong)(nil),                // 6: server.Pong
-	(*Stack)(nil),               // 7: server.Stack
-	(*Module)(nil),              // 8: server.Module
-	(*VersionKind)(nil),         // 9: server.VersionKind
-	(*ModuleStatusChanged)(nil), // 10: server.ModuleStatusChanged
-	(*ModuleDeleted)(nil),       // 11: server.ModuleDeleted
-	(*StatusChanged)(nil),       // 12: server.StatusChanged
-	(*StargateConfig)(nil),      // 13: server.StargateConfig
-	(*DeletedStack)(nil),        // 14: server.DeletedStack
-	(*DisabledStack)(nil),       // 15: server.DisabledStack
-	(*EnabledStack)(nil),        // 16: server.EnabledStack
-	(*AuthConfig)(nil),          // 17: server.AuthConfig
-	(*AuthClient)(nil),          // 18: server.AuthClient
-	(*AddedVersion)(nil),        // 19: server.AddedVersion
-	(*UpdatedVersion)(nil),      // 20: server.UpdatedVersion
-	(*DeletedVersion)(nil),      // 21: server.DeletedVersion
-	nil,                         // 22: server.ConnectRequest.TagsEntry
-	nil,                         // 23: server.Order.MetadataEntry
-	nil,                         // 24: server.Message.MetadataEntry
-	nil,                         // 25: server.Stack.AdditionalLabelsEntry
-	nil,                         // 26: server.Stack.AdditionalAnnotationsEntry
-	nil,                         // 27: server.AddedVersion.VersionsEntry
-	nil,                         // 28: server.UpdatedVersion.VersionsEntry
-	(*structpb.Struct)(nil),     // 29: google.protobuf.Struct
+	(StackStatus)(0),               // 0: server.StackStatus
+	(DeletionReason)(0),            // 1: server.DeletionReason
+	(ObjectAction)(0),              // 2: server.ObjectAction
+	(*ConnectRequest)(nil),         // 3: server.ConnectRequest
+	(*Order)(nil),                  // 4: server.Order
+	(*Message)(nil),                // 5: server.Message
+	(*Connected)(nil),              // 6: server.Connected
+	(*MessageBatch)(nil),           // 7: server.MessageBatch
+	(*Ack)(nil),                    // 8: server.Ack
+	(*Ping)(nil),                   // 9: server.Ping
+	(*Pong)(nil),                   // 10: server.Pong
+	(*Stack)(nil),                  // 11: server.Stack
+	(*Toleration)(nil),             // 12: server.Toleration
+	(*StackSetting)(nil),           // 13: server.StackSetting
+	(*Module)(nil),                 // 14: server.Module
+	(*VersionKind)(nil),            // 15: server.VersionKind
+	(*ModuleStatusChanged)(nil),    // 16: server.ModuleStatusChanged
+	(*GatewayHostsChanged)(nil),    // 17: server.GatewayHostsChanged
+	(*HostStatus)(nil),             // 18: server.HostStatus
+	(*ModuleDeleted)(nil),          // 19: server.ModuleDeleted
+	(*StatusChanged)(nil),          // 20: server.StatusChanged
+	(*StargateConfig)(nil),         // 21: server.StargateConfig
+	(*DeletedStack)(nil),           // 22: server.DeletedStack
+	(*DisabledStack)(nil),          // 23: server.DisabledStack
+	(*EnabledStack)(nil),           // 24: server.EnabledStack
+	(*UpsertVersions)(nil),         // 25: server.UpsertVersions
+	(*DeleteVersions)(nil),         // 26: server.DeleteVersions
+	(*RestartModule)(nil),          // 27: server.RestartModule
+	(*RotateStackCredentials)(nil), // 28: server.RotateStackCredentials
+	(*AgentConfig)(nil),            // 29: server.AgentConfig
+	(*Resync)(nil),                 // 30: server.Resync
+	(*AuthConfig)(nil),             // 31: server.AuthConfig
+	(*AuthClient)(nil),             // 32: server.AuthClient
+	(*AddedVersion)(nil),           // 33: server.AddedVersion
+	(*UpdatedVersion)(nil),         // 34: server.UpdatedVersion
+	(*DeletedVersion)(nil),         // 35: server.DeletedVersion
+	(*GroupVersionKind)(nil),       // 36: server.GroupVersionKind
+	(*ObjectResult)(nil),           // 37: server.ObjectResult
+	(*OrderResult)(nil),            // 38: server.OrderResult
+	(*Snapshot)(nil),               // 39: server.Snapshot
+	nil,                            // 40: server.ConnectRequest.TagsEntry
+	nil,                            // 41: server.Order.MetadataEntry
+	nil,                            // 42: server.Message.MetadataEntry
+	nil,                            // 43: server.Stack.AdditionalLabelsEntry
+	nil,                            // 44: server.Stack.AdditionalAnnotationsEntry
+	nil,                            // 45: server.Stack.VersionOverridesEntry
+	nil,                            // 46: server.Stack.NodeSelectorEntry
+	nil,                            // 47: server.UpsertVersions.VersionsEntry
+	nil,                            // 48: server.AddedVersion.VersionsEntry
+	nil,                            // 49: server.UpdatedVersion.VersionsEntry
+	(*structpb.Struct)(nil),        // 50: google.protobuf.Struct
+	(*timestamppb.Timestamp)(nil),  // 51: google.protobuf.Timestamp
 }
 var file_agent_proto_depIdxs = []int32{
-	22, // 0: server.ConnectRequest.tags:type_name -> server.ConnectRequest.TagsEntry
-	4,  // 1: server.Order.connected:type_name -> server.Connected
-	7,  // 2: server.Order.existingStack:type_name -> server.Stack
-	14, // 3: server.Order.deletedStack:type_name -> server.DeletedStack
-	5,  // 4: server.Order.ping:type_name -> server.Ping
-	15, // 5: server.Order.disabledStack:type_name -> server.DisabledStack
-	16, // 6: server.Order.enabledStack:type_name -> server.EnabledStack
-	23, // 7: server.Order.metadata:type_name -> server.Order.MetadataEntry
-	12, // 8: server.Message.statusChanged:type_name -> server.StatusChanged
-	6,  // 9: server.Message.pong:type_name -> server.Pong
-	19, // 10: server.Message.addedVersion:type_name -> server.AddedVersion
-	21, // 11: server.Message.deletedVersion:type_name -> server.DeletedVersion
-	20, // 12: server.Message.updatedVersion:type_name -> server.UpdatedVersion
-	10, // 13: server.Message.moduleStatusChanged:type_name -> server.ModuleStatusChanged
-	11, // 14: server.Message.moduleDeleted:type_name -> server.ModuleDeleted
-	14, // 15: server.Message.stackDeleted:type_name -> server.DeletedStack
-	24, // 16: server.Message.metadata:type_name -> server.Message.MetadataEntry
-	17, // 17: server.Stack.authConfig:type_name -> server.AuthConfig
-	18, // 18: server.Stack.staticClients:type_name -> server.AuthClient
-	13, // 19: server.Stack.stargateConfig:type_name -> server.StargateConfig
-	25, // 20: server.Stack.additionalLabels:type_name -> server.Stack.AdditionalLabelsEntry
-	26, // 21: server.Stack.additionalAnnotations:type_name -> server.Stack.AdditionalAnnotationsEntry
-	8,  // 22: server.Stack.modules:type_name -> server.Module
-	29, // 23: server.ModuleStatusChanged.status:type_name -> google.protobuf.Struct
-	9,  // 24: server.ModuleStatusChanged.vk:type_name -> server.VersionKind
-	9,  // 25: server.ModuleDeleted.vk:type_name -> server.VersionKind
-	0,  // 26: server.StatusChanged.status:type_name -> server.StackStatus
-	29, // 27: server.StatusChanged.statuses:type_name -> google.protobuf.Struct
-	9,  // 28: server.StatusChanged.vk:type_name -> server.VersionKind
-	27, // 29: server.AddedVersion.versions:type_name -> server.AddedVersion.VersionsEntry
-	28, // 30: server.UpdatedVersion.versions:type_name -> server.UpdatedVersion.VersionsEntry
-	3,  // 31: server.Server.Join:input_type -> server.Message
-	2,  // 32: server.Server.Join:output_type -> server.Order
-	32, // [32:33] is the sub-list for method output_type
-	31, // [31:32] is the sub-list for method input_type
-	31, // [31:31] is the sub-list for extension type_name
-	31, // [31:31] is the sub-list for extension extendee
-	0,  // [0:31] is the sub-list for field type_name
+	40, // 0: server.ConnectRequest.tags:type_name -> server.ConnectRequest.TagsEntry
+	6,  // 1: server.Order.connected:type_name -> server.Connected
+	11, // 2: server.Order.existingStack:type_name -> server.Stack
+	22, // 3: server.Order.deletedStack:type_name -> server.DeletedStack
+	9,  // 4: server.Order.ping:type_name -> server.Ping
+	23, // 5: server.Order.disabledStack:type_name -> server.DisabledStack
+	24, // 6: server.Order.enabledStack:type_name -> server.EnabledStack
+	8,  // 7: server.Order.ack:type_name -> server.Ack
+	30, // 8: server.Order.resync:type_name -> server.Resync
+	29, // 9: server.Order.configUpdate:type_name -> server.AgentConfig
+	25, // 10: server.Order.upsertVersions:type_name -> server.UpsertVersions
+	26, // 11: server.Order.deleteVersions:type_name -> server.DeleteVersions
+	27, // 12: server.Order.restartModule:type_name -> server.RestartModule
+	28, // 13: server.Order.rotateStackCredentials:type_name -> server.RotateStackCredentials
+	41, // 14: server.Order.metadata:type_name -> server.Order.MetadataEntry
+	20, // 15: server.Message.statusChanged:type_name -> server.StatusChanged
+	10, // 16: server.Message.pong:type_name -> server.Pong
+	33, // 17: server.Message.addedVersion:type_name -> server.AddedVersion
+	35, // 18: server.Message.deletedVersion:type_name -> server.DeletedVersion
+	34, // 19: server.Message.updatedVersion:type_name -> server.UpdatedVersion
+	16, // 20: server.Message.moduleStatusChanged:type_name -> server.ModuleStatusChanged
+	19, // 21: server.Message.moduleDeleted:type_name -> server.ModuleDeleted
+	22, // 22: server.Message.stackDeleted:type_name -> server.DeletedStack
+	39, // 23: server.Message.snapshot:type_name -> server.Snapshot
+	8,  // 24: server.Message.ack:type_name -> server.Ack
+	38, // 25: server.Message.orderResult:type_name -> server.OrderResult
+	7,  // 26: server.Message.messageBatch:type_name -> server.MessageBatch
+	17, // 27: server.Message.gatewayHostsChanged:type_name -> server.GatewayHostsChanged
+	42, // 28: server.Message.metadata:type_name -> server.Message.MetadataEntry
+	5,  // 29: server.MessageBatch.messages:type_name -> server.Message
+	31, // 30: server.Stack.authConfig:type_name -> server.AuthConfig
+	32, // 31: server.Stack.staticClients:type_name -> server.AuthClient
+	21, // 32: server.Stack.stargateConfig:type_name -> server.StargateConfig
+	43, // 33: server.Stack.additionalLabels:type_name -> server.Stack.AdditionalLabelsEntry
+	44, // 34: server.Stack.additionalAnnotations:type_name -> server.Stack.AdditionalAnnotationsEntry
+	14, // 35: server.Stack.modules:type_name -> server.Module
+	45, // 36: server.Stack.versionOverrides:type_name -> server.Stack.VersionOverridesEntry
+	13, // 37: server.Stack.settings:type_name -> server.StackSetting
+	46, // 38: server.Stack.nodeSelector:type_name -> server.Stack.NodeSelectorEntry
+	12, // 39: server.Stack.tolerations:type_name -> server.Toleration
+	50, // 40: server.Stack.affinity:type_name -> google.protobuf.Struct
+	51, // 41: server.Stack.expiresAt:type_name -> google.protobuf.Timestamp
+	50, // 42: server.Module.spec:type_name -> google.protobuf.Struct
+	50, // 43: server.ModuleStatusChanged.status:type_name -> google.protobuf.Struct
+	15, // 44: server.ModuleStatusChanged.vk:type_name -> server.VersionKind
+	18, // 45: server.GatewayHostsChanged.hosts:type_name -> server.HostStatus
+	15, // 46: server.ModuleDeleted.vk:type_name -> server.VersionKind
+	0,  // 47: server.StatusChanged.status:type_name -> server.StackStatus
+	50, // 48: server.StatusChanged.statuses:type_name -> google.protobuf.Struct
+	15, // 49: server.StatusChanged.vk:type_name -> server.VersionKind
+	1,  // 50: server.DeletedStack.reason:type_name -> server.DeletionReason
+	47, // 51: server.UpsertVersions.versions:type_name -> server.UpsertVersions.VersionsEntry
+	48, // 52: server.AddedVersion.versions:type_name -> server.AddedVersion.VersionsEntry
+	49, // 53: server.UpdatedVersion.versions:type_name -> server.UpdatedVersion.VersionsEntry
+	36, // 54: server.ObjectResult.gvk:type_name -> server.GroupVersionKind
+	2,  // 55: server.ObjectResult.action:type_name -> server.ObjectAction
+	37, // 56: server.OrderResult.objects:type_name -> server.ObjectResult
+	29, // 57: server.OrderResult.config:type_name -> server.AgentConfig
+	20, // 58: server.Snapshot.stacks:type_name -> server.StatusChanged
+	16, // 59: server.Snapshot.modules:type_name -> server.ModuleStatusChanged
+	33, // 60: server.Snapshot.versions:type_name -> server.AddedVersion
+	5,  // 61: server.Server.Join:input_type -> server.Message
+	4,  // 62: server.Server.Join:output_type -> server.Order
+	62, // [62:63] is the sub-list for method output_type
+	61, // [61:62] is the sub-list for method input_type
+	61, // [61:61] is the sub-list for extension type_name
+	61, // [61:61] is the sub-list for extension extendee
+	0,  // [0:61] is the sub-list for field type_name
 }
 
 func init() { file_agent_proto_init() }
@@ -1680,6 +3387,13 @@ func file_agent_proto_init() {
 		(*Order_Ping)(nil),
 		(*Order_DisabledStack)(nil),
 		(*Order_EnabledStack)(nil),
+		(*Order_Ack)(nil),
+		(*Order_Resync)(nil),
+		(*Order_ConfigUpdate)(nil),
+		(*Order_UpsertVersions)(nil),
+		(*Order_DeleteVersions)(nil),
+		(*Order_RestartModule)(nil),
+		(*Order_RotateStackCredentials)(nil),
 	}
 	file_agent_proto_msgTypes[2].OneofWrappers = []any{
 		(*Message_StatusChanged)(nil),
@@ -1690,14 +3404,21 @@ func file_agent_proto_init() {
 		(*Message_ModuleStatusChanged)(nil),
 		(*Message_ModuleDeleted)(nil),
 		(*Message_StackDeleted)(nil),
-	}
+		(*Message_Snapshot)(nil),
+		(*Message_Ack)(nil),
+		(*Message_OrderResult)(nil),
+		(*Message_MessageBatch)(nil),
+		(*Message_GatewayHostsChanged)(nil),
+	}
+	file_agent_proto_msgTypes[9].OneofWrappers = []any{}
+	file_agent_proto_msgTypes[26].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_agent_proto_rawDesc), len(file_agent_proto_rawDesc)),
-			NumEnums:      1,
-			NumMessages:   28,
+			NumEnums:      3,
+			NumMessages:   47,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
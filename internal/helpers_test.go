@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// fakeK8SClient stores objects in memory, indexed by resource then name.
+// Like the API server, patches changing the spec of an object increment its
+// generation.
+type fakeK8SClient struct {
+	mu      sync.Mutex
+	objects map[string]map[string]*unstructured.Unstructured
+	errors  map[string]error
+	// reconcile is called with the objects whose spec was patched, as the
+	// operator would.
+	reconcile func(resource string, object *unstructured.Unstructured)
+}
+
+func (c *fakeK8SClient) Get(_ context.Context, resource string, name string) (*unstructured.Unstructured, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	object, ok := c.objects[resource][name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: resource}, name)
+	}
+	return object, nil
+}
+
+func (c *fakeK8SClient) Create(_ context.Context, resource string, o *unstructured.Unstructured) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.errors[o.GetName()]; err != nil {
+		return err
+	}
+	if c.objects[resource] == nil {
+		c.objects[resource] = map[string]*unstructured.Unstructured{}
+	}
+	c.objects[resource][o.GetName()] = o
+	return nil
+}
+
+func (c *fakeK8SClient) Patch(_ context.Context, resource, name string, patch []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.errors[name]; err != nil {
+		return err
+	}
+	object, ok := c.objects[resource][name]
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: resource}, name)
+	}
+
+	data, err := object.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	data, err = jsonpatch.MergePatch(data, patch)
+	if err != nil {
+		return err
+	}
+	patched := &unstructured.Unstructured{}
+	if err := patched.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(object.Object["spec"], patched.Object["spec"]) {
+		patched.SetGeneration(object.GetGeneration() + 1)
+		if c.reconcile != nil {
+			c.reconcile(resource, patched)
+		}
+	}
+	c.objects[resource][name] = patched
+	return nil
+}
+
+func (c *fakeK8SClient) Delete(_ context.Context, resource, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.objects[resource][name]; !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: resource}, name)
+	}
+	delete(c.objects[resource], name)
+	return nil
+}
+
+func (c *fakeK8SClient) EnsureNotExists(ctx context.Context, resource, name string) error {
+	if err := c.Delete(ctx, resource, name); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *fakeK8SClient) EnsureNotExistsBySelector(_ context.Context, resource string, selector labels.Selector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, object := range c.objects[resource] {
+		if selector.Matches(labels.Set(object.GetLabels())) {
+			delete(c.objects[resource], name)
+		}
+	}
+	return nil
+}
+
+func (c *fakeK8SClient) List(_ context.Context, resource string, selector labels.Selector) ([]unstructured.Unstructured, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]unstructured.Unstructured, 0)
+	for _, object := range c.objects[resource] {
+		if selector.Matches(labels.Set(object.GetLabels())) {
+			ret = append(ret, *object)
+		}
+	}
+	return ret, nil
+}
+
+var _ K8SClient = (*fakeK8SClient)(nil)
+
+func newFakeK8SClient(objects ...*unstructured.Unstructured) *fakeK8SClient {
+	client := &fakeK8SClient{
+		objects: map[string]map[string]*unstructured.Unstructured{},
+		errors:  map[string]error{},
+	}
+	for _, object := range objects {
+		_ = client.Create(context.Background(), "Stacks", object)
+	}
+	return client
+}
+
+// newTestRESTMapper maps the kinds the listener applies, and the ones of the
+// given modules, to the resources of the fake client.
+func newTestRESTMapper(crds ...v1.CustomResourceDefinition) meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{formanceGroupVersion})
+	mapper.AddSpecific(formanceGroupVersion.WithKind("Versions"),
+		formanceGroupVersion.WithResource("versions"), formanceGroupVersion.WithResource("versions"), meta.RESTScopeRoot)
+	mapper.AddSpecific(formanceGroupVersion.WithKind("Stack"),
+		formanceGroupVersion.WithResource("stacks"), formanceGroupVersion.WithResource("stack"), meta.RESTScopeRoot)
+	mapper.AddSpecific(formanceGroupVersion.WithKind("AuthClient"),
+		formanceGroupVersion.WithResource("AuthClients"), formanceGroupVersion.WithResource("authclient"), meta.RESTScopeRoot)
+	mapper.AddSpecific(formanceGroupVersion.WithKind("Settings"),
+		formanceGroupVersion.WithResource("settings"), formanceGroupVersion.WithResource("settings"), meta.RESTScopeRoot)
+	mapper.AddSpecific(formanceGroupVersion.WithKind("Stargate"),
+		formanceGroupVersion.WithResource("Stargates"), formanceGroupVersion.WithResource("stargate"), meta.RESTScopeRoot)
+	for _, crd := range crds {
+		mapper.AddSpecific(formanceGroupVersion.WithKind(crd.Spec.Names.Kind),
+			formanceGroupVersion.WithResource(crd.Status.AcceptedNames.Plural),
+			formanceGroupVersion.WithResource(crd.Status.AcceptedNames.Singular), meta.RESTScopeRoot)
+	}
+	return mapper
+}
+
+// startTestListener runs a listener of the orders sent through the returned
+// mock until the end of the test.
+func startTestListener(t *testing.T, client K8SClient, config *runtimeConfig, kube kubernetes.Interface, crds ...v1.CustomResourceDefinition) *MembershipClientMock {
+	t.Helper()
+
+	membershipClient := NewMembershipClientMock()
+	listener := NewMembershipListener(client, ClientInfo{}, newTestRESTMapper(crds...), membershipClient, crds, nil, config, kube)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listener.Start(logging.TestingContext())
+	}()
+	if config != nil {
+		config.OnChange(listener.applyConfig)
+	}
+	t.Cleanup(func() {
+		close(membershipClient.Orders())
+		<-done
+	})
+
+	return membershipClient
+}
+
+// waitOrderResult returns the result of the order with the given correlation
+// id once the listener sent it.
+func waitOrderResult(t *testing.T, membershipClient *MembershipClientMock, correlationID string) *generated.OrderResult {
+	t.Helper()
+
+	var result *generated.OrderResult
+	require.Eventually(t, func() bool {
+		for _, message := range membershipClient.GetMessages() {
+			if message.GetOrderResult().GetCorrelationId() == correlationID {
+				result = message.GetOrderResult()
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return result
+}
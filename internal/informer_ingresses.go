@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"reflect"
+	"slices"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+var ingressesGroupVersionResource = networkingv1.SchemeGroupVersion.WithResource("ingresses")
+
+// ingressHosts returns the status of each host served by the ingresses, a
+// host is ready if one of the ingresses serving it has an address.
+func ingressHosts(ingresses ...*unstructured.Unstructured) []*generated.HostStatus {
+	ready := map[string]bool{}
+	for _, ingress := range ingresses {
+		addresses, _, _ := unstructured.NestedSlice(ingress.Object, "status", "loadBalancer", "ingress")
+		rules, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+		for _, rule := range rules {
+			rule, ok := rule.(map[string]any)
+			if !ok {
+				continue
+			}
+			host, _ := rule["host"].(string)
+			if host == "" {
+				continue
+			}
+			ready[host] = ready[host] || len(addresses) > 0
+		}
+	}
+
+	hosts := make([]string, 0, len(ready))
+	for host := range ready {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+
+	ret := make([]*generated.HostStatus, 0, len(hosts))
+	for _, host := range hosts {
+		ret = append(ret, &generated.HostStatus{
+			Host:  host,
+			Ready: ready[host],
+		})
+	}
+	return ret
+}
+
+// IngressEventHandler reports the hosts of the ingresses of each stack, which
+// are deployed by the operator in the namespace named after the stack.
+type IngressEventHandler struct {
+	logger    logging.Logger
+	client    MembershipClient
+	ingresses cache.GenericLister
+	stacks    cache.GenericLister
+}
+
+func (h *IngressEventHandler) sendHosts(namespace string) {
+	logger := h.logger.WithField("stack", namespace)
+
+	// Namespaces which are not stacks managed by the agent are ignored
+	stack, err := h.stacks.Get(namespace)
+	if err != nil {
+		return
+	}
+	if stack.(*unstructured.Unstructured).GetLabels()["formance.com/created-by-agent"] != "true" {
+		return
+	}
+
+	objects, err := h.ingresses.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		logger.Errorf("Unable to list ingresses: %s", err)
+		return
+	}
+	ingresses := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, object := range objects {
+		ingresses = append(ingresses, object.(*unstructured.Unstructured))
+	}
+
+	if err := h.client.Send(&generated.Message{
+		Message: &generated.Message_GatewayHostsChanged{
+			GatewayHostsChanged: &generated.GatewayHostsChanged{
+				ClusterName: namespace,
+				Hosts:       ingressHosts(ingresses...),
+			},
+		},
+	}); err != nil {
+		logger.Errorf("Unable to send gateway hosts to server: %s", err)
+		return
+	}
+	logger.Debugf("Gateway hosts of stack '%s' sent", namespace)
+}
+
+func (h *IngressEventHandler) AddFunc(obj interface{}) {
+	h.sendHosts(obj.(*unstructured.Unstructured).GetNamespace())
+}
+
+func (h *IngressEventHandler) UpdateFunc(oldObj, newObj interface{}) {
+	oldIngress := oldObj.(*unstructured.Unstructured)
+	newIngress := newObj.(*unstructured.Unstructured)
+
+	if reflect.DeepEqual(ingressHosts(oldIngress), ingressHosts(newIngress)) {
+		return
+	}
+	h.sendHosts(newIngress.GetNamespace())
+}
+
+func (h *IngressEventHandler) DeleteFunc(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		h.logger.Errorf("Unable to get key of deleted ingress: %s", err)
+		return
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		h.logger.Errorf("Unable to split key of deleted ingress: %s", err)
+		return
+	}
+	h.sendHosts(namespace)
+}
+
+func NewIngressEventHandler(logger logging.Logger, membershipClient MembershipClient, ingresses, stacks cache.GenericLister) cache.ResourceEventHandlerFuncs {
+	ingressEventHandler := &IngressEventHandler{
+		logger:    logger,
+		client:    membershipClient,
+		ingresses: ingresses,
+		stacks:    stacks,
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    ingressEventHandler.AddFunc,
+		UpdateFunc: ingressEventHandler.UpdateFunc,
+		DeleteFunc: ingressEventHandler.DeleteFunc,
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newUnstructuredIngress(namespace, name string, ready bool, hosts ...string) *unstructured.Unstructured {
+	rules := make([]any, 0, len(hosts))
+	for _, host := range hosts {
+		rules = append(rules, map[string]any{"host": host})
+	}
+	addresses := make([]any, 0)
+	if ready {
+		addresses = append(addresses, map[string]any{"ip": "10.0.0.1"})
+	}
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "networking.k8s.io/v1",
+			"kind":       "Ingress",
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]any{
+				"rules": rules,
+			},
+			"status": map[string]any{
+				"loadBalancer": map[string]any{
+					"ingress": addresses,
+				},
+			},
+		},
+	}
+}
+
+func TestIngressHosts(t *testing.T) {
+	t.Parallel()
+
+	hosts := ingressHosts(
+		newUnstructuredIngress("stack1", "gateway", false, "stack1.example.com", "api.acme.com"),
+		newUnstructuredIngress("stack1", "gateway-custom", true, "api.acme.com"),
+	)
+	require.Equal(t, []*generated.HostStatus{
+		{Host: "api.acme.com", Ready: true},
+		{Host: "stack1.example.com", Ready: false},
+	}, hosts)
+}
+
+func TestIngressEventHandler(t *testing.T) {
+	t.Parallel()
+
+	newIndexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		})
+	}
+	ingresses := newIndexer()
+	stacks := newIndexer()
+	require.NoError(t, stacks.Add(&unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "formance.com/v1beta1",
+			"kind":       "Stack",
+			"metadata": map[string]any{
+				"name": "stack1",
+				"labels": map[string]any{
+					"formance.com/created-by-agent": "true",
+				},
+			},
+		},
+	}))
+
+	membershipClient := NewMembershipClientMock()
+	handler := NewIngressEventHandler(logging.Testing(), membershipClient,
+		cache.NewGenericLister(ingresses, ingressesGroupVersionResource.GroupResource()),
+		cache.NewGenericLister(stacks, formanceGroupVersion.WithResource("stacks").GroupResource()))
+
+	lastHosts := func() *generated.GatewayHostsChanged {
+		messages := membershipClient.GetMessages()
+		return messages[len(messages)-1].GetGatewayHostsChanged()
+	}
+
+	ingress := newUnstructuredIngress("stack1", "gateway", false, "stack1.example.com")
+	require.NoError(t, ingresses.Add(ingress))
+	handler.AddFunc(ingress)
+	require.Equal(t, "stack1", lastHosts().ClusterName)
+	require.False(t, lastHosts().Hosts[0].Ready)
+
+	// Updates which do not change the hosts are not reported
+	handler.UpdateFunc(ingress, ingress)
+	require.Len(t, membershipClient.GetMessages(), 1)
+
+	readyIngress := newUnstructuredIngress("stack1", "gateway", true, "stack1.example.com")
+	require.NoError(t, ingresses.Update(readyIngress))
+	handler.UpdateFunc(ingress, readyIngress)
+	require.True(t, lastHosts().Hosts[0].Ready)
+
+	require.NoError(t, ingresses.Delete(readyIngress))
+	handler.DeleteFunc(cache.DeletedFinalStateUnknown{Key: "stack1/gateway", Obj: readyIngress})
+	require.Empty(t, lastHosts().Hosts)
+
+	// Ingresses outside of the namespaces of the stacks are ignored
+	other := newUnstructuredIngress("kube-system", "dashboard", true, "dashboard.example.com")
+	require.NoError(t, ingresses.Add(other))
+	handler.AddFunc(other)
+	require.Len(t, membershipClient.GetMessages(), 3)
+}
+
+func TestGatewayHosts(t *testing.T) {
+	t.Parallel()
+
+	listener := &membershipListener{
+		clientInfo: ClientInfo{
+			BaseUrl: &url.URL{Scheme: "https", Host: "example.com"},
+			AdditionalBaseURLs: []string{
+				"https://example.net",
+				"://invalid",
+				"https://example.com",
+			},
+		},
+	}
+	require.Equal(t, []string{
+		"stack1.example.com",
+		"stack1.example.net",
+		"api.acme.com",
+	}, listener.gatewayHosts(logging.TestingContext(), "stack1", []string{"API.acme.com", "api.acme.com"}))
+}
@@ -19,12 +19,18 @@ func fromUnstructuredToModuleStatusChanged(unstructuredModule *unstructured.Unst
 					Version: unstructuredModule.GetObjectKind().GroupVersionKind().Version,
 					Kind:    unstructuredModule.GetObjectKind().GroupVersionKind().Kind,
 				},
-				Status: status,
+				Status:   status,
+				Disabled: moduleDisabled(unstructuredModule),
 			},
 		},
 	}
 }
 
+func moduleDisabled(unstructuredModule *unstructured.Unstructured) bool {
+	disabled, _, _ := unstructured.NestedBool(unstructuredModule.Object, "spec", "disabled")
+	return disabled
+}
+
 type ModuleEventHandler struct {
 	logger logging.Logger
 	client MembershipClient
@@ -71,7 +77,7 @@ func (h *ModuleEventHandler) UpdateFunc(oldObj, newObj any) {
 		return
 	}
 
-	if newStatus == nil || reflect.DeepEqual(oldStatus, newStatus) {
+	if newStatus == nil || reflect.DeepEqual(oldStatus, newStatus) && moduleDisabled(oldVersions) == moduleDisabled(newVersions) {
 		return
 	}
 
@@ -5,6 +5,7 @@ import (
 
 	"github.com/formancehq/go-libs/v2/logging"
 	"github.com/formancehq/stack/components/agent/internal"
+	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
@@ -134,3 +135,35 @@ func TestModuleUpdateStatusChanged(t *testing.T) {
 	}
 
 }
+
+func TestModuleUpdateDisabled(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	membershipClientMock := internal.NewMockMembershipClient(ctrl)
+	resourceInformer := internal.NewModuleEventHandler(logging.Testing(), membershipClientMock)
+
+	newModule := func(disabled bool) *unstructured.Unstructured {
+		return &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name": "stack1",
+				},
+				"spec": map[string]interface{}{
+					"disabled": disabled,
+				},
+				"status": map[string]interface{}{
+					"ready": true,
+				},
+			},
+		}
+	}
+
+	var message *generated.Message
+	membershipClientMock.EXPECT().Send(gomock.Any()).DoAndReturn(func(m *generated.Message) error {
+		message = m
+		return nil
+	})
+	resourceInformer.UpdateFunc(newModule(false), newModule(true))
+	require.True(t, ctrl.Satisfied())
+	require.True(t, message.GetModuleStatusChanged().Disabled)
+}
@@ -0,0 +1,23 @@
+package internal
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+var namespacesGroupVersionResource = corev1.SchemeGroupVersion.WithResource("namespaces")
+
+// NamespaceEventHandler calls created with the name of the namespaces as they
+// are created. It is also called on every resync, so that a namespace created
+// while its stack was being synced is not missed.
+func NamespaceEventHandler(created func(namespace string)) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			created(obj.(*unstructured.Unstructured).GetName())
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			created(newObj.(*unstructured.Unstructured).GetName())
+		},
+	}
+}
@@ -100,6 +100,7 @@ func (h *StackEventHandler) DeleteFunc(obj interface{}) {
 		Message: &generated.Message_StackDeleted{
 			StackDeleted: &generated.DeletedStack{
 				ClusterName: stack.GetName(),
+				Reason:      stackDeletionReason(stack),
 			},
 		},
 	}); err != nil {
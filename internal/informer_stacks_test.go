@@ -3,9 +3,11 @@ package internal_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/formancehq/go-libs/v2/logging"
 	"github.com/formancehq/stack/components/agent/internal"
+	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
@@ -117,3 +119,35 @@ func TestUpdateStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteExpiredStack(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	membershipClientMock := internal.NewMockMembershipClient(ctrl)
+	resourceInformer := internal.NewStackEventHandler(logging.Testing(), membershipClientMock)
+
+	var messages []*generated.Message
+	membershipClientMock.EXPECT().Send(gomock.Any()).DoAndReturn(func(m *generated.Message) error {
+		messages = append(messages, m)
+		return nil
+	}).Times(2)
+
+	// Stacks past their expiry deleted on request are not reported as
+	// expired, only the ones deleted by the expirer are
+	requested := newUnstructuredStack(uuid.NewString(), true, false)
+	requested.SetAnnotations(map[string]string{
+		"formance.com/expires-at": time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	resourceInformer.DeleteFunc(requested)
+
+	expired := newUnstructuredStack(uuid.NewString(), true, false)
+	expired.SetAnnotations(map[string]string{
+		"formance.com/expires-at":      time.Now().Add(time.Minute).Format(time.RFC3339),
+		"formance.com/deletion-reason": "expired",
+	})
+	resourceInformer.DeleteFunc(expired)
+
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, generated.DeletionReason_DeletionRequested, messages[0].GetStackDeleted().Reason)
+	require.Equal(t, generated.DeletionReason_DeletionExpired, messages[1].GetStackDeleted().Reason)
+}
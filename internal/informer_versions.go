@@ -26,7 +26,51 @@ func extractVersionsSpec(obj *unstructured.Unstructured) map[string]string {
 	return result
 }
 
+// derivedVersionsStack returns the stack a Versions object was derived for,
+// empty for the Versions shared by stacks.
+func derivedVersionsStack(versions *unstructured.Unstructured) string {
+	return versions.GetLabels()["formance.com/stack"]
+}
+
+// releaseVersions tells whether a Versions object is a release. Versions
+// derived by the agent for a stack with version overrides are labelled with
+// the stack, and are not reported to membership.
+func releaseVersions(obj interface{}) bool {
+	versions, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	return derivedVersionsStack(versions) == ""
+}
+
+// DerivedVersionsEventHandler calls derive with the name of the Versions
+// shared by stacks whose spec changed, so that the Versions derived from them
+// are updated.
+func DerivedVersionsEventHandler(derive func(base string)) cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: releaseVersions,
+		Handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldVersions := oldObj.(*unstructured.Unstructured)
+				newVersions := newObj.(*unstructured.Unstructured)
+
+				if reflect.DeepEqual(extractVersionsSpec(oldVersions), extractVersionsSpec(newVersions)) {
+					return
+				}
+				derive(newVersions.GetName())
+			},
+		},
+	}
+}
+
 func VersionsEventHandler(logger logging.Logger, membershipClient MembershipClient) cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: releaseVersions,
+		Handler:    versionsEventHandlerFuncs(logger, membershipClient),
+	}
+}
+
+func versionsEventHandlerFuncs(logger logging.Logger, membershipClient MembershipClient) cache.ResourceEventHandler {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			version := obj.(*unstructured.Unstructured)
@@ -50,8 +94,10 @@ func VersionsEventHandler(logger logging.Logger, membershipClient MembershipClie
 
 			oldSpec := extractVersionsSpec(oldVersions)
 			newSpec := extractVersionsSpec(newVersions)
+			oldDeprecated := oldVersions.GetAnnotations()["formance.com/deprecated"] == "true"
+			newDeprecated := newVersions.GetAnnotations()["formance.com/deprecated"] == "true"
 
-			if reflect.DeepEqual(oldSpec, newSpec) {
+			if reflect.DeepEqual(oldSpec, newSpec) && oldDeprecated == newDeprecated {
 				return
 			}
 
@@ -61,7 +107,7 @@ func VersionsEventHandler(logger logging.Logger, membershipClient MembershipClie
 					UpdatedVersion: &generated.UpdatedVersion{
 						Name:       newVersions.GetName(),
 						Versions:   newSpec,
-						Deprecated: newVersions.GetAnnotations()["formance.com/deprecated"] == "true",
+						Deprecated: newDeprecated,
 					},
 				},
 			}); err != nil {
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionsEventHandlerIgnoresStackVersions(t *testing.T) {
+	t.Parallel()
+
+	membershipClient := NewMembershipClientMock()
+	handler := VersionsEventHandler(logging.Testing(), membershipClient)
+
+	release := newTestObject("Versions", "v1", nil, map[string]any{
+		"spec": map[string]any{"ledger": "v2.0.0"},
+	})
+	derived := newTestObject("Versions", "stack1-versions", map[string]any{
+		"formance.com/created-by-agent": "true",
+		"formance.com/stack":            "stack1",
+	}, map[string]any{
+		"spec": map[string]any{"ledger": "v2.1.0"},
+	})
+	updated := derived.DeepCopy()
+	updated.Object["spec"] = map[string]any{"ledger": "v2.2.0"}
+
+	handler.OnAdd(derived, false)
+	handler.OnUpdate(derived, updated)
+	handler.OnDelete(updated)
+	require.Empty(t, membershipClient.GetMessages())
+
+	handler.OnAdd(release, false)
+	messages := membershipClient.GetMessages()
+	require.Len(t, messages, 1)
+	require.Equal(t, "v1", messages[0].GetAddedVersion().GetName())
+}
+
+func TestDerivedVersionsEventHandler(t *testing.T) {
+	t.Parallel()
+
+	var derived []string
+	handler := DerivedVersionsEventHandler(func(base string) {
+		derived = append(derived, base)
+	})
+
+	release := newTestObject("Versions", "v1", nil, map[string]any{
+		"spec": map[string]any{"ledger": "v2.0.0"},
+	})
+	deprecated := release.DeepCopy()
+	deprecated.SetAnnotations(map[string]string{"formance.com/deprecated": "true"})
+	updated := release.DeepCopy()
+	updated.Object["spec"] = map[string]any{"ledger": "v2.1.0"}
+	stackVersions := newTestObject("Versions", "stack1-versions", map[string]any{
+		"formance.com/stack": "stack1",
+	}, map[string]any{
+		"spec": map[string]any{"ledger": "v2.1.0"},
+	})
+	updatedStackVersions := stackVersions.DeepCopy()
+	updatedStackVersions.Object["spec"] = map[string]any{"ledger": "v2.2.0"}
+
+	handler.OnAdd(release, false)
+	handler.OnUpdate(release, deprecated)
+	handler.OnUpdate(stackVersions, updatedStackVersions)
+	require.Empty(t, derived)
+
+	handler.OnUpdate(release, updated)
+	require.Equal(t, []string{"v1"}, derived)
+}
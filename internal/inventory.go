@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+)
+
+// Inventory builds the snapshot sent to membership when a connection opens,
+// and the messages sent again on a Resync order.
+type Inventory interface {
+	Snapshot(ctx context.Context) (*generated.Snapshot, error)
+	Resync(ctx context.Context, scope *generated.Resync) ([]*generated.Message, error)
+}
+
+type informerInventory struct {
+	factory dynamicinformer.DynamicSharedInformerFactory
+	modules modules
+}
+
+func (i *informerInventory) list(resource string, selector labels.Selector) ([]*unstructured.Unstructured, error) {
+	objects, err := i.factory.ForResource(schema.GroupVersionResource{
+		Group:    "formance.com",
+		Version:  "v1beta1",
+		Resource: resource,
+	}).Lister().List(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", resource)
+	}
+
+	ret := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, object := range objects {
+		ret = append(ret, object.(*unstructured.Unstructured))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetName() < ret[j].GetName()
+	})
+	return ret, nil
+}
+
+// Snapshot waits for the informers caches to be synced, so that an agent
+// which has just started does not report an empty inventory.
+func (i *informerInventory) Snapshot(ctx context.Context) (*generated.Snapshot, error) {
+	for gvr, synced := range i.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, errors.Errorf("cache of %s not synced", gvr.Resource)
+		}
+	}
+
+	snapshot := &generated.Snapshot{}
+
+	stacks, err := i.list("stacks", labels.NewSelector().Add(
+		must(labels.NewRequirement("formance.com/created-by-agent", selection.Equals, []string{"true"})),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, stack := range stacks {
+		status, err := getStatus(stack)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Unable to get status of stack %s: %s", stack.GetName(), err)
+		}
+		snapshot.Stacks = append(snapshot.Stacks, &generated.StatusChanged{
+			ClusterName: stack.GetName(),
+			Statuses:    status,
+		})
+	}
+
+	for _, crd := range i.modules {
+		objects, err := i.list(crd.Status.AcceptedNames.Plural, labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			status, err := getStatus(object)
+			if err != nil {
+				logging.FromContext(ctx).Errorf("Unable to get status of module %s: %s", object.GetName(), err)
+			}
+			snapshot.Modules = append(snapshot.Modules,
+				fromUnstructuredToModuleStatusChanged(object, status).GetModuleStatusChanged())
+		}
+	}
+
+	// Versions derived for stacks are not releases
+	versions, err := i.list("versions", labels.NewSelector().Add(
+		must(labels.NewRequirement("formance.com/stack", selection.DoesNotExist, nil)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		snapshot.Versions = append(snapshot.Versions, &generated.AddedVersion{
+			Name:       version.GetName(),
+			Versions:   extractVersionsSpec(version),
+			Deprecated: version.GetAnnotations()["formance.com/deprecated"] == "true",
+		})
+	}
+
+	return snapshot, nil
+}
+
+// Resync returns the messages describing the objects matching the scope.
+// Versions are not tied to a stack, they are only reported when the scope
+// does not name one.
+func (i *informerInventory) Resync(ctx context.Context, scope *generated.Resync) ([]*generated.Message, error) {
+	snapshot, err := i.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := func(clusterName, kind string) bool {
+		return (scope.ClusterName == "" || scope.ClusterName == clusterName) &&
+			(scope.Kind == "" || strings.EqualFold(scope.Kind, kind))
+	}
+
+	messages := make([]*generated.Message, 0)
+	for _, stack := range snapshot.Stacks {
+		if matches(stack.ClusterName, "Stack") {
+			messages = append(messages, &generated.Message{
+				Message: &generated.Message_StatusChanged{StatusChanged: stack},
+			})
+		}
+	}
+	for _, module := range snapshot.Modules {
+		if matches(module.ClusterName, module.GetVk().GetKind()) {
+			messages = append(messages, &generated.Message{
+				Message: &generated.Message_ModuleStatusChanged{ModuleStatusChanged: module},
+			})
+		}
+	}
+	if matches("", "Versions") {
+		for _, version := range snapshot.Versions {
+			messages = append(messages, &generated.Message{
+				Message: &generated.Message_AddedVersion{AddedVersion: version},
+			})
+		}
+	}
+
+	return messages, nil
+}
+
+var _ Inventory = (*informerInventory)(nil)
+
+func NewInventory(factory dynamicinformer.DynamicSharedInformerFactory, modules modules) Inventory {
+	return &informerInventory{
+		factory: factory,
+		modules: modules,
+	}
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestObject(kind, name string, labels map[string]any, fields map[string]any) *unstructured.Unstructured {
+	object := map[string]any{
+		"apiVersion": "formance.com/v1beta1",
+		"kind":       kind,
+		"metadata": map[string]any{
+			"name": name,
+		},
+	}
+	if labels != nil {
+		object["metadata"].(map[string]any)["labels"] = labels
+	}
+	for k, v := range fields {
+		object[k] = v
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func TestInventorySnapshot(t *testing.T) {
+	t.Parallel()
+
+	createdByAgent := map[string]any{
+		"formance.com/created-by-agent": "true",
+	}
+	gvr := func(resource string) schema.GroupVersionResource {
+		return formanceGroupVersion.WithResource(resource)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gvr("stacks"):   "StackList",
+		gvr("ledgers"):  "LedgerList",
+		gvr("versions"): "VersionsList",
+	})
+	for resource, object := range map[string]*unstructured.Unstructured{
+		"stacks": newTestObject("Stack", "stack1", createdByAgent, map[string]any{
+			"status": map[string]any{"ready": true},
+		}),
+		"ledgers": newTestObject("Ledger", "stack1", createdByAgent, map[string]any{
+			"status": map[string]any{"ready": false},
+		}),
+		"versions": newTestObject("Versions", "v1", nil, map[string]any{
+			"spec": map[string]any{"ledger": "v2.0.0"},
+		}),
+	} {
+		_, err := client.Resource(gvr(resource)).Create(context.Background(), object, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	_, err := client.Resource(gvr("stacks")).Create(context.Background(), newTestObject("Stack", "manual", nil, nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+	// Versions derived for a stack are not releases
+	_, err = client.Resource(gvr("versions")).Create(context.Background(), newTestObject("Versions", "stack1-versions", map[string]any{
+		"formance.com/created-by-agent": "true",
+		"formance.com/stack":            "stack1",
+	}, nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	ledgerCRD := v1.CustomResourceDefinition{}
+	ledgerCRD.Status.AcceptedNames.Plural = "ledgers"
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, time.Minute)
+	inventory := NewInventory(factory, modules{ledgerCRD})
+	for _, resource := range []string{"stacks", "ledgers", "versions"} {
+		require.NoError(t, createInformer(factory, resource, cache.ResourceEventHandlerFuncs{}))
+	}
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+		factory.Shutdown()
+	})
+	factory.Start(stopCh)
+
+	snapshot, err := inventory.Snapshot(logging.TestingContext())
+	require.NoError(t, err)
+
+	require.Len(t, snapshot.Stacks, 1)
+	require.Equal(t, "stack1", snapshot.Stacks[0].ClusterName)
+	require.Equal(t, true, snapshot.Stacks[0].Statuses.AsMap()["ready"])
+
+	require.Len(t, snapshot.Modules, 1)
+	require.Equal(t, "Ledger", snapshot.Modules[0].Vk.Kind)
+	require.Equal(t, false, snapshot.Modules[0].Status.AsMap()["ready"])
+
+	require.Len(t, snapshot.Versions, 1)
+	require.Equal(t, "v1", snapshot.Versions[0].Name)
+	require.Equal(t, map[string]string{"ledger": "v2.0.0"}, snapshot.Versions[0].Versions)
+
+	messages, err := inventory.Resync(logging.TestingContext(), &generated.Resync{})
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+
+	// Versions are not reported when resyncing a single stack
+	messages, err = inventory.Resync(logging.TestingContext(), &generated.Resync{ClusterName: "stack1"})
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "stack1", messages[0].GetStatusChanged().GetClusterName())
+	require.Equal(t, "stack1", messages[1].GetModuleStatusChanged().GetClusterName())
+
+	messages, err = inventory.Resync(logging.TestingContext(), &generated.Resync{Kind: "ledger"})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.NotNil(t, messages[0].GetModuleStatusChanged())
+
+	messages, err = inventory.Resync(logging.TestingContext(), &generated.Resync{Kind: "Versions"})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, "v1", messages[0].GetAddedVersion().GetName())
+
+	messages, err = inventory.Resync(logging.TestingContext(), &generated.Resync{ClusterName: "unknown"})
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
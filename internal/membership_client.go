@@ -2,16 +2,23 @@ package internal
 
 import (
 	"context"
-	"io"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/formancehq/go-libs/v2/logging"
 	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/formancehq/stack/components/agent/internal/grpcclient"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -23,18 +30,107 @@ const (
 	metadataOutdated           = "outdated"
 	metadataVersion            = "version"
 	metadataCapabilities       = "capabilities"
+	metadataProtocolVersion    = "protocolVersion"
+	metadataOrders             = "orders"
+	metadataMessages           = "messages"
 
-	capabilityEE         = "EE"
-	capabilityModuleList = "MODULE_LIST"
+	primaryProbeTimeout = 5 * time.Second
+	defaultPongInterval = 5 * time.Second
+
+	defaultNegotiationTimeout = 10 * time.Second
 )
 
+type connectionState string
+
+const (
+	stateConnecting   connectionState = "connecting"
+	stateConnected    connectionState = "connected"
+	stateDisconnected connectionState = "disconnected"
+	stateStopped      connectionState = "stopped"
+)
+
+// errSessionRestarted ends a session to open a new one with the updated
+// configuration, without waiting for the reconnection backoff.
+var errSessionRestarted = errors.New("session restarted")
+
+// ConnectionConfig holds the settings of the stream to the membership server.
+type ConnectionConfig struct {
+	// MinReconnectBackoff is the delay before the first reconnection attempt.
+	MinReconnectBackoff time.Duration
+	// MaxReconnectBackoff caps the delay between two reconnection attempts.
+	MaxReconnectBackoff time.Duration
+	// InFlightWindow is the number of messages which can be sent before being
+	// acknowledged by the server. Acknowledgements are disabled when zero.
+	// StateDir must be set along with it, so that sequences are not reused
+	// after a restart.
+	InFlightWindow int
+	// StateDir is where the agent persists its state across restarts.
+	// Persistence is disabled when empty.
+	StateDir string
+	// ResetRuntimeConfig drops the configuration updates persisted in
+	// StateDir at startup, so that the command line is in effect again.
+	ResetRuntimeConfig bool
+	// FailoverThreshold is the number of failed connections to a server
+	// address before trying the next one.
+	FailoverThreshold int
+	// PrimaryProbeInterval is how often the first server address is probed
+	// while connected to another one, to fail back once it recovers.
+	// Probing is disabled when zero.
+	PrimaryProbeInterval time.Duration
+	// PongInterval is the delay between two pongs sent to the server.
+	PongInterval time.Duration
+	// LivenessTimeout is how long a session can go without receiving any
+	// order or ping before being considered dead and re-established.
+	// Liveness checks are disabled when zero.
+	LivenessTimeout time.Duration
+	// SendRate is the number of frames per second sent to the server, with
+	// bursts of up to SendBurst frames. Sending is not limited when zero.
+	SendRate  float64
+	SendBurst int
+	// MaxBatchSize is the maximum number of messages packed in a single
+	// frame when the server supports batches.
+	MaxBatchSize int
+	// NegotiationTimeout is how long messages are held for the server to
+	// negotiate the optional features. A server which does not negotiate in
+	// time, or whose first order is not a Connected order, predates
+	// negotiation: the session goes on without optional features.
+	NegotiationTimeout time.Duration
+	// OutboxMaxSize is the maximum number of messages waiting to be sent,
+	// lower priority messages are dropped first. Unbounded when zero.
+	OutboxMaxSize int
+	// ShutdownTimeout bounds the time spent waiting for running orders and
+	// flushing the outbox when the agent stops.
+	ShutdownTimeout time.Duration
+}
+
+// stopRequest asks the client to flush its outbox and close the stream
+// before the deadline of ctx.
+type stopRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
 type membershipClient struct {
 	modules   []string
 	eeModules []string
 
+	// debug and outdated are updated by configUpdate orders, they are
+	// read when a session is opened.
+	debug    atomic.Bool
+	outdated atomic.Bool
+	// restart is signaled when they changed, to open a new session.
+	restart    chan struct{}
 	clientInfo ClientInfo
-	stopChan   chan chan error
+	config     ConnectionConfig
+	stopChan   chan stopRequest
 	stopped    chan struct{}
+	// stopping is the pending stop request while the outbox is flushed.
+	stopping *stopRequest
+	// ordersStopped is closed once orders must no longer be forwarded.
+	ordersStopped  chan struct{}
+	stopOrdersOnce sync.Once
+	done           chan struct{}
+	state          connectionState
 
 	joinContext context.Context
 	joinCancel  func()
@@ -43,10 +139,17 @@ type membershipClient struct {
 
 	orders chan *generated.Order
 	opts   []grpc.DialOption
+	conn   *grpc.ClientConn
+
+	endpoints *endpoints
 
-	address string
+	outbox    *outbox
+	inventory Inventory
+	limiter   *rate.Limiter
 
-	messages chan *generated.Message
+	// lastOrderSequence is the sequence of the last order forwarded to
+	// Orders, used to drop orders retransmitted by the server.
+	lastOrderSequence atomic.Uint64
 }
 
 func (c *membershipClient) connectMetadata(ctx context.Context) (metadata.MD, error) {
@@ -60,9 +163,12 @@ func (c *membershipClient) connectMetadata(ctx context.Context) (metadata.MD, er
 	md.Append(metadataBaseUrl, c.clientInfo.BaseUrl.String())
 	md.Append(metadataAdditionalBaseUrls, c.clientInfo.AdditionalBaseURLs...)
 	md.Append(metadataProduction, strconv.FormatBool(c.clientInfo.Production))
-	md.Append(metadataOutdated, strconv.FormatBool(c.clientInfo.Outdated))
+	md.Append(metadataOutdated, strconv.FormatBool(c.outdated.Load()))
 	md.Append(metadataVersion, c.clientInfo.Version)
-	md.Append(metadataCapabilities, capabilityEE, capabilityModuleList)
+	md.Append(metadataProtocolVersion, strconv.Itoa(protocolVersion))
+	md.Append(metadataOrders, supportedOrders...)
+	md.Append(metadataMessages, supportedMessages...)
+	md.Append(metadataCapabilities, append([]string{capabilityEE, capabilityModuleList}, c.optionalCapabilities()...)...)
 	md.Append(capabilityModuleList, c.modules...)
 	md.Append(capabilityEE, c.eeModules...)
 	return md, nil
@@ -76,21 +182,150 @@ func LoggingClientStreamInterceptor(l logging.Logger) grpc.StreamClientIntercept
 	}
 }
 
+func newLimiter(sendRate float64, burst int) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	setSendRate(limiter, sendRate, burst)
+	return limiter
+}
+
+// setSendRate updates the limits of a limiter in use, a rate of 0 disables
+// the limit.
+func setSendRate(limiter *rate.Limiter, sendRate float64, burst int) {
+	if sendRate <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	limiter.SetBurst(burst)
+	limiter.SetLimit(rate.Limit(sendRate))
+}
+
+// applyConfig applies the settings of a configUpdate order, send rate
+// limits are effective immediately. Debug and outdated are set when a session
+// is opened, the session is restarted if they changed.
+func (c *membershipClient) applyConfig(config *generated.AgentConfig) {
+	debugChanged := c.debug.Swap(config.GetDebug()) != config.GetDebug()
+	outdatedChanged := c.outdated.Swap(config.GetOutdated()) != config.GetOutdated()
+	setSendRate(c.limiter, config.GetSendRate(), int(config.GetSendBurst()))
+
+	if debugChanged || outdatedChanged {
+		select {
+		case c.restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *membershipClient) pongInterval() time.Duration {
+	if c.config.PongInterval <= 0 {
+		return defaultPongInterval
+	}
+	return c.config.PongInterval
+}
+
+func (c *membershipClient) negotiationTimeout() time.Duration {
+	if c.config.NegotiationTimeout <= 0 {
+		return defaultNegotiationTimeout
+	}
+	return c.config.NegotiationTimeout
+}
+
+// optionalCapabilities lists the optional features enabled by the
+// configuration, advertised to the server.
+func (c *membershipClient) optionalCapabilities() []string {
+	capabilities := make([]string, 0)
+	if c.config.InFlightWindow > 0 {
+		capabilities = append(capabilities, capabilityAck)
+	}
+	if c.config.MaxBatchSize > 1 {
+		capabilities = append(capabilities, capabilityMessageBatch)
+	}
+	return capabilities
+}
+
+// probePrimary periodically checks whether the primary server address
+// accepts connections again, and interrupts the session to fail back to it.
+// The session is interrupted with its own cancel func, c.joinCancel being
+// replaced when the client reconnects.
+func (c *membershipClient) probePrimary(ctx context.Context, cancel func(), address string) {
+	ticker := time.NewTicker(c.config.PrimaryProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.probe(ctx, address) {
+				continue
+			}
+			logging.FromContext(ctx).WithFields(map[string]any{
+				"endpoint": address,
+			}).Infof("Primary server is reachable again, failing back")
+			c.endpoints.Failback()
+			cancel()
+			return
+		}
+	}
+}
+
+func (c *membershipClient) probe(ctx context.Context, address string) bool {
+	conn, err := grpc.NewClient(address, c.opts...)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, primaryProbeTimeout)
+	defer cancel()
+
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return false
+		case connectivity.Idle:
+			conn.Connect()
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
 func (c *membershipClient) connect(ctx context.Context) (generated.Server_JoinClient, error) {
+	address, ok := c.endpoints.Current(ctx)
+	if !ok {
+		return nil, errors.New("no server address available")
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("endpoint", address))
 	logging.FromContext(ctx).WithFields(map[string]any{
-		"id": c.clientInfo.ID,
+		"id":       c.clientInfo.ID,
+		"endpoint": address,
 	}).Infof("Establish connection to server")
-	c.joinContext, c.joinCancel = context.WithCancel(ctx)
+	joinContext, joinCancel := context.WithCancel(ctx)
+	c.joinContext, c.joinCancel = joinContext, joinCancel
+
+	if primary, failedOver := c.endpoints.Primary(); failedOver && c.config.PrimaryProbeInterval > 0 {
+		go c.probePrimary(joinContext, joinCancel, primary)
+	}
 
 	opts := append(c.opts,
 		grpc.WithChainStreamInterceptor(
 			LoggingClientStreamInterceptor(logging.FromContext(ctx)),
 		),
 	)
-	conn, err := grpc.NewClient(c.address, opts...)
+	conn, err := grpc.NewClient(address, opts...)
 	if err != nil {
 		return nil, err
 	}
+	c.conn = conn
 
 	serverClient := generated.NewServerClient(conn)
 
@@ -107,117 +342,529 @@ func (c *membershipClient) connect(ctx context.Context) (generated.Server_JoinCl
 	return joinClient, nil
 }
 
+func (c *membershipClient) disconnect() {
+	if c.joinCancel != nil {
+		c.joinCancel()
+	}
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *membershipClient) setState(ctx context.Context, state connectionState) {
+	if c.state == state {
+		return
+	}
+	logging.FromContext(ctx).WithFields(map[string]any{
+		"from": c.state,
+		"to":   state,
+	}).Infof("Connection state changed")
+	trace.SpanFromContext(ctx).AddEvent("ConnectionStateChanged", trace.WithAttributes(
+		attribute.String("from", string(c.state)),
+		attribute.String("to", string(state)),
+	))
+	c.state = state
+}
+
+// Send queues a message in the outbox, it is written to the stream as soon
+// as a session is available.
 func (c *membershipClient) Send(message *generated.Message) error {
 	select {
 	case <-c.stopped:
 		return errors.New("stopped")
-	case c.messages <- message:
-		return nil
+	default:
+		return c.outbox.Push(message)
 	}
 }
 
-func (c *membershipClient) sendPong(ctx context.Context, client grpcclient.ConnectionAdapter) {
+func (c *membershipClient) sendAck(ctx context.Context, client grpcclient.ConnectionAdapter) error {
+	if err := client.Send(ctx, &generated.Message{
+		Message: &generated.Message_Ack{
+			Ack: &generated.Ack{
+				Sequence: c.lastOrderSequence.Load(),
+			},
+		},
+	}); err != nil {
+		return errors.Wrap(err, "sending ack")
+	}
+	return nil
+}
+
+func (c *membershipClient) sendPong(ctx context.Context, client grpcclient.ConnectionAdapter) error {
 	if err := client.Send(ctx, &generated.Message{
 		Message: &generated.Message_Pong{
 			Pong: &generated.Pong{},
 		},
 	}); err != nil {
-		logging.FromContext(ctx).Errorf("Unable to send pong to server: %s", err)
-		if errors.Is(err, io.EOF) {
-			panic(err)
+		return errors.Wrap(err, "sending pong")
+	}
+	return nil
+}
+
+// sendSnapshot queues the inventory behind the pending messages, which are
+// older than the state it describes.
+func (c *membershipClient) sendSnapshot(ctx context.Context) {
+	snapshot, err := c.inventory.Snapshot(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Unable to build inventory snapshot: %s", err)
+		return
+	}
+
+	logging.FromContext(ctx).WithFields(map[string]any{
+		"stacks":   len(snapshot.Stacks),
+		"modules":  len(snapshot.Modules),
+		"versions": len(snapshot.Versions),
+	}).Infof("Sending inventory snapshot")
+	if err := c.Send(&generated.Message{
+		Message: &generated.Message_Snapshot{
+			Snapshot: snapshot,
+		},
+	}); err != nil {
+		logging.FromContext(ctx).Errorf("Unable to send inventory snapshot: %s", err)
+	}
+}
+
+// Start runs sessions against the membership server until Stop is called,
+// reconnecting with a jittered exponential backoff each time a session ends,
+// unless it was interrupted to fail back to the primary server address or
+// restarted to apply the configuration.
+// The Orders and Send channels are shared by all sessions.
+func (c *membershipClient) Start(ctx context.Context) error {
+	defer close(c.done)
+
+	backoff := newBackoff(c.config.MinReconnectBackoff, c.config.MaxReconnectBackoff)
+	for {
+		connected, err := c.runSession(ctx)
+		if c.stopping != nil {
+			// The session ended while flushing the outbox
+			c.finishStop(ctx, err)
+		}
+		select {
+		case <-c.stopped:
+			c.setState(ctx, stateStopped)
+			return nil
+		default:
+		}
+		if ctx.Err() != nil {
+			c.setState(ctx, stateStopped)
+			return ctx.Err()
+		}
+		if errors.Is(err, errSessionRestarted) {
+			continue
+		}
+		c.endpoints.Report(connected)
+		if connected {
+			backoff.reset()
+		}
+		if c.endpoints.TakeFailback() {
+			continue
+		}
+
+		delay := backoff.next()
+		c.setState(ctx, stateDisconnected)
+		logging.FromContext(ctx).Errorf("Connection to server lost, retrying in %s: %s", delay, err)
+
+		select {
+		case <-ctx.Done():
+			c.setState(ctx, stateStopped)
+			return ctx.Err()
+		case request := <-c.stopChan:
+			c.stopping = &request
+			c.finishStop(ctx, nil)
+			c.setState(ctx, stateStopped)
+			return nil
+		case <-time.After(delay):
 		}
 	}
 }
 
-func (c *membershipClient) Start(ctx context.Context, client grpcclient.ConnectionAdapter) error {
+// runSession opens a stream and serves it until it fails or Stop is called.
+// The returned boolean reports whether the server answered at least once,
+// which is used to reset the reconnection backoff.
+func (c *membershipClient) runSession(ctx context.Context) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Session")
+	defer span.End()
 
+	c.setState(ctx, stateConnecting)
+	// The session is opened with the current configuration
+	select {
+	case <-c.restart:
+	default:
+	}
+	client, err := c.connect(ctx)
+	if err != nil {
+		c.disconnect()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, errors.Wrap(err, "connecting to server")
+	}
+	defer c.disconnect()
+
+	connected, err := c.handleSession(ctx, grpcclient.NewConnectionWithTrace(client, c.debug.Load()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return connected, err
+}
+
+func (c *membershipClient) handleSession(ctx context.Context, client grpcclient.ConnectionAdapter) (bool, error) {
+	sessionContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// gRPC streams do not support concurrent writes, so every Send goes
+	// through this loop, the receiver only asks for pongs and acks.
 	var (
 		errCh = make(chan error, 1)
+		pongs = make(chan struct{}, 1)
+		alive = make(chan struct{}, 1)
+		acks  = make(chan struct{}, 1)
+		// outboxAcked is notified when the server acknowledged messages.
+		outboxAcked = make(chan struct{}, 1)
+		// drainDeadline is the deadline of a pending stop request.
+		drainDeadline <-chan struct{}
+		firstRecv     = make(chan struct{})
+		recvDone      = make(chan struct{})
+		connected     = false
+		// throttled fires when the rate limiter allows sending again.
+		throttled <-chan time.Time
+		// negotiated receives the Connected order of the server, or nil if
+		// the first order shows the server does not negotiate, features
+		// lists the optional features enabled for the session. When the
+		// agent has optional features, messages are held until they are
+		// negotiated, so that the outbox is not flushed without acks.
+		negotiated  = make(chan *generated.Connected, 1)
+		features    []string
+		negotiating = len(c.optionalCapabilities()) > 0
 	)
+	notify := func(ch chan struct{}) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	// Entries left unacknowledged by the previous session are sent again
+	if err := c.outbox.Requeue(); err != nil {
+		return false, errors.Wrap(err, "requeuing messages")
+	}
+	if pending := c.outbox.Len(); pending > 0 {
+		logging.FromContext(ctx).Infof("Replaying %d pending messages", pending)
+	}
+	if c.inventory != nil {
+		go c.sendSnapshot(sessionContext)
+	}
+
 	go func() {
+		defer close(recvDone)
+		first := true
 		for {
-			msg, err := client.Recv(ctx)
+			msg, err := client.Recv(sessionContext)
 			if err != nil {
-				if err == io.EOF {
-					select {
-					case <-c.stopped:
-					default:
-						errCh <- err
-					}
-					return
-				}
-				errCh <- err
+				errCh <- errors.Wrap(err, "receiving order")
 				return
 			}
+			if first || msg.GetConnected() != nil {
+				select {
+				case negotiated <- msg.GetConnected():
+				default:
+				}
+			}
+			if first {
+				close(firstRecv)
+				first = false
+			}
+			notify(alive)
 
 			if msg.GetPing() != nil {
-				c.sendPong(ctx, client)
+				notify(pongs)
 				continue
 			}
 
+			if ack := msg.GetAck(); ack != nil {
+				if err := c.outbox.Ack(ack.Sequence); err != nil {
+					logging.FromContext(ctx).Errorf("Unable to acknowledge messages in outbox: %s", err)
+				}
+				notify(outboxAcked)
+				continue
+			}
+
+			if msg.Sequence != 0 && msg.Sequence <= c.lastOrderSequence.Load() {
+				logging.FromContext(ctx).Debugf("Dropping duplicate order %d", msg.Sequence)
+				notify(acks)
+				continue
+			}
+
+			if c.ordersStoppedBeforeForward(ctx, msg) {
+				continue
+			}
 			select {
 			case c.orders <- msg:
-			case <-ctx.Done():
+			case <-c.ordersStopped:
+				c.ignoreOrder(ctx, msg)
+				continue
+			case <-sessionContext.Done():
 				return
 			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-time.After(5 * time.Second):
-				c.sendPong(ctx, client)
-			case <-ctx.Done():
-				return
+
+			if msg.Sequence != 0 {
+				c.lastOrderSequence.Store(msg.Sequence)
+				notify(acks)
 			}
 		}
 	}()
 
+	closeStream := func() {
+		err := client.CloseSend(ctx)
+		if err == nil {
+			c.joinCancel()
+			<-recvDone
+		}
+		c.finishStop(ctx, err)
+	}
+
+	pongTicker := time.NewTicker(c.pongInterval())
+	defer pongTicker.Stop()
+
+	// A half-open connection does not fail writes, only the lack of orders
+	// and pings from the server reveals it.
+	var (
+		livenessTimer *time.Timer
+		deadline      <-chan time.Time
+	)
+	if c.config.LivenessTimeout > 0 {
+		livenessTimer = time.NewTimer(c.config.LivenessTimeout)
+		defer livenessTimer.Stop()
+		deadline = livenessTimer.C
+	}
+
+	var negotiationDeadline <-chan time.Time
+	if negotiating {
+		negotiationTimer := time.NewTimer(c.negotiationTimeout())
+		defer negotiationTimer.Stop()
+		negotiationDeadline = negotiationTimer.C
+	}
+	// Servers predating negotiation get the messages of protocol v0
+	skipNegotiation := func(reason string) {
+		logging.FromContext(ctx).Infof("Server does not negotiate the protocol (%s), optional features disabled", reason)
+		negotiating = false
+		negotiationDeadline = nil
+		c.outbox.Wake()
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case ch := <-c.stopChan:
-			close(c.stopped)
-			if err := client.CloseSend(ctx); err != nil {
-				ch <- err
-				//nolint:nilerr
-				return nil
+			return connected, ctx.Err()
+		case <-negotiationDeadline:
+			skipNegotiation("nothing negotiated within " + c.negotiationTimeout().String())
+		case <-deadline:
+			return connected, errors.Errorf("nothing received from server for %s", c.config.LivenessTimeout)
+		case <-alive:
+			if livenessTimer != nil {
+				livenessTimer.Reset(c.config.LivenessTimeout)
 			}
-			c.joinCancel()
-
-			// Drain messages
-			for {
-				_, err := client.Recv(ctx)
-				if err != nil {
-					break
+		case <-c.restart:
+			if c.stopping != nil {
+				// The stream is closed once the outbox is flushed
+				continue
+			}
+			logging.FromContext(ctx).Infof("Configuration changed, restarting session")
+			return connected, errSessionRestarted
+		case <-firstRecv:
+			firstRecv = nil
+			connected = true
+			c.setState(ctx, stateConnected)
+		case server := <-negotiated:
+			if !negotiating {
+				// Features are only negotiated when the session opens
+				continue
+			}
+			if server == nil {
+				skipNegotiation("first order is not a Connected order")
+				continue
+			}
+			features = negotiate(c.optionalCapabilities(), server.Capabilities)
+			logging.FromContext(ctx).WithFields(map[string]any{
+				"protocolVersion": server.ProtocolVersion,
+				"features":        features,
+			}).Infof("Negotiated protocol with server")
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.Int("protocolVersion", int(server.ProtocolVersion)),
+				attribute.StringSlice("features", features),
+			)
+			negotiating = false
+			negotiationDeadline = nil
+			c.outbox.Wake()
+		case request := <-c.stopChan:
+			c.stopping = &request
+			drainDeadline = request.ctx.Done()
+			if c.drained() {
+				closeStream()
+				return connected, nil
+			}
+			logging.FromContext(ctx).Infof("Flushing %d messages before closing the stream",
+				c.outbox.Len()+c.outbox.InFlight())
+		case <-drainDeadline:
+			closeStream()
+			return connected, nil
+		case <-outboxAcked:
+			if c.stopping != nil && c.drained() {
+				closeStream()
+				return connected, nil
+			}
+		case <-pongTicker.C:
+			notify(pongs)
+		case <-pongs:
+			if err := c.sendPong(ctx, client); err != nil {
+				return connected, err
+			}
+		case <-acks:
+			if !slices.Contains(features, capabilityAck) {
+				continue
+			}
+			if err := c.sendAck(ctx, client); err != nil {
+				return connected, err
+			}
+		case <-throttled:
+			throttled = nil
+			c.outbox.Wake()
+		case <-c.outbox.Ready():
+			if throttled != nil || negotiating {
+				// The sender is woken up once the rate limiter allows it, or
+				// once the features are negotiated
+				continue
+			}
+			size := 1
+			if slices.Contains(features, capabilityMessageBatch) {
+				size = c.config.MaxBatchSize
+			}
+			if slices.Contains(features, capabilityAck) {
+				size = min(size, c.config.InFlightWindow-c.outbox.InFlight())
+				if size <= 0 {
+					// The window is full, the next ack from the server wakes us up
+					continue
 				}
 			}
 
-			ch <- nil
-			return nil
-		case msg := <-c.messages:
-			if err := client.Send(ctx, msg); err != nil {
-				panic(err)
+			reservation := c.limiter.Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				throttled = time.After(delay)
+				continue
+			}
+			entries, err := c.outbox.Take(size)
+			if err != nil {
+				return connected, errors.Wrap(err, "taking messages from outbox")
+			}
+			if len(entries) == 0 {
+				reservation.Cancel()
+				continue
+			}
+			if err := client.Send(ctx, batchMessage(entries)); err != nil {
+				return connected, errors.Wrap(err, "sending message")
+			}
+
+			if slices.Contains(features, capabilityAck) {
+				c.outbox.Wake()
+			} else if err := c.outbox.Ack(entries[len(entries)-1].sequence); err != nil {
+				logging.FromContext(ctx).Errorf("Unable to acknowledge message in outbox: %s", err)
+			}
+			if c.stopping != nil && c.drained() {
+				closeStream()
+				return connected, nil
 			}
-			<-time.After(50 * time.Millisecond)
 		case err := <-errCh:
 			logging.FromContext(ctx).Errorf("Stream closed with error: %s", err)
-			return err
+			return connected, err
 		}
 	}
 }
 
+// batchMessage packs the entries in a single message when there are many.
+func batchMessage(entries []outboxEntry) *generated.Message {
+	if len(entries) == 1 {
+		return entries[0].message
+	}
+
+	batch := &generated.MessageBatch{
+		Messages: make([]*generated.Message, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		batch.Messages = append(batch.Messages, entry.message)
+	}
+	return &generated.Message{
+		Message: &generated.Message_MessageBatch{
+			MessageBatch: batch,
+		},
+	}
+}
+
+// stopOrders stops forwarding orders to Orders, the first step of a
+// shutdown. Orders received afterwards are left for the next session.
+func (c *membershipClient) stopOrders() {
+	c.stopOrdersOnce.Do(func() {
+		close(c.ordersStopped)
+	})
+}
+
+// ordersStoppedBeforeForward checks the shutdown before forwarding an order,
+// as select would otherwise pick randomly between both when they are ready.
+func (c *membershipClient) ordersStoppedBeforeForward(ctx context.Context, msg *generated.Order) bool {
+	select {
+	case <-c.ordersStopped:
+		c.ignoreOrder(ctx, msg)
+		return true
+	default:
+		return false
+	}
+}
+
+// ignoreOrder drops an order received during shutdown. It is not
+// acknowledged, the server sends it again to the next session.
+func (c *membershipClient) ignoreOrder(ctx context.Context, msg *generated.Order) {
+	logging.FromContext(ctx).WithFields(map[string]any{
+		"sequence":      msg.Sequence,
+		"correlationId": msg.CorrelationId,
+	}).Infof("Ignoring order received during shutdown: %T", msg.GetMessage())
+}
+
+// drained reports whether every message has been delivered.
+func (c *membershipClient) drained() bool {
+	return c.outbox.Len() == 0 && c.outbox.InFlight() == 0
+}
+
+// finishStop answers the pending stop request, messages still in the outbox
+// are sent after the next start if it is persisted.
+func (c *membershipClient) finishStop(ctx context.Context, err error) {
+	if !c.drained() {
+		logging.FromContext(ctx).Errorf("Stopping with %d messages not delivered",
+			c.outbox.Len()+c.outbox.InFlight())
+	}
+	close(c.stopped)
+	c.stopping.done <- err
+	c.stopping = nil
+}
+
+// Stop stops forwarding orders, flushes the outbox and closes the stream.
+// Messages not delivered before the deadline of ctx are kept in the outbox.
 func (c *membershipClient) Stop(ctx context.Context) error {
-	ch := make(chan error)
+	c.stopOrders()
+
+	request := stopRequest{
+		ctx:  ctx,
+		done: make(chan error, 1),
+	}
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case c.stopChan <- ch:
+	case <-c.done:
+		return nil
+	case c.stopChan <- request:
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case err := <-ch:
+		case <-c.done:
+			return nil
+		case err := <-request.done:
 			return err
 		}
 	}
@@ -228,23 +875,37 @@ func (c *membershipClient) Orders() chan *generated.Order {
 }
 
 func NewMembershipClient(
+	debug bool,
 	authenticator Authenticator,
 	clientInfo ClientInfo,
-	address string,
+	config ConnectionConfig,
+	addresses []string,
 	modules modules,
 	eeModules eeModules,
+	outbox *outbox,
+	inventory Inventory,
 	opts ...grpc.DialOption,
 ) *membershipClient {
-	return &membershipClient{
-		stopChan:      make(chan chan error),
+	client := &membershipClient{
+		stopChan:      make(chan stopRequest),
+		restart:       make(chan struct{}, 1),
+		ordersStopped: make(chan struct{}),
 		authenticator: authenticator,
 		clientInfo:    clientInfo,
+		config:        config,
 		opts:          opts,
-		address:       address,
+		endpoints:     newEndpoints(addresses, config.FailoverThreshold),
+		limiter:       newLimiter(config.SendRate, config.SendBurst),
 		orders:        make(chan *generated.Order),
-		messages:      make(chan *generated.Message),
+		outbox:        outbox,
+		inventory:     inventory,
 		stopped:       make(chan struct{}),
+		done:          make(chan struct{}),
+		state:         stateDisconnected,
 		modules:       modules.Singular(),
 		eeModules:     eeModules.Singular(),
 	}
+	client.debug.Store(debug)
+	client.outdated.Store(clientInfo.Outdated)
+	return client
 }
@@ -0,0 +1,596 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+type testSession struct {
+	stream generated.Server_JoinServer
+	close  chan error
+}
+
+// recvMessage returns the next message sent by the agent, skipping pongs.
+func (s *testSession) recvMessage(t *testing.T) *generated.Message {
+	t.Helper()
+	for {
+		msg, err := s.stream.Recv()
+		require.NoError(t, err)
+		if msg.GetPong() == nil {
+			return msg
+		}
+	}
+}
+
+type testServer struct {
+	generated.UnimplementedServerServer
+	sessions chan *testSession
+}
+
+func (s *testServer) Join(stream generated.Server_JoinServer) error {
+	session := &testSession{
+		stream: stream,
+		close:  make(chan error, 1),
+	}
+	select {
+	case s.sessions <- session:
+	case <-stream.Context().Done():
+		return nil
+	}
+	select {
+	case err := <-session.close:
+		return err
+	case <-stream.Context().Done():
+		return nil
+	}
+}
+
+func (s *testServer) nextSession(t *testing.T) *testSession {
+	t.Helper()
+	select {
+	case session := <-s.sessions:
+		return session
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the agent to join")
+		return nil
+	}
+}
+
+func startTestServer(t *testing.T) (*testServer, []grpc.DialOption) {
+	t.Helper()
+
+	server, listener := serveTestServer(t)
+	return server, []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+}
+
+func serveTestServer(t *testing.T) (*testServer, *bufconn.Listener) {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := &testServer{
+		sessions: make(chan *testSession),
+	}
+	grpcServer := grpc.NewServer()
+	generated.RegisterServerServer(grpcServer, server)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	return server, listener
+}
+
+func startTestMembershipClient(t *testing.T, config ConnectionConfig, outbox *outbox, inventory Inventory, opts ...grpc.DialOption) *membershipClient {
+	t.Helper()
+
+	return startTestMembershipClientAt(t, []string{"passthrough:///bufnet"}, config, outbox, inventory, opts...)
+}
+
+func startTestMembershipClientAt(t *testing.T, addresses []string, config ConnectionConfig, outbox *outbox, inventory Inventory, opts ...grpc.DialOption) *membershipClient {
+	t.Helper()
+
+	config.MinReconnectBackoff = 10 * time.Millisecond
+	config.MaxReconnectBackoff = 50 * time.Millisecond
+	client := NewMembershipClient(false, TokenAuthenticator("token"), ClientInfo{
+		ID:      "agent",
+		BaseUrl: &url.URL{},
+	}, config, addresses, modules{}, eeModules{}, outbox, inventory, opts...)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Start(logging.TestingContext())
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, client.Stop(ctx))
+		require.NoError(t, <-done)
+	})
+
+	return client
+}
+
+func expectOrder(t *testing.T, client *membershipClient) *generated.Order {
+	t.Helper()
+	select {
+	case order := <-client.Orders():
+		return order
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for order")
+		return nil
+	}
+}
+
+// connectSession sends the Connected order of the server, advertising the
+// given capabilities, and waits for the client to forward it.
+func connectSession(t *testing.T, session *testSession, client *membershipClient, capabilities ...string) {
+	t.Helper()
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Connected{
+			Connected: &generated.Connected{
+				Capabilities:    capabilities,
+				ProtocolVersion: protocolVersion,
+			},
+		},
+	}))
+	require.NotNil(t, expectOrder(t, client).GetConnected())
+}
+
+func TestMembershipClientReconnect(t *testing.T) {
+	t.Parallel()
+
+	server, opts := startTestServer(t)
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClient(t, ConnectionConfig{}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Connected{
+			Connected: &generated.Connected{},
+		},
+	}))
+	require.NotNil(t, expectOrder(t, client).GetConnected())
+
+	session.close <- grpcstatus.Error(codes.Unavailable, "server restarting")
+
+	session = server.nextSession(t)
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_DeletedStack{
+			DeletedStack: &generated.DeletedStack{
+				ClusterName: "stack",
+			},
+		},
+	}))
+	require.Equal(t, "stack", expectOrder(t, client).GetDeletedStack().GetClusterName())
+
+	require.NoError(t, client.Send(&generated.Message{
+		Message: &generated.Message_StackDeleted{
+			StackDeleted: &generated.DeletedStack{
+				ClusterName: "stack",
+			},
+		},
+	}))
+	require.Equal(t, "stack", session.recvMessage(t).GetStackDeleted().GetClusterName())
+}
+
+func TestMembershipClientReplaysOutbox(t *testing.T) {
+	t.Parallel()
+
+	outbox, err := NewOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, outbox.Push(newStatusChanged("stack", generated.StackStatus_Ready)))
+
+	server, opts := startTestServer(t)
+	startTestMembershipClient(t, ConnectionConfig{}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	require.Equal(t, "stack", session.recvMessage(t).GetStatusChanged().GetClusterName())
+	require.Eventually(t, func() bool {
+		return outbox.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type inventoryFn func(ctx context.Context) (*generated.Snapshot, error)
+
+func (fn inventoryFn) Snapshot(ctx context.Context) (*generated.Snapshot, error) {
+	return fn(ctx)
+}
+
+func (fn inventoryFn) Resync(context.Context, *generated.Resync) ([]*generated.Message, error) {
+	return nil, nil
+}
+
+func TestMembershipClientSendsSnapshotOnConnection(t *testing.T) {
+	t.Parallel()
+
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+
+	server, opts := startTestServer(t)
+	startTestMembershipClient(t, ConnectionConfig{}, outbox, inventoryFn(func(ctx context.Context) (*generated.Snapshot, error) {
+		return &generated.Snapshot{
+			Stacks: []*generated.StatusChanged{{
+				ClusterName: "stack",
+			}},
+		}, nil
+	}), opts...)
+
+	session := server.nextSession(t)
+	require.Equal(t, "stack", session.recvMessage(t).GetSnapshot().GetStacks()[0].GetClusterName())
+
+	session.close <- grpcstatus.Error(codes.Unavailable, "server restarting")
+
+	session = server.nextSession(t)
+	require.NotNil(t, session.recvMessage(t).GetSnapshot())
+}
+
+func TestMembershipClientAcknowledgedDelivery(t *testing.T) {
+	t.Parallel()
+
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	for _, stackName := range []string{"stack1", "stack2", "stack3"} {
+		require.NoError(t, outbox.Push(newStatusChanged(stackName, generated.StackStatus_Ready)))
+	}
+
+	server, opts := startTestServer(t)
+	client := startTestMembershipClient(t, ConnectionConfig{
+		InFlightWindow: 2,
+	}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	connectSession(t, session, client, capabilityAck)
+	require.Equal(t, uint64(1), session.recvMessage(t).Sequence)
+	require.Equal(t, uint64(2), session.recvMessage(t).Sequence)
+
+	// The window is full until the server acknowledges the first message
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Ack{
+			Ack: &generated.Ack{Sequence: 1},
+		},
+	}))
+	require.Equal(t, uint64(3), session.recvMessage(t).Sequence)
+	require.Equal(t, 2, outbox.InFlight())
+
+	// Unacknowledged messages are sent again on the next session
+	session.close <- grpcstatus.Error(codes.Unavailable, "server restarting")
+	session = server.nextSession(t)
+	connectSession(t, session, client, capabilityAck)
+	require.Equal(t, "stack2", session.recvMessage(t).GetStatusChanged().GetClusterName())
+	last := session.recvMessage(t)
+	require.Equal(t, "stack3", last.GetStatusChanged().GetClusterName())
+
+	// Orders are acknowledged and duplicates are dropped
+	order := &generated.Order{
+		Message: &generated.Order_DeletedStack{
+			DeletedStack: &generated.DeletedStack{ClusterName: "stack1"},
+		},
+		Sequence: 5,
+	}
+	require.NoError(t, session.stream.Send(order))
+	require.Equal(t, uint64(5), expectOrder(t, client).Sequence)
+	require.Equal(t, uint64(5), session.recvMessage(t).GetAck().GetSequence())
+
+	require.NoError(t, session.stream.Send(order))
+	require.Equal(t, uint64(5), session.recvMessage(t).GetAck().GetSequence())
+	select {
+	case order := <-client.Orders():
+		t.Fatalf("unexpected duplicate order %d", order.Sequence)
+	default:
+	}
+
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Ack{
+			Ack: &generated.Ack{Sequence: last.Sequence},
+		},
+	}))
+}
+
+func TestMembershipClientNegotiation(t *testing.T) {
+	t.Parallel()
+
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	require.NoError(t, outbox.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+
+	server, opts := startTestServer(t)
+	client := startTestMembershipClient(t, ConnectionConfig{
+		InFlightWindow: 2,
+		MaxBatchSize:   10,
+	}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	md, ok := metadata.FromIncomingContext(session.stream.Context())
+	require.True(t, ok)
+	require.Equal(t, []string{"1"}, md.Get(metadataProtocolVersion))
+	require.Contains(t, md.Get(metadataCapabilities), capabilityAck)
+	require.Contains(t, md.Get(metadataCapabilities), capabilityMessageBatch)
+
+	// Nothing is sent until the features are negotiated
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, outbox.Len())
+
+	// A server without the ACK capability does not acknowledge messages,
+	// which are removed from the outbox as soon as they are sent
+	connectSession(t, session, client)
+	require.Equal(t, "stack1", session.recvMessage(t).GetStatusChanged().GetClusterName())
+	require.Eventually(t, func() bool {
+		return outbox.InFlight() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMembershipClientWithoutNegotiation(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		first   *generated.Order
+	}{
+		{name: "silent server", timeout: 100 * time.Millisecond},
+		{
+			name: "first order is not connected",
+			// Not expected to expire, the first order is enough
+			timeout: time.Hour,
+			first: &generated.Order{
+				Message: &generated.Order_Ping{
+					Ping: &generated.Ping{},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			outbox, err := NewOutbox("", 0)
+			require.NoError(t, err)
+			require.NoError(t, outbox.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+
+			server, opts := startTestServer(t)
+			startTestMembershipClient(t, ConnectionConfig{
+				InFlightWindow:     2,
+				MaxBatchSize:       10,
+				NegotiationTimeout: tc.timeout,
+			}, outbox, nil, opts...)
+
+			// A server predating negotiation never sends a Connected order,
+			// messages are sent as in protocol v0 anyway
+			session := server.nextSession(t)
+			if tc.first != nil {
+				require.NoError(t, session.stream.Send(tc.first))
+			}
+			require.Equal(t, "stack1", session.recvMessage(t).GetStatusChanged().GetClusterName())
+			require.Eventually(t, func() bool {
+				return outbox.InFlight() == 0 && outbox.Len() == 0
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestMembershipClientFailover(t *testing.T) {
+	t.Parallel()
+
+	primary, primaryListener := serveTestServer(t)
+	secondary, secondaryListener := serveTestServer(t)
+	primaryDown := atomic.Bool{}
+	primaryDown.Store(true)
+
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClientAt(t, []string{"passthrough:///primary", "passthrough:///secondary"}, ConnectionConfig{
+		FailoverThreshold:    2,
+		PrimaryProbeInterval: 20 * time.Millisecond,
+	}, outbox, nil,
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			if address == "secondary" {
+				return secondaryListener.DialContext(ctx)
+			}
+			if primaryDown.Load() {
+				return nil, errors.New("connection refused")
+			}
+			return primaryListener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+
+	session := secondary.nextSession(t)
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Connected{
+			Connected: &generated.Connected{},
+		},
+	}))
+	expectOrder(t, client)
+
+	// Once the primary is back, the client leaves the secondary
+	primaryDown.Store(false)
+	primary.nextSession(t)
+	select {
+	case <-session.stream.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the secondary session to be closed")
+	}
+}
+
+func TestMembershipClientLivenessTimeout(t *testing.T) {
+	t.Parallel()
+
+	server, opts := startTestServer(t)
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClient(t, ConnectionConfig{
+		PongInterval:    20 * time.Millisecond,
+		LivenessTimeout: 200 * time.Millisecond,
+	}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Connected{
+			Connected: &generated.Connected{},
+		},
+	}))
+	require.NotNil(t, expectOrder(t, client).GetConnected())
+
+	// Pings keep the session alive
+	for i := 0; i < 5; i++ {
+		require.NoError(t, session.stream.Send(&generated.Order{
+			Message: &generated.Order_Ping{
+				Ping: &generated.Ping{},
+			},
+		}))
+		<-time.After(100 * time.Millisecond)
+	}
+	require.NoError(t, session.stream.Context().Err())
+
+	// The server stays silent, the agent gives up on the stream
+	server.nextSession(t)
+	select {
+	case <-session.stream.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the dead session to be closed")
+	}
+}
+
+func TestMembershipClientBatching(t *testing.T) {
+	t.Parallel()
+
+	server, opts := startTestServer(t)
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClient(t, ConnectionConfig{
+		SendRate:     2,
+		SendBurst:    1,
+		MaxBatchSize: 10,
+	}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	connectSession(t, session, client, capabilityMessageBatch)
+
+	require.NoError(t, client.Send(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.Equal(t, "stack1", session.recvMessage(t).GetStatusChanged().GetClusterName())
+
+	// Messages queued while the rate limiter holds the sender are batched
+	for _, stackName := range []string{"stack2", "stack3", "stack4"} {
+		require.NoError(t, client.Send(newStatusChanged(stackName, generated.StackStatus_Ready)))
+	}
+	batch := session.recvMessage(t).GetMessageBatch()
+	require.NotNil(t, batch)
+	require.Len(t, batch.Messages, 3)
+	for i, msg := range batch.Messages {
+		require.Equal(t, uint64(i+2), msg.Sequence)
+	}
+}
+
+func TestMembershipClientGracefulShutdown(t *testing.T) {
+	t.Parallel()
+
+	server, opts := startTestServer(t)
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClient(t, ConnectionConfig{
+		InFlightWindow: 10,
+	}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	connectSession(t, session, client, capabilityAck)
+	require.NoError(t, client.Send(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.Equal(t, "stack1", session.recvMessage(t).GetStatusChanged().GetClusterName())
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- client.Stop(ctx)
+	}()
+
+	// Orders are no longer forwarded, but results of running orders are
+	// still sent until the outbox is flushed
+	require.Eventually(t, func() bool {
+		select {
+		case <-client.ordersStopped:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_DeletedStack{
+			DeletedStack: &generated.DeletedStack{ClusterName: "stack1"},
+		},
+	}))
+	require.NoError(t, client.Send(newStatusChanged("stack2", generated.StackStatus_Ready)))
+	last := session.recvMessage(t)
+	require.Equal(t, "stack2", last.GetStatusChanged().GetClusterName())
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("stopped before the outbox was flushed: %v", err)
+	case order := <-client.Orders():
+		t.Fatalf("unexpected order received during shutdown: %T", order.GetMessage())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, session.stream.Send(&generated.Order{
+		Message: &generated.Order_Ack{
+			Ack: &generated.Ack{Sequence: last.Sequence},
+		},
+	}))
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the client to stop")
+	}
+	_, err = session.stream.Recv()
+	require.Error(t, err)
+}
+
+func TestMembershipClientRestartsSessionOnConfigChange(t *testing.T) {
+	t.Parallel()
+
+	server, opts := startTestServer(t)
+	outbox, err := NewOutbox("", 0)
+	require.NoError(t, err)
+	client := startTestMembershipClient(t, ConnectionConfig{}, outbox, nil, opts...)
+
+	session := server.nextSession(t)
+	connectSession(t, session, client)
+	md, ok := metadata.FromIncomingContext(session.stream.Context())
+	require.True(t, ok)
+	require.Equal(t, []string{"false"}, md.Get(metadataOutdated))
+
+	// The send rate is applied to the running session
+	client.applyConfig(&generated.AgentConfig{SendRate: proto.Float64(10)})
+	select {
+	case <-server.sessions:
+		t.Fatal("session restarted without a session-scoped change")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.applyConfig(&generated.AgentConfig{Outdated: proto.Bool(true)})
+	session = server.nextSession(t)
+	md, ok = metadata.FromIncomingContext(session.stream.Context())
+	require.True(t, ok)
+	require.Equal(t, []string{"true"}, md.Get(metadataOutdated))
+}
@@ -3,14 +3,19 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
 
@@ -20,12 +25,14 @@ import (
 	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/formancehq/stack/components/agent/internal/grpcclient"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -54,7 +61,10 @@ func (m *MembershipClientMock) Send(message *generated.Message) error {
 }
 
 func (m *MembershipClientMock) GetMessages() []*generated.Message {
-	return m.messages
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.messages)
 }
 
 func NewMembershipClientMock() *MembershipClientMock {
@@ -80,11 +90,41 @@ type membershipListener struct {
 	restMapper       meta.RESTMapper
 	membershipClient MembershipClient
 	modules          modules
-	wp               *pond.WorkerPool
+	inventory        Inventory
+	config           *runtimeConfig
+	kube             kubernetes.Interface
+
+	// wp runs the orders, it is replaced when the worker concurrency is
+	// updated. Replaced pools complete their queued orders in background.
+	wpMu      sync.Mutex
+	wp        *pond.WorkerPool
+	wpStopped bool
+	retired   sync.WaitGroup
+
+	// versionsMu serializes the updates of the Versions derived for stacks
+	versionsMu sync.Mutex
+
+	// pendingSecrets holds, by namespace then name, the AuthClient secrets
+	// waiting for the namespace of their stack to be created
+	pendingMu      sync.Mutex
+	pendingSecrets map[string]map[string]pendingSecret
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
 }
 
 func (c *membershipListener) Start(ctx context.Context) {
-	defer c.wp.StopAndWait()
+	defer close(c.done)
+	defer func() {
+		c.wpMu.Lock()
+		c.wpStopped = true
+		wp := c.wp
+		c.wpMu.Unlock()
+
+		wp.StopAndWait()
+		c.retired.Wait()
+	}()
 	for {
 		select {
 		case msg, ok := <-c.membershipClient.Orders():
@@ -92,8 +132,28 @@ func (c *membershipListener) Start(ctx context.Context) {
 				return
 			}
 
-			c.wp.Submit(func() {
-				ctx = grpcclient.ExtractOtelCtxFromMessage(ctx, msg)
+			c.pool().Submit(func() {
+				select {
+				case <-c.stop:
+					// The order was already acknowledged, membership is told
+					// to send it again
+					logger := logging.FromContext(ctx).WithFields(map[string]any{
+						"sequence":      msg.Sequence,
+						"correlationId": msg.CorrelationId,
+					})
+					logger.Infof("Order not started before shutdown: %T", msg.GetMessage())
+					if msg.GetConnected() != nil {
+						return
+					}
+					result := &orderResult{notExecuted: true}
+					if err := c.membershipClient.Send(result.message(msg)); err != nil {
+						logger.Errorf("Unable to send order result to server: %s", err)
+					}
+					return
+				default:
+				}
+
+				ctx := grpcclient.ExtractOtelCtxFromMessage(ctx, msg)
 
 				ctx, span := tracer.Start(ctx, "NewOrder")
 				defer span.End()
@@ -103,6 +163,9 @@ func (c *membershipListener) Start(ctx context.Context) {
 					WithField("spanId", span.SpanContext().SpanID())
 				logger.Infof("Got message from membership: %T", msg.GetMessage())
 
+				result := &orderResult{}
+				ctx = contextWithOrderResult(ctx, result)
+
 				switch msg := msg.Message.(type) {
 				case *generated.Order_ExistingStack:
 					logger = logger.WithField("stack", msg.ExistingStack.ClusterName)
@@ -136,14 +199,150 @@ func (c *membershipListener) Start(ctx context.Context) {
 					span.SetAttributes(attribute.String("stack", msg.EnabledStack.ClusterName))
 
 					c.enableStack(ctx, msg.EnabledStack)
+				case *generated.Order_Resync:
+					logger = logger.WithFields(map[string]any{
+						"stack": msg.Resync.ClusterName,
+						"kind":  msg.Resync.Kind,
+					})
+					ctx = logging.ContextWithLogger(ctx, logger)
+
+					span.SetName("Resync")
+					span.SetAttributes(
+						attribute.String("stack", msg.Resync.ClusterName),
+						attribute.String("kind", msg.Resync.Kind),
+					)
+
+					c.resync(ctx, msg.Resync)
+				case *generated.Order_UpsertVersions:
+					logger = logger.WithField("versions", msg.UpsertVersions.Name)
+					ctx = logging.ContextWithLogger(ctx, logger)
+
+					span.SetName("UpsertVersions")
+					span.SetAttributes(attribute.String("versions", msg.UpsertVersions.Name))
+
+					c.upsertVersions(ctx, msg.UpsertVersions)
+				case *generated.Order_DeleteVersions:
+					logger = logger.WithField("versions", msg.DeleteVersions.Name)
+					ctx = logging.ContextWithLogger(ctx, logger)
+
+					span.SetName("DeleteVersions")
+					span.SetAttributes(attribute.String("versions", msg.DeleteVersions.Name))
+
+					c.deleteVersions(ctx, msg.DeleteVersions)
+				case *generated.Order_RestartModule:
+					logger = logger.WithFields(map[string]any{
+						"stack":  msg.RestartModule.ClusterName,
+						"module": msg.RestartModule.Kind,
+					})
+					ctx = logging.ContextWithLogger(ctx, logger)
+
+					span.SetName("RestartModule")
+					span.SetAttributes(
+						attribute.String("stack", msg.RestartModule.ClusterName),
+						attribute.String("module", msg.RestartModule.Kind),
+					)
+
+					c.restartModule(ctx, msg.RestartModule)
+				case *generated.Order_RotateStackCredentials:
+					logger = logger.WithField("stack", msg.RotateStackCredentials.ClusterName)
+					ctx = logging.ContextWithLogger(ctx, logger)
+
+					span.SetName("RotateStackCredentials")
+					span.SetAttributes(attribute.String("stack", msg.RotateStackCredentials.ClusterName))
+
+					c.rotateStackCredentials(ctx, msg.RotateStackCredentials)
+				case *generated.Order_ConfigUpdate:
+					span.SetName("UpdateConfig")
+
+					result.config = c.updateConfig(ctx, msg.ConfigUpdate)
+				case *generated.Order_Connected:
+					return
+				default:
+					// Sent by a server implementing a newer protocol, the
+					// order type is unknown to this agent
+					logger.Errorf("Unsupported order")
+					span.SetStatus(codes.Error, "unsupported order")
+					result.unsupported = true
+				}
+
+				if err := c.membershipClient.Send(result.message(msg)); err != nil {
+					logger.Errorf("Unable to send order result to server: %s", err)
 				}
 			})
+		case <-c.stop:
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+func (c *membershipListener) pool() *pond.WorkerPool {
+	c.wpMu.Lock()
+	defer c.wpMu.Unlock()
+
+	return c.wp
+}
+
+// setConcurrency replaces the worker pool if the concurrency changed. Orders
+// already queued are run by the previous pool, so the concurrency may exceed
+// the new one until they complete.
+func (c *membershipListener) setConcurrency(concurrency int) {
+	c.wpMu.Lock()
+	defer c.wpMu.Unlock()
+
+	if c.wp.MaxWorkers() == concurrency || c.wpStopped {
+		return
+	}
+
+	previous := c.wp
+	c.wp = pond.New(concurrency, concurrency)
+	c.retired.Add(1)
+	go func() {
+		defer c.retired.Done()
+		previous.StopAndWait()
+	}()
+}
+
+func (c *membershipListener) applyConfig(config *generated.AgentConfig) {
+	c.setConcurrency(int(config.GetWorkerConcurrency()))
+}
+
+// updateConfig returns the effective configuration, even if the update is
+// rejected.
+func (c *membershipListener) updateConfig(ctx context.Context, update *generated.AgentConfig) *generated.AgentConfig {
+	if c.config == nil {
+		logging.FromContext(ctx).Errorf("Runtime configuration not available")
+		recordFailure(ctx)
+		return nil
+	}
+
+	config, err := c.config.Update(update)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Unable to update configuration: %s", err)
+		recordFailure(ctx)
+		return c.config.Effective()
+	}
+
+	logging.FromContext(ctx).Infof("Configuration updated: %s", config)
+	return config
+}
+
+// Stop stops taking orders and waits for the running ones to complete, the
+// queued ones are not started and reported as not executed.
+func (c *membershipListener) Stop(ctx context.Context) error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for running orders")
+	}
+}
+
 func (c *membershipListener) syncExistingStack(ctx context.Context, membershipStack *generated.Stack) {
 	versions := membershipStack.Versions
 	if versions == "" {
@@ -151,9 +350,37 @@ func (c *membershipListener) syncExistingStack(ctx context.Context, membershipSt
 	}
 
 	metadata := c.generateMetadata(membershipStack)
+	settings := membershipStack.Settings
+
+	// With overrides, the stack uses its own Versions object derived from
+	// the base one
+	if len(membershipStack.VersionOverrides) > 0 {
+		if _, err := c.derivedVersions(ctx, membershipStack.ClusterName, versions, membershipStack.VersionOverrides); err != nil {
+			logging.FromContext(ctx).Errorf("Unable to derive versions of the stack: %s", err)
+			recordObject(ctx, formanceGroupVersion.WithKind("Versions"), stackVersionsName(membershipStack.ClusterName), generated.ObjectAction_ObjectUnchanged, err)
+			return
+		}
+	}
+	base := versions
+	if len(membershipStack.VersionOverrides) > 0 {
+		versions = stackVersionsName(membershipStack.ClusterName)
+	}
+
+	scheduling, err := newStackScheduling(membershipStack)
+	if err == nil {
+		var schedulingSettings []*generated.StackSetting
+		schedulingSettings, err = scheduling.settings()
+		settings = withSchedulingSettings(settings, schedulingSettings)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Invalid scheduling constraints: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Stack"), membershipStack.ClusterName, generated.ObjectAction_ObjectUnchanged,
+			errors.Wrap(err, "invalid scheduling constraints"))
+		return
+	}
 
 	stack, err := c.createOrUpdate(ctx, formanceGroupVersion.WithKind("Stack"), membershipStack.ClusterName, membershipStack.ClusterName, nil, map[string]any{
-		"metadata": metadata,
+		"metadata": stackMetadata(metadata, membershipStack),
 		"spec": map[string]any{
 			"versionsFromFile": versions,
 			"disabled":         membershipStack.Disabled,
@@ -164,13 +391,155 @@ func (c *membershipListener) syncExistingStack(ctx context.Context, membershipSt
 		return
 	}
 
+	c.syncStackVersions(ctx, stack, base, membershipStack.VersionOverrides)
 	c.syncModules(ctx, metadata, stack, membershipStack)
 	c.syncStargate(ctx, metadata, stack, membershipStack)
 	c.syncAuthClients(ctx, metadata, stack, membershipStack.StaticClients)
+	c.syncSettings(ctx, metadata, stack, settings)
+	c.checkScheduling(ctx, stack, scheduling)
 
 	logging.FromContext(ctx).Infof("Stack %s updated cluster side", stack.GetName())
 }
 
+// stackVersionsName is the name of the Versions object derived for a stack
+// with version overrides.
+func stackVersionsName(stackName string) string {
+	return stackName + "-versions"
+}
+
+// derivedVersions returns the content of the Versions object derived for a
+// stack. The base and the overrides are kept in its annotations, so that it
+// can be derived again when the base changes.
+func (c *membershipListener) derivedVersions(ctx context.Context, stackName, base string, overrides map[string]string) (map[string]any, error) {
+	baseVersions, err := c.client.Get(ctx, "versions", base)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading base versions %s", base)
+	}
+
+	versions := extractVersionsSpec(baseVersions)
+	if versions == nil {
+		versions = map[string]string{}
+	}
+	for module, version := range overrides {
+		versions[module] = version
+	}
+
+	spec, err := c.versionsSpec(ctx, stackVersionsName(stackName), stackName, versions)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding version overrides")
+	}
+
+	return map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]any{
+				"formance.com/derived-versions": "true",
+			},
+			"annotations": map[string]any{
+				"formance.com/versions-base":     base,
+				"formance.com/version-overrides": string(data),
+			},
+		},
+		"spec": spec,
+	}, nil
+}
+
+// syncStackVersions creates the Versions object derived for the stack, owned
+// by it so that it is deleted with the stack, or deletes it when the stack
+// has no more overrides.
+func (c *membershipListener) syncStackVersions(ctx context.Context, stack *unstructured.Unstructured, base string, overrides map[string]string) {
+	name := stackVersionsName(stack.GetName())
+	logger := logging.FromContext(ctx)
+
+	if len(overrides) > 0 {
+		// Derived again while holding versionsMu, so that a concurrent change
+		// of the base is not overwritten
+		c.versionsMu.Lock()
+		defer c.versionsMu.Unlock()
+
+		content, err := c.derivedVersions(ctx, stack.GetName(), base, overrides)
+		if err != nil {
+			logger.Errorf("Unable to derive versions of the stack: %s", err)
+			recordObject(ctx, formanceGroupVersion.WithKind("Versions"), name, generated.ObjectAction_ObjectUnchanged, err)
+			return
+		}
+		if _, err := c.createOrUpdate(ctx, formanceGroupVersion.WithKind("Versions"), name, stack.GetName(),
+			stackOwnerReference(stack), content); err != nil {
+			logger.Errorf("Unable to create versions of the stack cluster side: %s", err)
+		}
+		return
+	}
+
+	existing, err := c.client.Get(ctx, "versions", name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.Errorf("Unable to read versions of the stack cluster side: %s", err)
+			recordObject(ctx, formanceGroupVersion.WithKind("Versions"), name, generated.ObjectAction_ObjectDeleted, err)
+		}
+		return
+	}
+	if existing.GetLabels()["formance.com/created-by-agent"] != "true" || derivedVersionsStack(existing) != stack.GetName() {
+		return
+	}
+
+	err = c.client.EnsureNotExists(ctx, "versions", name)
+	recordObject(ctx, formanceGroupVersion.WithKind("Versions"), name, generated.ObjectAction_ObjectDeleted, err)
+	if err != nil {
+		logger.Errorf("Unable to delete versions of the stack cluster side: %s", err)
+	}
+}
+
+// rederiveVersions derives again the Versions objects of the stacks based on
+// the Versions base, after its spec changed.
+func (c *membershipListener) rederiveVersions(ctx context.Context, base string) {
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+
+	logger := logging.FromContext(ctx).WithField("versions", base)
+
+	c.versionsMu.Lock()
+	defer c.versionsMu.Unlock()
+
+	derived, err := c.client.List(ctx, "versions", labels.SelectorFromSet(labels.Set{
+		"formance.com/derived-versions": "true",
+	}))
+	if err != nil {
+		logger.Errorf("Unable to list derived versions: %s", err)
+		return
+	}
+
+	for _, versions := range derived {
+		if versions.GetAnnotations()["formance.com/versions-base"] != base {
+			continue
+		}
+		stackName := derivedVersionsStack(&versions)
+		logger := logger.WithField("stack", stackName)
+
+		overrides := map[string]string{}
+		if err := json.Unmarshal([]byte(versions.GetAnnotations()["formance.com/version-overrides"]), &overrides); err != nil {
+			logger.Errorf("Unable to decode version overrides: %s", err)
+			continue
+		}
+		content, err := c.derivedVersions(ctx, stackName, base, overrides)
+		if err != nil {
+			logger.Errorf("Unable to derive versions of the stack: %s", err)
+			continue
+		}
+		if _, _, err := c.apply(ctx, formanceGroupVersion.WithKind("Versions"), versions.GetName(), stackName, nil, content); err != nil {
+			logger.Errorf("Unable to update versions of the stack cluster side: %s", err)
+			continue
+		}
+		logger.Infof("Versions %s derived again from %s", versions.GetName(), base)
+	}
+}
+
 func (c *membershipListener) generateMetadata(membershipStack *generated.Stack) map[string]any {
 	additionalLabels := map[string]any{}
 	for key, value := range membershipStack.AdditionalLabels {
@@ -188,10 +557,53 @@ func (c *membershipListener) generateMetadata(membershipStack *generated.Stack)
 	}
 
 }
+
+// stackMetadata returns the metadata of the stack object, which carries its
+// expiry in addition to the metadata shared with its dependencies.
+func stackMetadata(metadata map[string]any, membershipStack *generated.Stack) map[string]any {
+	annotations, _ := metadata["annotations"].(map[string]any)
+	annotations = maps.Clone(annotations)
+	if annotations == nil {
+		annotations = map[string]any{}
+	}
+	if membershipStack.ExpiresAt != nil {
+		annotations[stackExpiresAtAnnotation] = membershipStack.ExpiresAt.AsTime().UTC().Format(time.RFC3339)
+	} else {
+		// Removed by the merge patch
+		annotations[stackExpiresAtAnnotation] = nil
+	}
+	// A stack synced by membership is no longer being deleted by the
+	// expirer, if its deletion failed
+	annotations[stackDeletionReasonAnnotation] = nil
+
+	metadata = maps.Clone(metadata)
+	metadata["annotations"] = annotations
+	return metadata
+}
+
+// withAnnotation returns a copy of the metadata shared by the objects of a
+// stack with an annotation added.
+func withAnnotation(metadata map[string]any, key, value string) map[string]any {
+	annotations, _ := metadata["annotations"].(map[string]any)
+	annotations = maps.Clone(annotations)
+	if annotations == nil {
+		annotations = map[string]any{}
+	}
+	annotations[key] = value
+
+	metadata = maps.Clone(metadata)
+	metadata["annotations"] = annotations
+	return metadata
+}
+
 func (c *membershipListener) syncModules(ctx context.Context, metadata map[string]any, stack *unstructured.Unstructured, membershipStack *generated.Stack) {
 	expectedModules := collectionutils.Map(membershipStack.Modules, func(module *generated.Module) string {
 		return strings.ToLower(module.Name)
 	})
+	membershipModules := make(map[string]*generated.Module, len(membershipStack.Modules))
+	for _, module := range membershipStack.Modules {
+		membershipModules[strings.ToLower(module.Name)] = module
+	}
 	logger := logging.FromContext(ctx).WithField("stack", membershipStack.ClusterName)
 	logger.Infof("Syncing modules for stack %s", membershipStack.Modules)
 
@@ -220,54 +632,170 @@ func (c *membershipListener) syncModules(ctx context.Context, metadata map[strin
 			continue
 		}
 
+		// Keys owned by the agent, they take precedence over the spec sent by
+		// membership
+		owned := map[string]any{
+			"stack": stack.GetName(),
+		}
+		// The API server would silently prune the field from modules which
+		// cannot be disabled
+		if specFieldSupported(crd, "disabled") {
+			owned["disabled"] = membershipModules[singular].Disabled
+		} else if membershipModules[singular].Disabled {
+			err := errors.Errorf("module %s does not support being disabled", kind)
+			logger.Errorf("Unable to disable module %s: %s", kind, err)
+			recordObject(ctx, gvk, stack.GetName(), generated.ObjectAction_ObjectUnchanged, err)
+			continue
+		}
 		switch kind {
 		case "Auth":
-			if _, err := c.createOrUpdateStackDependency(ctx, stack.GetName(), stack.GetName(), stack, gvk, map[string]any{
-				"metadata": metadata,
-				"spec": map[string]any{
-					"delegatedOIDCServer": map[string]any{
-						"issuer":       membershipStack.AuthConfig.Issuer,
-						"clientID":     membershipStack.AuthConfig.ClientId,
-						"clientSecret": membershipStack.AuthConfig.ClientSecret,
-					},
-				},
-			}); err != nil {
-				logger.Errorf("Unable to create module Auth cluster side: %s", err)
+			owned["delegatedOIDCServer"] = map[string]any{
+				"issuer":       membershipStack.AuthConfig.Issuer,
+				"clientID":     membershipStack.AuthConfig.ClientId,
+				"clientSecret": membershipStack.AuthConfig.ClientSecret,
 			}
 		case "Gateway":
-			if _, err := c.createOrUpdateStackDependency(ctx, stack.GetName(), stack.GetName(), stack, gvk, map[string]any{
-				"metadata": metadata,
-				"spec": map[string]any{
-					"ingress": map[string]any{
-						"host":   fmt.Sprintf("%s.%s", stack.GetName(), c.clientInfo.BaseUrl.Host),
-						"scheme": c.clientInfo.BaseUrl.Scheme,
-					},
-				},
-			}); client.IgnoreNotFound(err) != nil {
-				logger.Errorf("Unable to create module Gateway cluster side: %s", err)
+			hosts := c.gatewayHosts(ctx, stack.GetName(), membershipStack.CustomDomains)
+			ingress := map[string]any{
+				"host":   hosts[0],
+				"scheme": c.clientInfo.BaseUrl.Scheme,
 			}
-		default:
-			if _, err := c.createOrUpdateStackDependency(ctx, stack.GetName(), stack.GetName(), stack, gvk, map[string]any{
-				"metadata": metadata,
-			}); err != nil {
-				logger.Errorf("Unable to create module %s cluster side: %s", kind, err)
+			// The other hosts are written to spec.ingress.additionalHosts,
+			// which must be declared by the Gateway CRD of the operator
+			// (config/crd/bases/formance.com_gateways.yaml), otherwise the
+			// API server would silently prune them
+			switch {
+			case specFieldSupported(crd, "ingress", "additionalHosts"):
+				ingress["additionalHosts"] = toAnySlice(hosts[1:])
+			case len(hosts) > 1:
+				logger.Errorf("Gateway does not support additional hosts, not serving %s", hosts[1:])
+				recordWarning(ctx, fmt.Sprintf("the gateway of stack %s does not support additional hosts, %s are not served",
+					stack.GetName(), strings.Join(hosts[1:], ", ")))
 			}
+			owned["ingress"] = ingress
+		}
+
+		// Keys are removed from the spec of the module once membership stops
+		// sending them
+		var previous map[string]any
+		if existing, err := c.client.Get(ctx, plural, stack.GetName()); err == nil {
+			previous = lastAppliedSpec(existing)
+		}
+		lastApplied, err := json.Marshal(membershipModules[singular].Spec.AsMap())
+		if err != nil {
+			logger.Errorf("Invalid spec for module %s: %s", kind, err)
+			recordObject(ctx, gvk, stack.GetName(), generated.ObjectAction_ObjectUnchanged, err)
+			continue
+		}
+
+		spec, overridden, err := moduleSpec(membershipModules[singular].Spec, owned, previous)
+		if err == nil {
+			if len(overridden) > 0 {
+				logger.Infof("Ignoring keys of module %s spec owned by the agent: %s", kind, overridden)
+			}
+			err = validateModuleSpec(crd, spec)
+		}
+		if err != nil {
+			logger.Errorf("Invalid spec for module %s: %s", kind, err)
+			recordObject(ctx, gvk, stack.GetName(), generated.ObjectAction_ObjectUnchanged, err)
+			continue
+		}
+
+		_, action, err := c.apply(ctx, gvk, stack.GetName(), stack.GetName(), stackOwnerReference(stack), map[string]any{
+			"metadata": withAnnotation(metadata, lastAppliedSpecAnnotation, string(lastApplied)),
+			"spec":     spec,
+		})
+		// The gateway may be missing from the cluster, which does not fail
+		// the order
+		if err != nil && kind == "Gateway" && client.IgnoreNotFound(err) == nil {
+			logger.Infof("Gateway not found, skipping it")
+			continue
+		}
+		recordObject(ctx, gvk, stack.GetName(), action, err)
+		if err != nil {
+			logger.Errorf("Unable to create module %s cluster side: %s", kind, err)
 		}
 	}
 }
 
+// gatewayHosts returns the hosts served by the gateway of a stack: one per
+// base url of the agent, the primary one first, then the custom domains.
+func (c *membershipListener) gatewayHosts(ctx context.Context, stackName string, customDomains []string) []string {
+	hosts := []string{fmt.Sprintf("%s.%s", stackName, c.clientInfo.BaseUrl.Host)}
+	for _, additionalBaseURL := range c.clientInfo.AdditionalBaseURLs {
+		baseURL, err := url.Parse(additionalBaseURL)
+		if err != nil || baseURL.Host == "" {
+			logging.FromContext(ctx).Errorf("Ignoring invalid additional base url %q: %v", additionalBaseURL, err)
+			continue
+		}
+		hosts = append(hosts, fmt.Sprintf("%s.%s", stackName, baseURL.Host))
+	}
+	for _, domain := range customDomains {
+		hosts = append(hosts, strings.ToLower(domain))
+	}
+
+	// Keep the first occurrence of each host
+	ret := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !slices.Contains(ret, host) {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
 func (c *membershipListener) deleteModule(ctx context.Context, logger logging.Logger, resource string, stackName string) error {
 	logger.Debugf("Deleting module %s", resource)
 
-	return c.client.EnsureNotExistsBySelector(ctx, resource, stackLabels(stackName))
+	// Only used to report the deleted objects
+	objects, listErr := c.client.List(ctx, resource, stackLabels(stackName))
+
+	err := c.client.EnsureNotExistsBySelector(ctx, resource, stackLabels(stackName))
+	if listErr != nil || len(objects) == 0 {
+		if err != nil {
+			recordFailure(ctx)
+		}
+		return err
+	}
+	for _, object := range objects {
+		recordObject(ctx, object.GroupVersionKind(), object.GetName(), generated.ObjectAction_ObjectDeleted, err)
+	}
+	return err
+}
+
+// stackIdentity returns the organization and the id of a stack. Stacks sent
+// by older membership versions only carry them in their name, as
+// <organizationId>-<stackId>.
+func stackIdentity(name string, stack *generated.Stack) (string, string, error) {
+	organizationID, stackID := stack.OrganizationId, stack.StackId
+	if organizationID == "" && stackID == "" {
+		var ok bool
+		organizationID, stackID, ok = strings.Cut(name, "-")
+		if !ok {
+			return "", "", errors.Errorf("unable to parse organization and stack ids from name %q", name)
+		}
+	}
+	if organizationID == "" {
+		return "", "", errors.New("missing organization id")
+	}
+	if stackID == "" {
+		return "", "", errors.New("missing stack id")
+	}
+	return organizationID, stackID, nil
 }
 
 func (c *membershipListener) syncStargate(ctx context.Context, metadata map[string]any, stack *unstructured.Unstructured, membershipStack *generated.Stack) {
 	logger := logging.FromContext(ctx).WithField("stack", stack.GetName())
 	if membershipStack.StargateConfig != nil && membershipStack.StargateConfig.Enabled {
-		parts := strings.Split(stack.GetName(), "-")
 		logger.Debug("Stargate is enabled")
 
+		organizationID, stackID, err := stackIdentity(stack.GetName(), membershipStack)
+		if err != nil {
+			logger.Errorf("Unable to create module Stargate cluster side: %s", err)
+			recordObject(ctx, formanceGroupVersion.WithKind("Stargate"), stack.GetName(), generated.ObjectAction_ObjectUnchanged, err)
+			return
+		}
+
 		tlsSpec := map[string]any{}
 		if membershipStack.StargateConfig.DisableTLS {
 			tlsSpec["disable"] = true
@@ -276,13 +804,13 @@ func (c *membershipListener) syncStargate(ctx context.Context, metadata map[stri
 		if _, err := c.createOrUpdateStackDependency(ctx, stack.GetName(), stack.GetName(), stack, formanceGroupVersion.WithKind("Stargate"), map[string]any{
 			"metadata": metadata,
 			"spec": map[string]any{
-				"organizationID": parts[0],
-				"stackID":        parts[1],
+				"organizationID": organizationID,
+				"stackID":        stackID,
 				"serverURL":      membershipStack.StargateConfig.Url,
 				"auth": map[string]any{
-					"issuer":       membershipStack.AuthConfig.Issuer,
-					"clientID":     membershipStack.AuthConfig.ClientId,
-					"clientSecret": membershipStack.AuthConfig.ClientSecret,
+					"issuer":       membershipStack.GetAuthConfig().GetIssuer(),
+					"clientID":     membershipStack.GetAuthConfig().GetClientId(),
+					"clientSecret": membershipStack.GetAuthConfig().GetClientSecret(),
 				},
 				"tls": tlsSpec,
 			},
@@ -291,21 +819,43 @@ func (c *membershipListener) syncStargate(ctx context.Context, metadata map[stri
 		}
 	} else {
 		logger.Debug("Stargate is disabled")
-		if err := c.client.EnsureNotExists(ctx, "Stargates", stack.GetName()); err != nil {
+		err := c.client.Delete(ctx, "Stargates", stack.GetName())
+		if apierrors.IsNotFound(err) {
+			return
+		}
+		if err != nil {
 			logger.Errorf("Unable to delete module Stargate cluster side: %s", err)
 		}
+		recordObject(ctx, formanceGroupVersion.WithKind("Stargate"), stack.GetName(), generated.ObjectAction_ObjectDeleted, err)
 	}
 }
 
 func (c *membershipListener) syncAuthClients(ctx context.Context, metadata map[string]any, stack *unstructured.Unstructured, staticClients []*generated.AuthClient) {
 	expectedAuthClients := make([]*unstructured.Unstructured, 0)
 	for _, client := range staticClients {
-		authClient, err := c.createOrUpdateStackDependency(ctx, fmt.Sprintf("%s-%s", stack.GetName(), client.Id), stack.GetName(),
+		name := fmt.Sprintf("%s-%s", stack.GetName(), client.Id)
+
+		// The secret is never written in the spec, only a reference to the
+		// Secret holding it
+		var secretRef any
+		if client.Secret != "" {
+			secretRef = map[string]any{
+				"name": name,
+				"key":  authClientSecretKey,
+			}
+		}
+
+		authClient, err := c.createOrUpdateStackDependency(ctx, name, stack.GetName(),
 			stack, formanceGroupVersion.WithKind("AuthClient"), map[string]any{
 				"metadata": metadata,
 				"spec": map[string]any{
-					"id":     client.Id,
-					"public": client.Public,
+					"id":                     client.Id,
+					"public":                 client.Public,
+					"name":                   client.Name,
+					"redirectUris":           toAnySlice(client.RedirectUris),
+					"postLogoutRedirectUris": toAnySlice(client.PostLogoutRedirectUris),
+					"scopes":                 toAnySlice(client.Scopes),
+					"secretFromSecret":       secretRef,
 				},
 			})
 		if err != nil {
@@ -313,11 +863,14 @@ func (c *membershipListener) syncAuthClients(ctx context.Context, metadata map[s
 			continue
 		}
 		expectedAuthClients = append(expectedAuthClients, authClient)
+
+		c.syncAuthClientSecret(ctx, stack, authClient, client.Secret)
 	}
 
 	authClients, err := c.client.List(ctx, "AuthClients", stackLabels(stack.GetName()))
 	if err != nil {
 		logging.FromContext(ctx).Errorf("Unable to list AuthClient cluster side: %s", err)
+		recordFailure(ctx)
 		return
 	}
 
@@ -332,10 +885,209 @@ func (c *membershipListener) syncAuthClients(ctx context.Context, metadata map[s
 
 	for _, name := range authClientsToDelete {
 		logging.FromContext(ctx).Infof("Deleting AuthClient %s", name)
-		if err := c.client.EnsureNotExists(ctx, "AuthClients", name); err != nil {
+		err := c.client.EnsureNotExists(ctx, "AuthClients", name)
+		if err != nil {
 			logging.FromContext(ctx).Errorf("Unable to delete AuthClient %s cluster side: %s", name, err)
 		}
+		recordObject(ctx, formanceGroupVersion.WithKind("AuthClient"), name, generated.ObjectAction_ObjectDeleted, err)
+	}
+}
+
+// syncAuthClientSecret stores the secret of an AuthClient in a Secret of the
+// stack namespace, owned by the AuthClient so that they are deleted together.
+// The Secret is deleted when the client no longer has a secret. The namespace
+// of a new stack may not exist yet, the Secret is then kept pending until the
+// namespace is created.
+func (c *membershipListener) syncAuthClientSecret(ctx context.Context, stack, authClient *unstructured.Unstructured, secret string) {
+	gvk := corev1.SchemeGroupVersion.WithKind("Secret")
+	name := authClient.GetName()
+	logger := logging.FromContext(ctx)
+
+	if c.kube == nil {
+		if secret != "" {
+			err := errors.New("secrets client not available")
+			logger.Errorf("Unable to create AuthClient secret cluster side: %s", err)
+			recordObject(ctx, gvk, name, generated.ObjectAction_ObjectUnchanged, err)
+		}
+		return
+	}
+	secrets := c.kube.CoreV1().Secrets(stack.GetName())
+	// The last order wins over a secret still waiting for its namespace
+	c.dropPendingSecret(stack.GetName(), name)
+
+	if secret == "" {
+		err := secrets.Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Unable to delete AuthClient secret cluster side: %s", err)
+		}
+		recordObject(ctx, gvk, name, generated.ObjectAction_ObjectDeleted, err)
+		return
+	}
+
+	existing, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: stack.GetName(),
+				Labels: map[string]string{
+					"formance.com/created-by-agent": "true",
+					"formance.com/stack":            stack.GetName(),
+				},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "formance.com/v1beta1",
+					Kind:       "AuthClient",
+					Name:       authClient.GetName(),
+					UID:        authClient.GetUID(),
+				}},
+			},
+			Data: map[string][]byte{
+				authClientSecretKey: []byte(secret),
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsNotFound(err) {
+			// The operator creates the namespace of a new stack
+			// asynchronously, the secret is written once it exists
+			c.addPendingSecret(stack, authClient, secret)
+			logger.Infof("Namespace %s not created yet, waiting for it to write the secret of AuthClient %s", stack.GetName(), name)
+			recordWarning(ctx, fmt.Sprintf("namespace %s does not exist yet, the secret of AuthClient %s is written once it is created", stack.GetName(), name))
+			return
+		}
+		recordObject(ctx, gvk, name, generated.ObjectAction_ObjectCreated, err)
+	case err != nil:
+		recordObject(ctx, gvk, name, generated.ObjectAction_ObjectUpdated, err)
+	case string(existing.Data[authClientSecretKey]) == secret:
+		recordObject(ctx, gvk, name, generated.ObjectAction_ObjectUnchanged, nil)
+	default:
+		updated := existing.DeepCopy()
+		updated.Data = map[string][]byte{
+			authClientSecretKey: []byte(secret),
+		}
+		_, err = secrets.Update(ctx, updated, metav1.UpdateOptions{})
+		recordObject(ctx, gvk, name, generated.ObjectAction_ObjectUpdated, err)
+	}
+	if err != nil {
+		logger.Errorf("Unable to write AuthClient secret cluster side: %s", err)
+	}
+}
+
+// pendingSecret is the secret of an AuthClient whose namespace does not exist
+// yet.
+type pendingSecret struct {
+	stack      *unstructured.Unstructured
+	authClient *unstructured.Unstructured
+	secret     string
+}
+
+func (c *membershipListener) addPendingSecret(stack, authClient *unstructured.Unstructured, secret string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	if c.pendingSecrets[stack.GetName()] == nil {
+		c.pendingSecrets[stack.GetName()] = map[string]pendingSecret{}
+	}
+	c.pendingSecrets[stack.GetName()][authClient.GetName()] = pendingSecret{
+		stack:      stack,
+		authClient: authClient,
+		secret:     secret,
+	}
+}
+
+func (c *membershipListener) dropPendingSecret(namespace, name string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	delete(c.pendingSecrets[namespace], name)
+	if len(c.pendingSecrets[namespace]) == 0 {
+		delete(c.pendingSecrets, namespace)
+	}
+}
+
+// syncPendingSecrets writes the AuthClient secrets waiting for namespace,
+// once it exists. Secrets whose namespace is still missing are kept pending.
+func (c *membershipListener) syncPendingSecrets(ctx context.Context, namespace string) {
+	c.pendingMu.Lock()
+	pending := c.pendingSecrets[namespace]
+	delete(c.pendingSecrets, namespace)
+	c.pendingMu.Unlock()
+
+	for _, secret := range pending {
+		c.syncAuthClientSecret(ctx, secret.stack, secret.authClient, secret.secret)
+	}
+}
+
+// settingName derives the name of a Settings object from its key, which
+// may contain characters not allowed in names.
+func settingName(stackName, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%x", stackName, hash[:8])
+}
+
+func (c *membershipListener) syncSettings(ctx context.Context, metadata map[string]any, stack *unstructured.Unstructured, settings []*generated.StackSetting) {
+	expectedSettings := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		name := settingName(stack.GetName(), setting.Key)
+		if _, err := c.createOrUpdate(ctx, formanceGroupVersion.WithKind("Settings"), name, stack.GetName(),
+			stackOwnerReference(stack), map[string]any{
+				"metadata": metadata,
+				"spec": map[string]any{
+					"stacks": []any{stack.GetName()},
+					"key":    setting.Key,
+					"value":  setting.Value,
+				},
+			}); err != nil {
+			logging.FromContext(ctx).Errorf("Unable to create Settings %s cluster side: %s", setting.Key, err)
+		}
+		expectedSettings = append(expectedSettings, name)
+	}
+
+	existingSettings, err := c.client.List(ctx, "settings", stackLabels(stack.GetName()))
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Unable to list Settings cluster side: %s", err)
+		recordFailure(ctx)
+		return
+	}
+
+	for _, item := range existingSettings {
+		if slices.Contains(expectedSettings, item.GetName()) {
+			continue
+		}
+		logging.FromContext(ctx).Infof("Deleting Settings %s", item.GetName())
+		err := c.client.EnsureNotExists(ctx, "settings", item.GetName())
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Unable to delete Settings %s cluster side: %s", item.GetName(), err)
+		}
+		recordObject(ctx, formanceGroupVersion.WithKind("Settings"), item.GetName(), generated.ObjectAction_ObjectDeleted, err)
+	}
+}
+
+// checkScheduling warns membership when no node of the cluster satisfies the
+// scheduling constraints of the stack.
+func (c *membershipListener) checkScheduling(ctx context.Context, stack *unstructured.Unstructured, scheduling *stackScheduling) {
+	if !scheduling.constrained() || c.kube == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+
+	nodes, err := c.kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(scheduling.nodeSelector).String(),
+	})
+	if err != nil {
+		logger.Errorf("Unable to list nodes to check scheduling constraints: %s", err)
+		return
+	}
+	for _, node := range nodes.Items {
+		if scheduling.schedulable(ctx, &node) {
+			return
+		}
 	}
+
+	logger.Errorf("No node satisfies the scheduling constraints of the stack")
+	recordWarning(ctx, fmt.Sprintf("no node satisfies the scheduling constraints of stack %s", stack.GetName()))
 }
 
 func (c *membershipListener) deleteStack(ctx context.Context, stack *generated.DeletedStack) {
@@ -350,20 +1102,25 @@ func (c *membershipListener) deleteStack(ctx context.Context, stack *generated.D
 				},
 			}); err != nil {
 				logger.Errorf("Unable to send stack delete to server: %s", err)
+				recordFailure(ctx)
 				return
 			}
 			return
 		}
 
 		logger.Errorf("Deleting cluster side: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Stack"), stack.ClusterName, generated.ObjectAction_ObjectDeleted, err)
 		return
 	}
 
+	recordObject(ctx, formanceGroupVersion.WithKind("Stack"), stack.ClusterName, generated.ObjectAction_ObjectDeleted, nil)
 	logger.Infof("Stack %s deleted", stack.ClusterName)
 }
 
 func (c *membershipListener) disableStack(ctx context.Context, stack *generated.DisabledStack) {
-	if err := c.client.Patch(ctx, "Stacks", stack.ClusterName, []byte(`{"spec": {"disabled": true}}`)); err != nil {
+	err := c.client.Patch(ctx, "Stacks", stack.ClusterName, []byte(`{"spec": {"disabled": true}}`))
+	recordObject(ctx, formanceGroupVersion.WithKind("Stack"), stack.ClusterName, generated.ObjectAction_ObjectUpdated, err)
+	if err != nil {
 		logging.FromContext(ctx).Errorf("Disabling cluster side: %s", err)
 		return
 	}
@@ -372,7 +1129,9 @@ func (c *membershipListener) disableStack(ctx context.Context, stack *generated.
 }
 
 func (c *membershipListener) enableStack(ctx context.Context, stack *generated.EnabledStack) {
-	if err := c.client.Patch(ctx, "Stacks", stack.ClusterName, []byte(`{"spec": {"disabled": false}}`)); err != nil {
+	err := c.client.Patch(ctx, "Stacks", stack.ClusterName, []byte(`{"spec": {"disabled": false}}`))
+	recordObject(ctx, formanceGroupVersion.WithKind("Stack"), stack.ClusterName, generated.ObjectAction_ObjectUpdated, err)
+	if err != nil {
 		logging.FromContext(ctx).Errorf("Disabling cluster side: %s", err)
 		return
 	}
@@ -380,39 +1139,227 @@ func (c *membershipListener) enableStack(ctx context.Context, stack *generated.E
 	logging.FromContext(ctx).Infof("Stack %s enabled", stack.ClusterName)
 }
 
+// versionsSpec returns the spec replacing the one of the Versions object
+// name, modules which are no longer listed are removed. stackName is the
+// stack the object is derived for, empty for Versions shared by stacks.
+// errVersionsNotManaged is returned for Versions objects applied by hand,
+// which membership cannot update nor delete.
+var errVersionsNotManaged = errors.New("versions not managed by the agent")
+
+// errVersionsDerived is returned when membership updates or deletes the
+// Versions derived for a stack, which are managed with the stack.
+var errVersionsDerived = errors.New("versions derived for a stack")
+
+// errVersionsShared is returned when the Versions derived for a stack would
+// replace Versions shared by stacks.
+var errVersionsShared = errors.New("versions shared by stacks")
+
+func (c *membershipListener) versionsSpec(ctx context.Context, name, stackName string, versions map[string]string) (map[string]any, error) {
+	spec := map[string]any{}
+	for module, version := range versions {
+		spec[module] = version
+	}
+
+	existing, err := c.client.Get(ctx, "versions", name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return spec, nil
+		}
+		return nil, errors.Wrap(err, "reading versions")
+	}
+	if existing.GetLabels()["formance.com/created-by-agent"] != "true" {
+		return nil, errVersionsNotManaged
+	}
+	switch derived := derivedVersionsStack(existing); {
+	case stackName == "" && derived != "":
+		return nil, errors.Wrapf(errVersionsDerived, "stack %s", derived)
+	case stackName != "" && derived != stackName:
+		return nil, errVersionsShared
+	}
+	for module := range extractVersionsSpec(existing) {
+		if _, ok := spec[module]; !ok {
+			spec[module] = nil
+		}
+	}
+	return spec, nil
+}
+
+// reservedVersionsName returns the stack which the name of Versions is
+// reserved for, membership cannot create Versions named after the ones
+// derived for an existing stack.
+func (c *membershipListener) reservedVersionsName(ctx context.Context, name string) (string, error) {
+	stackName, ok := strings.CutSuffix(name, "-versions")
+	if !ok {
+		return "", nil
+	}
+	if _, err := c.client.Get(ctx, "stacks", stackName); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "reading stack")
+	}
+	return stackName, nil
+}
+
+// upsertVersions only updates objects created by the agent, the ones applied
+// by hand and the ones derived for stacks are left untouched.
+func (c *membershipListener) upsertVersions(ctx context.Context, versions *generated.UpsertVersions) {
+	spec, err := c.versionsSpec(ctx, versions.Name, "", versions.Versions)
+	if err == nil {
+		var stackName string
+		stackName, err = c.reservedVersionsName(ctx, versions.Name)
+		if err == nil && stackName != "" {
+			err = errors.Wrapf(errVersionsDerived, "stack %s", stackName)
+		}
+	}
+	if errors.Is(err, errVersionsNotManaged) || errors.Is(err, errVersionsDerived) {
+		logging.FromContext(ctx).Errorf("Refusing to update versions cluster side: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Unable to read versions cluster side: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, generated.ObjectAction_ObjectUpdated, err)
+		return
+	}
+
+	if _, err := c.createOrUpdate(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, "", nil, map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				"formance.com/deprecated": strconv.FormatBool(versions.Deprecated),
+			},
+		},
+		"spec": spec,
+	}); err != nil {
+		logging.FromContext(ctx).Errorf("Unable to create versions cluster side: %s", err)
+		return
+	}
+
+	logging.FromContext(ctx).Infof("Versions %s updated cluster side", versions.Name)
+}
+
+// deleteVersions only deletes objects created by the agent, the ones applied
+// by hand and the ones derived for stacks are left untouched.
+func (c *membershipListener) deleteVersions(ctx context.Context, versions *generated.DeleteVersions) {
+	logger := logging.FromContext(ctx)
+
+	existing, err := c.client.Get(ctx, "versions", versions.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// Already deleted, membership may have missed the event
+			if err := c.membershipClient.Send(&generated.Message{
+				Message: &generated.Message_DeletedVersion{
+					DeletedVersion: &generated.DeletedVersion{
+						Name: versions.Name,
+					},
+				},
+			}); err != nil {
+				logger.Errorf("Unable to send versions delete to server: %s", err)
+				recordFailure(ctx)
+			}
+			return
+		}
+
+		logger.Errorf("Unable to read versions cluster side: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, generated.ObjectAction_ObjectDeleted, err)
+		return
+	}
+
+	switch {
+	case existing.GetLabels()["formance.com/created-by-agent"] != "true":
+		err = errVersionsNotManaged
+	case derivedVersionsStack(existing) != "":
+		err = errors.Wrapf(errVersionsDerived, "stack %s", derivedVersionsStack(existing))
+	}
+	if err != nil {
+		logger.Errorf("Refusing to delete versions cluster side: %s", err)
+		recordObject(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, generated.ObjectAction_ObjectDeleted, err)
+		return
+	}
+
+	err = c.client.EnsureNotExists(ctx, "versions", versions.Name)
+	recordObject(ctx, formanceGroupVersion.WithKind("Versions"), versions.Name, generated.ObjectAction_ObjectDeleted, err)
+	if err != nil {
+		logger.Errorf("Deleting versions cluster side: %s", err)
+		return
+	}
+
+	logger.Infof("Versions %s deleted", versions.Name)
+}
+
+func (c *membershipListener) resync(ctx context.Context, scope *generated.Resync) {
+	messages, err := c.inventory.Resync(ctx, scope)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Unable to read objects to resync: %s", err)
+		recordFailure(ctx)
+		return
+	}
+
+	for _, message := range messages {
+		if err := c.membershipClient.Send(message); err != nil {
+			logging.FromContext(ctx).Errorf("Unable to send resync message to server: %s", err)
+			recordFailure(ctx)
+			return
+		}
+	}
+
+	logging.FromContext(ctx).Infof("Resynced %d objects", len(messages))
+}
+
+// createOrUpdate applies an object and records the outcome in the result of
+// the order being executed.
 func (c *membershipListener) createOrUpdate(ctx context.Context, gvk schema.GroupVersionKind, name string, stackName string, owner *metav1.OwnerReference, content map[string]any) (*unstructured.Unstructured, error) {
+	u, action, err := c.apply(ctx, gvk, name, stackName, owner, content)
+	recordObject(ctx, gvk, name, action, err)
+	return u, err
+}
+
+// apply creates an object, or patches it if its content differs, and returns
+// the action taken.
+func (c *membershipListener) apply(ctx context.Context, gvk schema.GroupVersionKind, name string, stackName string, owner *metav1.OwnerReference, content map[string]any) (*unstructured.Unstructured, generated.ObjectAction, error) {
+	action := generated.ObjectAction_ObjectUnchanged
 
 	logger := logging.FromContext(ctx).WithFields(map[string]any{
 		"gvk": gvk,
 	})
 	logger.Infof("creating object '%s'", name)
-	if content["metadata"] == nil {
-		content["metadata"] = map[string]any{}
+	// The metadata is shared by the objects of a stack, it is copied so that
+	// the name and labels of an object do not leak to the next ones
+	metadata, _ := content["metadata"].(map[string]any)
+	metadata = maps.Clone(metadata)
+	if metadata == nil {
+		metadata = map[string]any{}
 	}
-
-	if content["metadata"].(map[string]any)["labels"] == nil {
-		content["metadata"].(map[string]any)["labels"] = map[string]any{}
+	labels, _ := metadata["labels"].(map[string]any)
+	labels = maps.Clone(labels)
+	if labels == nil {
+		labels = map[string]any{}
 	}
 
-	content["metadata"].(map[string]any)["labels"].(map[string]any)["formance.com/created-by-agent"] = "true"
-	content["metadata"].(map[string]any)["labels"].(map[string]any)["formance.com/stack"] = stackName
-	content["metadata"].(map[string]any)["name"] = name
+	labels["formance.com/created-by-agent"] = "true"
+	if stackName != "" {
+		labels["formance.com/stack"] = stackName
+	}
+	metadata["labels"] = labels
+	metadata["name"] = name
+	content["metadata"] = metadata
 
 	restMapping, err := c.restMapper.RESTMapping(gvk.GroupKind())
 	if err != nil {
-		return nil, errors.Wrap(err, "getting rest mapping")
+		return nil, action, errors.Wrap(err, "getting rest mapping")
 	}
 
 	u, err := c.client.Get(ctx, restMapping.Resource.Resource, name)
 	if err != nil {
 		if !apierrors.IsNotFound(err) {
-			return nil, errors.Wrap(err, "reading object")
+			return nil, action, errors.Wrap(err, "reading object")
 		}
 
 		logger.Infof("Object not found, create a new one")
+		action = generated.ObjectAction_ObjectCreated
 
 		u := &unstructured.Unstructured{}
-		u.SetUnstructuredContent(content)
+		u.SetUnstructuredContent(withoutRemovedFields(content))
 		u.SetGroupVersionKind(gvk)
 		u.SetName(name)
 		if owner != nil {
@@ -420,29 +1367,30 @@ func (c *membershipListener) createOrUpdate(ctx context.Context, gvk schema.Grou
 		}
 
 		if err := c.client.Create(ctx, restMapping.Resource.Resource, u); err != nil {
-			return nil, errors.Wrap(err, "creating object")
+			return nil, action, errors.Wrap(err, "creating object")
 		}
 
-		return u, nil
+		return u, action, nil
 
 	}
 
-	if equality.Semantic.DeepDerivative(content, u.Object) {
+	if equality.Semantic.DeepDerivative(content, u.Object) && !removesFields(content, u.Object) {
 		logger.Infof("Object found and has expected content, skip it")
-		return u, nil
+		return u, action, nil
 	}
 
 	logger.Infof("Object exists and content differ, patch it")
+	action = generated.ObjectAction_ObjectUpdated
 	contentData, err := json.Marshal(content)
 	if err != nil {
-		return nil, err
+		return nil, action, err
 	}
 
 	if err := c.client.Patch(ctx, restMapping.Resource.Resource, name, contentData); err != nil {
-		return nil, errors.Wrap(err, "patching object")
+		return nil, action, errors.Wrap(err, "patching object")
 	}
 
-	return u, nil
+	return u, action, nil
 }
 
 func (c *membershipListener) createOrUpdateStackDependency(
@@ -458,13 +1406,16 @@ func (c *membershipListener) createOrUpdateStackDependency(
 	}
 	content["spec"].(map[string]any)["stack"] = stack.GetName()
 
-	return c.createOrUpdate(ctx, gvk, name, stackName,
-		&metav1.OwnerReference{
-			APIVersion: "formance.com/v1beta1",
-			Kind:       "Stack",
-			Name:       stack.GetName(),
-			UID:        stack.GetUID(),
-		}, content)
+	return c.createOrUpdate(ctx, gvk, name, stackName, stackOwnerReference(stack), content)
+}
+
+func stackOwnerReference(stack *unstructured.Unstructured) *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		APIVersion: "formance.com/v1beta1",
+		Kind:       "Stack",
+		Name:       stack.GetName(),
+		UID:        stack.GetUID(),
+	}
 }
 
 func NewMembershipListener(
@@ -473,17 +1424,36 @@ func NewMembershipListener(
 	mapper meta.RESTMapper,
 	membershipClient MembershipClient,
 	modules modules,
+	inventory Inventory,
+	config *runtimeConfig,
+	kube kubernetes.Interface,
 ) *membershipListener {
 	return &membershipListener{
 		client:           client,
 		clientInfo:       clientInfo,
 		restMapper:       mapper,
 		membershipClient: membershipClient,
-		wp:               pond.New(5, 5),
+		wp:               pond.New(defaultWorkerConcurrency, defaultWorkerConcurrency),
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
 		modules:          modules,
+		inventory:        inventory,
+		config:           config,
+		kube:             kube,
+		pendingSecrets:   map[string]map[string]pendingSecret{},
 	}
 }
 
+// authClientSecretKey is the key of the client secret in the Secret
+// referenced by an AuthClient.
+const authClientSecretKey = "secret"
+
+func toAnySlice(values []string) []any {
+	return collectionutils.Map(values, func(value string) any {
+		return value
+	})
+}
+
 func must[T any](t *T, err error) T {
 	if err != nil {
 		panic(err)
@@ -3,9 +3,12 @@ package internal
 import (
 	"context"
 	"fmt"
+	"maps"
 	"math/rand"
+	"net/url"
 	"path/filepath"
 	osRuntime "runtime"
+	"slices"
 	"testing"
 	"time"
 
@@ -15,14 +18,19 @@ import (
 	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 )
 
@@ -123,7 +131,7 @@ func TestDeleteModule(t *testing.T) {
 				require.NoError(t, testConfig.client.Post().Resource(resources.Resource.Resource).Body(recon).Do(ctx).Error())
 				orders := NewMembershipClientMock()
 
-				membershipListener := NewMembershipListener(NewDefaultK8SClient(testConfig.client), ClientInfo{}, testConfig.mapper, orders, []v1apis.CustomResourceDefinition{})
+				membershipListener := NewMembershipListener(NewDefaultK8SClient(testConfig.client), ClientInfo{}, testConfig.mapper, orders, []v1apis.CustomResourceDefinition{}, nil, nil, nil)
 
 				if tc.withLabels {
 					require.NoError(t, membershipListener.deleteModule(ctx, logging.Testing(), resources.Resource.Resource, stackName))
@@ -184,7 +192,7 @@ func TestSyncAuthClients(t *testing.T) {
 	}
 	test(t, func(ctx context.Context, tc *testConfig) {
 		t.Parallel()
-		listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, NewMembershipClientMock(), []v1apis.CustomResourceDefinition{})
+		listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, NewMembershipClientMock(), []v1apis.CustomResourceDefinition{}, nil, nil, nil)
 
 		stackName := uuid.NewString() + "-" + randStr(4)
 		stackuid := uuid.NewString()
@@ -243,7 +251,7 @@ func TestSyncStargate(t *testing.T) {
 		t.Run(fmt.Sprintf("%s enabled=%t", t.Name(), tcase.enabled), func(t *testing.T) {
 			test(t, func(ctx context.Context, tc *testConfig) {
 				t.Parallel()
-				listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, NewMembershipClientMock(), []v1apis.CustomResourceDefinition{})
+				listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, NewMembershipClientMock(), []v1apis.CustomResourceDefinition{}, nil, nil, nil)
 
 				stackName := uuid.NewString() + "-" + randStr(4)
 				stackuid := uuid.NewString()
@@ -301,7 +309,7 @@ func TestDeleteStackNotExisting(t *testing.T) {
 	test(t, func(ctx context.Context, tc *testConfig) {
 		t.Parallel()
 		mock := NewMembershipClientMock()
-		listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, mock, []v1apis.CustomResourceDefinition{})
+		listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{}, tc.mapper, mock, []v1apis.CustomResourceDefinition{}, nil, nil, nil)
 		listener.deleteStack(ctx, &generated.DeletedStack{
 			ClusterName: "non-existing-stack",
 		})
@@ -315,3 +323,697 @@ func TestDeleteStackNotExisting(t *testing.T) {
 		require.Equal(t, "non-existing-stack", message.StackDeleted.ClusterName)
 	})
 }
+
+func TestVersionsOrders(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	require.NoError(t, client.Create(context.Background(), "versions", newTestObject("Versions", "manual", nil, nil)))
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	upsert := func(correlationID string, versions map[string]string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_UpsertVersions{
+				UpsertVersions: &generated.UpsertVersions{
+					Name:       "v1",
+					Versions:   versions,
+					Deprecated: true,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	deleteVersions := func(correlationID, name string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_DeleteVersions{
+				DeleteVersions: &generated.DeleteVersions{Name: name},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+
+	result := upsert("create", map[string]string{"ledger": "v2.0.0", "payments": "v2.0.0"})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectCreated, result.Objects[0].Action)
+
+	versions, err := client.Get(context.Background(), "versions", "v1")
+	require.NoError(t, err)
+	require.Equal(t, "true", versions.GetLabels()["formance.com/created-by-agent"])
+	require.NotContains(t, versions.GetLabels(), "formance.com/stack")
+	require.Equal(t, "true", versions.GetAnnotations()["formance.com/deprecated"])
+
+	result = upsert("unchanged", map[string]string{"ledger": "v2.0.0", "payments": "v2.0.0"})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectUnchanged, result.Objects[0].Action)
+
+	// Removing a module is an update, even if the remaining ones are unchanged
+	result = upsert("update", map[string]string{"ledger": "v2.0.0"})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectUpdated, result.Objects[0].Action)
+
+	// Versions applied by hand are neither deleted nor updated
+	result = deleteVersions("manual", "manual")
+	require.False(t, result.Success)
+	_, err = client.Get(context.Background(), "versions", "manual")
+	require.NoError(t, err)
+
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_UpsertVersions{
+			UpsertVersions: &generated.UpsertVersions{
+				Name:     "manual",
+				Versions: map[string]string{"ledger": "v2.0.0"},
+			},
+		},
+		CorrelationId: "upsert-manual",
+	}
+	result = waitOrderResult(t, membershipClient, "upsert-manual")
+	require.False(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectUnchanged, result.Objects[0].Action)
+	require.Equal(t, errVersionsNotManaged.Error(), result.Objects[0].Error)
+	versions, err = client.Get(context.Background(), "versions", "manual")
+	require.NoError(t, err)
+	require.NotContains(t, versions.GetLabels(), "formance.com/created-by-agent")
+	require.NotContains(t, versions.Object, "spec")
+
+	result = deleteVersions("delete", "v1")
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectDeleted, result.Objects[0].Action)
+
+	result = deleteVersions("missing", "v1")
+	require.True(t, result.Success)
+	require.Empty(t, result.Objects)
+	require.True(t, slices.ContainsFunc(membershipClient.GetMessages(), func(message *generated.Message) bool {
+		return message.GetDeletedVersion().GetName() == "v1"
+	}))
+}
+
+func TestStackVersionOverrides(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	require.NoError(t, client.Create(context.Background(), "versions", newTestObject("Versions", "default", nil, map[string]any{
+		"spec": map[string]any{"ledger": "v2.0.0", "payments": "v2.0.0"},
+	})))
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	syncStack := func(correlationID, versions string, overrides map[string]string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName:      "stack1",
+					Versions:         versions,
+					VersionOverrides: overrides,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+
+	result := syncStack("override", "", map[string]string{"ledger": "v2.0.1"})
+	require.True(t, result.Success)
+
+	stack, err := client.Get(context.Background(), "stacks", "stack1")
+	require.NoError(t, err)
+	versionsFromFile, _, _ := unstructured.NestedString(stack.Object, "spec", "versionsFromFile")
+	require.Equal(t, "stack1-versions", versionsFromFile)
+
+	versions, err := client.Get(context.Background(), "versions", "stack1-versions")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ledger": "v2.0.1", "payments": "v2.0.0"}, extractVersionsSpec(versions))
+	require.Equal(t, "stack1", versions.GetLabels()["formance.com/stack"])
+	require.Equal(t, "true", versions.GetLabels()["formance.com/derived-versions"])
+	require.Equal(t, "default", versions.GetAnnotations()["formance.com/versions-base"])
+	require.Len(t, versions.GetOwnerReferences(), 1)
+	require.Equal(t, "Stack", versions.GetOwnerReferences()[0].Kind)
+
+	// Membership cannot update nor delete the derived versions, nor create
+	// versions named after them
+	for _, order := range []*generated.Order{{
+		Message: &generated.Order_UpsertVersions{
+			UpsertVersions: &generated.UpsertVersions{Name: "stack1-versions", Versions: map[string]string{"ledger": "v1.0.0"}},
+		},
+		CorrelationId: "upsert-derived",
+	}, {
+		Message: &generated.Order_DeleteVersions{
+			DeleteVersions: &generated.DeleteVersions{Name: "stack1-versions"},
+		},
+		CorrelationId: "delete-derived",
+	}} {
+		membershipClient.Orders() <- order
+		result = waitOrderResult(t, membershipClient, order.CorrelationId)
+		require.False(t, result.Success)
+		require.Contains(t, result.Objects[0].Error, errVersionsDerived.Error())
+	}
+	versions, err = client.Get(context.Background(), "versions", "stack1-versions")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ledger": "v2.0.1", "payments": "v2.0.0"}, extractVersionsSpec(versions))
+
+	require.NoError(t, client.Create(context.Background(), "stacks", newTestObject("Stack", "stack2", nil, nil)))
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_UpsertVersions{
+			UpsertVersions: &generated.UpsertVersions{Name: "stack2-versions", Versions: map[string]string{"ledger": "v1.0.0"}},
+		},
+		CorrelationId: "upsert-reserved",
+	}
+	result = waitOrderResult(t, membershipClient, "upsert-reserved")
+	require.False(t, result.Success)
+	_, err = client.Get(context.Background(), "versions", "stack2-versions")
+	require.True(t, apierrors.IsNotFound(err))
+
+	// Shared versions are not replaced by the ones derived for a stack
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_UpsertVersions{
+			UpsertVersions: &generated.UpsertVersions{Name: "stack3-versions", Versions: map[string]string{"ledger": "v1.0.0"}},
+		},
+		CorrelationId: "upsert-shared",
+	}
+	require.True(t, waitOrderResult(t, membershipClient, "upsert-shared").Success)
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_ExistingStack{
+			ExistingStack: &generated.Stack{
+				ClusterName:      "stack3",
+				VersionOverrides: map[string]string{"ledger": "v2.0.1"},
+			},
+		},
+		CorrelationId: "derive-shared",
+	}
+	result = waitOrderResult(t, membershipClient, "derive-shared")
+	require.False(t, result.Success)
+	require.Equal(t, errVersionsShared.Error(), result.Objects[0].Error)
+	versions, err = client.Get(context.Background(), "versions", "stack3-versions")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ledger": "v1.0.0"}, extractVersionsSpec(versions))
+
+	// The base versions must exist to derive the ones of the stack
+	result = syncStack("missing", "missing", map[string]string{"ledger": "v2.0.1"})
+	require.False(t, result.Success)
+
+	// Without overrides, the derived versions are deleted
+	result = syncStack("reset", "", nil)
+	require.True(t, result.Success)
+	require.True(t, slices.ContainsFunc(result.Objects, func(object *generated.ObjectResult) bool {
+		return object.Gvk.Kind == "Versions" && object.Action == generated.ObjectAction_ObjectDeleted
+	}))
+	_, err = client.Get(context.Background(), "versions", "stack1-versions")
+	require.True(t, apierrors.IsNotFound(err))
+}
+
+func TestRederiveVersions(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	require.NoError(t, client.Create(context.Background(), "versions", newTestObject("Versions", "default", nil, map[string]any{
+		"spec": map[string]any{"ledger": "v2.0.0", "payments": "v2.0.0", "wallets": "v2.0.0"},
+	})))
+	listener := NewMembershipListener(client, ClientInfo{}, newTestRESTMapper(), NewMembershipClientMock(), nil, nil, nil, nil)
+
+	ctx := logging.TestingContext()
+	listener.syncExistingStack(ctx, &generated.Stack{
+		ClusterName:      "stack1",
+		VersionOverrides: map[string]string{"ledger": "v2.0.1"},
+	})
+
+	// A release of the base is reflected in the derived versions, the
+	// overrides still applying
+	require.NoError(t, client.Patch(ctx, "versions", "default",
+		[]byte(`{"spec": {"ledger": "v2.1.0", "payments": "v2.1.0", "wallets": null}}`)))
+	listener.rederiveVersions(ctx, "default")
+
+	versions, err := client.Get(ctx, "versions", "stack1-versions")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ledger": "v2.0.1", "payments": "v2.1.0"}, extractVersionsSpec(versions))
+	require.Equal(t, "stack1", versions.GetLabels()["formance.com/stack"])
+
+	// Versions derived from other bases are left untouched
+	require.NoError(t, client.Patch(ctx, "versions", "stack1-versions", []byte(`{"spec": {"payments": "v2.0.0"}}`)))
+	listener.rederiveVersions(ctx, "other")
+	versions, err = client.Get(ctx, "versions", "stack1-versions")
+	require.NoError(t, err)
+	require.Equal(t, "v2.0.0", extractVersionsSpec(versions)["payments"])
+}
+
+func TestSyncSettings(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	syncStack := func(correlationID string, settings ...*generated.StackSetting) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName: "stack1",
+					Settings:    settings,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	settingsResults := func(result *generated.OrderResult) []*generated.ObjectResult {
+		return slices.DeleteFunc(slices.Clone(result.Objects), func(object *generated.ObjectResult) bool {
+			return object.Gvk.Kind != "Settings"
+		})
+	}
+
+	result := syncStack("create",
+		&generated.StackSetting{Key: "postgresql.*.uri", Value: "postgresql://localhost"},
+		&generated.StackSetting{Key: "broker.dsn", Value: "nats://localhost"},
+	)
+	require.True(t, result.Success)
+	require.Len(t, settingsResults(result), 2)
+
+	settings, err := client.Get(context.Background(), "settings", settingName("stack1", "postgresql.*.uri"))
+	require.NoError(t, err)
+	require.Equal(t, "stack1", settings.GetLabels()["formance.com/stack"])
+	require.Equal(t, "Stack", settings.GetOwnerReferences()[0].Kind)
+	value, _, _ := unstructured.NestedString(settings.Object, "spec", "value")
+	require.Equal(t, "postgresql://localhost", value)
+	stacks, _, _ := unstructured.NestedStringSlice(settings.Object, "spec", "stacks")
+	require.Equal(t, []string{"stack1"}, stacks)
+
+	// Settings no longer listed are pruned
+	result = syncStack("prune", &generated.StackSetting{Key: "broker.dsn", Value: "nats://localhost"})
+	require.True(t, result.Success)
+	objects := settingsResults(result)
+	require.Len(t, objects, 2)
+	require.Equal(t, generated.ObjectAction_ObjectUnchanged, objects[0].Action)
+	require.Equal(t, generated.ObjectAction_ObjectDeleted, objects[1].Action)
+	require.Equal(t, settingName("stack1", "postgresql.*.uri"), objects[1].Name)
+	_, err = client.Get(context.Background(), "settings", settingName("stack1", "postgresql.*.uri"))
+	require.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSyncAuthClientSecrets(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	kube := k8sfake.NewClientset()
+	secrets := kube.CoreV1()
+	membershipClient := startTestListener(t, client, nil, kube)
+
+	syncStack := func(correlationID string, authClients ...*generated.AuthClient) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName:   "stack1",
+					StaticClients: authClients,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	secretAction := func(result *generated.OrderResult) generated.ObjectAction {
+		for _, object := range result.Objects {
+			if object.Gvk.Kind == "Secret" {
+				return object.Action
+			}
+		}
+		t.Fatal("no secret in the order result")
+		return 0
+	}
+
+	result := syncStack("create", &generated.AuthClient{
+		Id:           "client1",
+		Name:         "Client 1",
+		RedirectUris: []string{"https://example.com/callback"},
+		Scopes:       []string{"openid", "ledger:read"},
+		Secret:       "s3cr3t",
+	})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectCreated, secretAction(result))
+
+	authClient, err := client.Get(context.Background(), "AuthClients", "stack1-client1")
+	require.NoError(t, err)
+	spec, _, _ := unstructured.NestedMap(authClient.Object, "spec")
+	require.Equal(t, "Client 1", spec["name"])
+	require.Equal(t, []any{"https://example.com/callback"}, spec["redirectUris"])
+	require.Equal(t, []any{"openid", "ledger:read"}, spec["scopes"])
+	require.Equal(t, map[string]any{"name": "stack1-client1", "key": authClientSecretKey}, spec["secretFromSecret"])
+	require.NotContains(t, spec, "secret")
+
+	secret, err := secrets.Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", string(secret.Data[authClientSecretKey]))
+	require.Equal(t, "AuthClient", secret.OwnerReferences[0].Kind)
+
+	result = syncStack("rotate", &generated.AuthClient{Id: "client1", Secret: "n3w"})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectUpdated, secretAction(result))
+	secret, err = secrets.Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "n3w", string(secret.Data[authClientSecretKey]))
+
+	// The secret is deleted once the client becomes public
+	result = syncStack("public", &generated.AuthClient{Id: "client1", Public: true})
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectDeleted, secretAction(result))
+	_, err = secrets.Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSyncAuthClientSecretsNewStack(t *testing.T) {
+	t.Parallel()
+
+	// Like the API server, secrets cannot be created in a missing namespace
+	kube := k8sfake.NewClientset()
+	kube.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if _, err := kube.Tracker().Get(namespacesGroupVersionResource, "", action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	listener := NewMembershipListener(newFakeK8SClient(), ClientInfo{}, newTestRESTMapper(), NewMembershipClientMock(), nil, nil, nil, kube)
+
+	result := &orderResult{}
+	listener.syncExistingStack(contextWithOrderResult(logging.TestingContext(), result), &generated.Stack{
+		ClusterName:   "stack1",
+		StaticClients: []*generated.AuthClient{{Id: "client1", Secret: "s3cr3t"}},
+	})
+
+	// The order does not fail while the operator creates the namespace
+	orderResult := result.message(&generated.Order{}).GetOrderResult()
+	require.True(t, orderResult.Success)
+	require.Len(t, orderResult.Warnings, 1)
+	_, err := kube.CoreV1().Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err))
+
+	// Other namespaces do not release the secret
+	listener.syncPendingSecrets(logging.TestingContext(), "stack2")
+	_, err = kube.CoreV1().Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err))
+
+	_, err = kube.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+		ObjectMeta: v1.ObjectMeta{Name: "stack1"},
+	}, v1.CreateOptions{})
+	require.NoError(t, err)
+	listener.syncPendingSecrets(logging.TestingContext(), "stack1")
+
+	secret, err := kube.CoreV1().Secrets("stack1").Get(context.Background(), "stack1-client1", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", string(secret.Data[authClientSecretKey]))
+	require.Empty(t, listener.pendingSecrets)
+}
+
+func TestStargateIdentity(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	syncStack := func(correlationID string, stack *generated.Stack) *generated.OrderResult {
+		stack.StargateConfig = &generated.StargateConfig{Enabled: true}
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: stack,
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	stargateSpec := func(name string) map[string]any {
+		stargate, err := client.Get(context.Background(), "Stargates", name)
+		require.NoError(t, err)
+		spec, _, _ := unstructured.NestedMap(stargate.Object, "spec")
+		return spec
+	}
+
+	result := syncStack("explicit", &generated.Stack{
+		ClusterName:    "stack1",
+		OrganizationId: "org-with-dashes",
+		StackId:        "stack-with-dashes",
+	})
+	require.True(t, result.Success)
+	require.Equal(t, "org-with-dashes", stargateSpec("stack1")["organizationID"])
+	require.Equal(t, "stack-with-dashes", stargateSpec("stack1")["stackID"])
+
+	// Older membership versions only send the cluster name
+	result = syncStack("parsed", &generated.Stack{ClusterName: "org1-stack2"})
+	require.True(t, result.Success)
+	require.Equal(t, "org1", stargateSpec("org1-stack2")["organizationID"])
+	require.Equal(t, "stack2", stargateSpec("org1-stack2")["stackID"])
+
+	result = syncStack("invalid", &generated.Stack{ClusterName: "nodash"})
+	require.False(t, result.Success)
+	require.True(t, slices.ContainsFunc(result.Objects, func(object *generated.ObjectResult) bool {
+		return object.Gvk.Kind == "Stargate" && object.Error != ""
+	}))
+}
+
+func TestSyncModuleSpec(t *testing.T) {
+	t.Parallel()
+
+	crd := v1apis.CustomResourceDefinition{}
+	crd.Spec.Group = formanceGroupVersion.Group
+	crd.Spec.Names.Kind = "Ledger"
+	crd.Spec.Versions = []v1apis.CustomResourceDefinitionVersion{{Name: formanceGroupVersion.Version}}
+	crd.Status.AcceptedNames = v1apis.CustomResourceDefinitionNames{Singular: "ledger", Plural: "ledgers"}
+
+	client := newFakeK8SClient()
+	membershipClient := startTestListener(t, client, nil, nil, crd)
+
+	syncStack := func(correlationID string, spec map[string]any) map[string]any {
+		moduleSpec, err := structpb.NewStruct(spec)
+		require.NoError(t, err)
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName: "stack1",
+					Modules:     []*generated.Module{{Name: "Ledger", Spec: moduleSpec}},
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		require.True(t, waitOrderResult(t, membershipClient, correlationID).Success)
+
+		ledger, err := client.Get(context.Background(), "ledgers", "stack1")
+		require.NoError(t, err)
+		return ledger.Object["spec"].(map[string]any)
+	}
+
+	spec := syncStack("create", map[string]any{
+		"replicas": 3,
+		"service": map[string]any{
+			"annotations": map[string]any{"a": "b"},
+		},
+	})
+	require.Equal(t, int64(3), spec["replicas"])
+	require.Contains(t, spec, "service")
+
+	// Keys no longer sent by membership are removed, the ones owned by the
+	// agent are kept
+	spec = syncStack("remove", map[string]any{
+		"service": map[string]any{},
+	})
+	require.NotContains(t, spec, "replicas")
+	require.Equal(t, map[string]any{}, spec["service"])
+	require.Equal(t, "stack1", spec["stack"])
+
+	spec = syncStack("empty", map[string]any{})
+	require.NotContains(t, spec, "service")
+	require.Equal(t, "stack1", spec["stack"])
+}
+
+func TestSyncGatewayHosts(t *testing.T) {
+	t.Parallel()
+
+	gatewayCRD := func(ingress map[string]v1apis.JSONSchemaProps) v1apis.CustomResourceDefinition {
+		crd := v1apis.CustomResourceDefinition{}
+		crd.Spec.Group = formanceGroupVersion.Group
+		crd.Spec.Names.Kind = "Gateway"
+		crd.Spec.Versions = []v1apis.CustomResourceDefinitionVersion{{
+			Name: formanceGroupVersion.Version,
+			Schema: &v1apis.CustomResourceValidation{
+				OpenAPIV3Schema: &v1apis.JSONSchemaProps{
+					Type: "object",
+					Properties: map[string]v1apis.JSONSchemaProps{
+						"spec": {
+							Type: "object",
+							Properties: map[string]v1apis.JSONSchemaProps{
+								"stack":   {Type: "string"},
+								"ingress": {Type: "object", Properties: ingress},
+							},
+						},
+					},
+				},
+			},
+		}}
+		crd.Status.AcceptedNames = v1apis.CustomResourceDefinitionNames{Singular: "gateway", Plural: "gateways"}
+		return crd
+	}
+	ingress := map[string]v1apis.JSONSchemaProps{
+		"host":   {Type: "string"},
+		"scheme": {Type: "string"},
+	}
+
+	for _, tc := range []struct {
+		name            string
+		additionalHosts bool
+	}{
+		{name: "additional hosts supported", additionalHosts: true},
+		{name: "additional hosts not supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			properties := maps.Clone(ingress)
+			if tc.additionalHosts {
+				properties["additionalHosts"] = v1apis.JSONSchemaProps{
+					Type:  "array",
+					Items: &v1apis.JSONSchemaPropsOrArray{Schema: &v1apis.JSONSchemaProps{Type: "string"}},
+				}
+			}
+			crd := gatewayCRD(properties)
+
+			client := newFakeK8SClient()
+			listener := NewMembershipListener(client, ClientInfo{
+				BaseUrl: &url.URL{Scheme: "https", Host: "example.com"},
+			}, newTestRESTMapper(crd), NewMembershipClientMock(), modules{crd}, nil, nil, nil)
+
+			stack := newTestObject("Stack", "stack1", nil, nil)
+			result := &orderResult{}
+			listener.syncModules(contextWithOrderResult(logging.TestingContext(), result), map[string]any{}, stack, &generated.Stack{
+				ClusterName:   "stack1",
+				CustomDomains: []string{"api.acme.com"},
+				Modules:       []*generated.Module{{Name: "Gateway"}},
+			})
+			orderResult := result.message(&generated.Order{}).GetOrderResult()
+			require.True(t, orderResult.Success)
+
+			gateway, err := client.Get(context.Background(), "gateways", "stack1")
+			require.NoError(t, err)
+			host, _, _ := unstructured.NestedString(gateway.Object, "spec", "ingress", "host")
+			require.Equal(t, "stack1.example.com", host)
+			additionalHosts, found, _ := unstructured.NestedStringSlice(gateway.Object, "spec", "ingress", "additionalHosts")
+			if tc.additionalHosts {
+				require.Equal(t, []string{"api.acme.com"}, additionalHosts)
+				require.Empty(t, orderResult.Warnings)
+			} else {
+				// The hosts which cannot be served are reported
+				require.False(t, found)
+				require.Len(t, orderResult.Warnings, 1)
+				require.Contains(t, orderResult.Warnings[0], "api.acme.com")
+			}
+		})
+	}
+}
+
+// TestSyncGatewayAdditionalHosts checks that the Gateway CRD of the operator
+// keeps the additional hosts written by the agent.
+func TestSyncGatewayAdditionalHosts(t *testing.T) {
+	test(t, func(ctx context.Context, tc *testConfig) {
+		t.Parallel()
+
+		moduleCRDs, _, err := RetrieveModuleList(ctx, tc.restConfig)
+		require.NoError(t, err)
+		idx := slices.IndexFunc(moduleCRDs, func(crd v1apis.CustomResourceDefinition) bool {
+			return crd.Spec.Names.Kind == "Gateway"
+		})
+		require.NotEqual(t, -1, idx)
+		require.True(t, specFieldSupported(moduleCRDs[idx], "ingress", "additionalHosts"))
+
+		listener := NewMembershipListener(NewDefaultK8SClient(tc.client), ClientInfo{
+			BaseUrl: &url.URL{Scheme: "https", Host: "example.com"},
+		}, tc.mapper, NewMembershipClientMock(), moduleCRDs[idx:idx+1], nil, nil, nil)
+
+		stackName := uuid.NewString()
+		stack := &unstructured.Unstructured{}
+		stack.SetName(stackName)
+		stack.SetUID(types.UID(uuid.NewString()))
+
+		result := &orderResult{}
+		listener.syncModules(contextWithOrderResult(ctx, result), map[string]any{}, stack, &generated.Stack{
+			ClusterName:   stackName,
+			CustomDomains: []string{"api.acme.com"},
+			Modules:       []*generated.Module{{Name: "Gateway"}},
+		})
+		require.True(t, result.message(&generated.Order{}).GetOrderResult().Success)
+
+		// Read from the API server, which prunes the fields unknown to the CRD
+		gateway := &unstructured.Unstructured{}
+		require.NoError(t, tc.client.Get().Resource("gateways").Name(stackName).Do(ctx).Into(gateway))
+		additionalHosts, _, _ := unstructured.NestedStringSlice(gateway.Object, "spec", "ingress", "additionalHosts")
+		require.Equal(t, []string{"api.acme.com"}, additionalHosts)
+	})
+}
+
+func TestSyncDisabledModules(t *testing.T) {
+	t.Parallel()
+
+	crd := v1apis.CustomResourceDefinition{}
+	crd.Spec.Group = formanceGroupVersion.Group
+	crd.Spec.Names.Kind = "Ledger"
+	crd.Spec.Versions = []v1apis.CustomResourceDefinitionVersion{{Name: formanceGroupVersion.Version}}
+	crd.Status.AcceptedNames = v1apis.CustomResourceDefinitionNames{Singular: "ledger", Plural: "ledgers"}
+
+	// The schema of payments has no disabled field
+	paymentsCRD := v1apis.CustomResourceDefinition{}
+	paymentsCRD.Spec.Group = formanceGroupVersion.Group
+	paymentsCRD.Spec.Names.Kind = "Payments"
+	paymentsCRD.Spec.Versions = []v1apis.CustomResourceDefinitionVersion{{
+		Name: formanceGroupVersion.Version,
+		Schema: &v1apis.CustomResourceValidation{
+			OpenAPIV3Schema: &v1apis.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]v1apis.JSONSchemaProps{
+					"spec": {
+						Type: "object",
+						Properties: map[string]v1apis.JSONSchemaProps{
+							"stack": {Type: "string"},
+						},
+					},
+				},
+			},
+		},
+	}}
+	paymentsCRD.Status.AcceptedNames = v1apis.CustomResourceDefinitionNames{Singular: "payments", Plural: "payments"}
+
+	client := newFakeK8SClient()
+	membershipClient := startTestListener(t, client, nil, nil, crd, paymentsCRD)
+
+	syncStack := func(correlationID string, modules ...*generated.Module) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName: "stack1",
+					Modules:     modules,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+	disabled := func() bool {
+		ledger, err := client.Get(context.Background(), "ledgers", "stack1")
+		require.NoError(t, err)
+		disabled, _, _ := unstructured.NestedBool(ledger.Object, "spec", "disabled")
+		return disabled
+	}
+
+	require.True(t, syncStack("enabled", &generated.Module{Name: "Ledger"}, &generated.Module{Name: "Payments"}).Success)
+	require.False(t, disabled())
+	payments, err := client.Get(context.Background(), "payments", "stack1")
+	require.NoError(t, err)
+	require.NotContains(t, payments.Object["spec"], "disabled")
+
+	// Disabled modules are kept
+	require.True(t, syncStack("disabled", &generated.Module{Name: "Ledger", Disabled: true}, &generated.Module{Name: "Payments"}).Success)
+	require.True(t, disabled())
+
+	// Modules which cannot be disabled are reported
+	result := syncStack("unsupported", &generated.Module{Name: "Ledger"}, &generated.Module{Name: "Payments", Disabled: true})
+	require.False(t, result.Success)
+	require.True(t, slices.ContainsFunc(result.Objects, func(object *generated.ObjectResult) bool {
+		return object.Gvk.Kind == "Payments" && object.Error == "module Payments does not support being disabled"
+	}))
+	_, err = client.Get(context.Background(), "payments", "stack1")
+	require.NoError(t, err)
+
+	require.True(t, syncStack("removed").Success)
+	_, err = client.Get(context.Background(), "ledgers", "stack1")
+	require.True(t, apierrors.IsNotFound(err))
+}
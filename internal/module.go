@@ -2,15 +2,17 @@ package internal
 
 import (
 	"context"
+	"path/filepath"
 	"sort"
 	"time"
 
 	"github.com/formancehq/go-libs/v2/collectionutils"
 	"github.com/formancehq/go-libs/v2/logging"
-	"github.com/formancehq/stack/components/agent/internal/grpcclient"
+	"github.com/formancehq/stack/components/agent/internal/generated"
 	"github.com/pkg/errors"
 	"go.uber.org/fx"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
 	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsv1client "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/typed/apiextensions/v1"
@@ -20,6 +22,7 @@ import (
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
@@ -87,6 +90,20 @@ func CreateVersionsInformer(factory dynamicinformer.DynamicSharedInformerFactory
 	return createInformer(factory, "versions", VersionsEventHandler(logger, client))
 }
 
+// CreateDerivedVersionsInformer derives again the Versions of the stacks with
+// version overrides when their base changes.
+func CreateDerivedVersionsInformer(factory dynamicinformer.DynamicSharedInformerFactory,
+	logger logging.Logger, listener *membershipListener) error {
+	ctx := logging.ContextWithLogger(context.Background(), logger.WithFields(map[string]any{
+		"component": "derived-versions",
+	}))
+	return createInformer(factory, "versions", DerivedVersionsEventHandler(func(base string) {
+		// Not run by the informer, which would be blocked while the
+		// derived Versions are patched
+		go listener.rederiveVersions(ctx, base)
+	}))
+}
+
 func CreateStacksInformer(factory dynamicinformer.DynamicSharedInformerFactory,
 	logger logging.Logger, client MembershipClient) error {
 	logger = logger.WithFields(map[string]any{
@@ -96,6 +113,94 @@ func CreateStacksInformer(factory dynamicinformer.DynamicSharedInformerFactory,
 	return createInformer(factory, "stacks", NewStackEventHandler(logger, client))
 }
 
+// CreateSettingsInformer only fills the cache used to list the Settings of
+// stacks, they are not reported to membership.
+func CreateSettingsInformer(factory dynamicinformer.DynamicSharedInformerFactory, logger logging.Logger) error {
+	logger.WithFields(map[string]any{
+		"component": "settings",
+	}).Info("Creating informer")
+	return createInformer(factory, "settings", cache.ResourceEventHandlerFuncs{})
+}
+
+// CreateIngressesInformer watches the ingresses deployed by the operator for
+// the gateways of the stacks, to report the readiness of their hosts.
+func CreateIngressesInformer(factory dynamicinformer.DynamicSharedInformerFactory,
+	logger logging.Logger, client MembershipClient) error {
+	logger = logger.WithFields(map[string]any{
+		"component": "ingresses",
+	})
+	logger.Info("Creating informer")
+
+	ingresses := factory.ForResource(ingressesGroupVersionResource)
+	stacks := factory.ForResource(schema.GroupVersionResource{
+		Group:    "formance.com",
+		Version:  "v1beta1",
+		Resource: "stacks",
+	})
+
+	_, err := ingresses.Informer().AddEventHandler(NewIngressEventHandler(logger, client, ingresses.Lister(), stacks.Lister()))
+	if err != nil {
+		return errors.Wrap(err, "unable to add event handler")
+	}
+	return nil
+}
+
+// CreateNamespacesInformer writes the AuthClient secrets of new stacks once
+// the operator created their namespace. The agent must be allowed to list and
+// watch namespaces.
+func CreateNamespacesInformer(factory dynamicinformer.DynamicSharedInformerFactory,
+	logger logging.Logger, listener *membershipListener) error {
+	logger = logger.WithFields(map[string]any{
+		"component": "namespaces",
+	})
+	logger.Info("Creating informer")
+
+	ctx := logging.ContextWithLogger(context.Background(), logger)
+	_, err := factory.ForResource(namespacesGroupVersionResource).Informer().
+		AddEventHandler(NamespaceEventHandler(func(namespace string) {
+			listener.syncPendingSecrets(ctx, namespace)
+		}))
+	if err != nil {
+		return errors.Wrap(err, "unable to add event handler")
+	}
+	return nil
+}
+
+// runStackExpirer deletes the stacks once they expire. It is woken up by the
+// events of the stacks informer, to reschedule its timer.
+func runStackExpirer(lc fx.Lifecycle, factory dynamicinformer.DynamicSharedInformerFactory,
+	client K8SClient, logger logging.Logger) error {
+	stacks := factory.ForResource(formanceGroupVersion.WithResource("stacks"))
+	expirer := newStackExpirer(logger.WithFields(map[string]any{
+		"component": "expirer",
+	}), client, stacks.Lister())
+
+	_, err := stacks.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			expirer.notify()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			expirer.notify()
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to add event handler")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go expirer.Run(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+	return nil
+}
+
 func CreateModulesInformers(factory dynamicinformer.DynamicSharedInformerFactory,
 	modules modules, logger logging.Logger, client MembershipClient) error {
 
@@ -194,26 +299,42 @@ func RetrieveModuleList(ctx context.Context, config *rest.Config) (modules, eeMo
 	return modules, eeModules, nil
 }
 
-func runMembershipClient(lc fx.Lifecycle, debug bool, membershipClient *membershipClient, logger logging.Logger, config *rest.Config) {
+func runMembershipClient(lc fx.Lifecycle, membershipClient *membershipClient, logger logging.Logger) {
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			client, err := membershipClient.connect(logging.ContextWithLogger(ctx, logger))
-			if err != nil {
-				return err
-			}
-			clientWithTrace := grpcclient.NewConnectionWithTrace(client, debug)
-
 			go func() {
-				if err := membershipClient.Start(logging.ContextWithLogger(ctx, logger), clientWithTrace); err != nil {
-					panic(err)
+				if err := membershipClient.Start(logging.ContextWithLogger(ctx, logger)); err != nil {
+					logger.Errorf("Membership client stopped: %s", err)
 				}
 			}()
 			return nil
 		},
-		OnStop: membershipClient.Stop,
 	})
 }
 
+func newOutbox(lc fx.Lifecycle, config ConnectionConfig) (*outbox, error) {
+	dir := ""
+	if config.StateDir != "" {
+		dir = filepath.Join(config.StateDir, "outbox")
+	}
+	outbox, err := NewOutbox(dir, config.OutboxMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	registration, err := outbox.registerMetrics()
+	if err != nil {
+		_ = outbox.Close()
+		return nil, errors.Wrap(err, "registering outbox metrics")
+	}
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			_ = registration.Unregister()
+			return outbox.Close()
+		},
+	})
+	return outbox, nil
+}
+
 func runMembershipListener(lc fx.Lifecycle, client *membershipListener, logger logging.Logger) {
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
@@ -223,11 +344,37 @@ func runMembershipListener(lc fx.Lifecycle, client *membershipListener, logger l
 	})
 }
 
+// runShutdown stops the agent in order: orders are no longer taken, the
+// running ones complete, then the outbox is flushed before closing the
+// stream, all within shutdownTimeout.
+func runShutdown(lc fx.Lifecycle, membershipClient *membershipClient, listener *membershipListener, shutdownTimeout time.Duration) {
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			if shutdownTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+				defer cancel()
+			}
+
+			membershipClient.stopOrders()
+			if err := listener.Stop(ctx); err != nil {
+				logging.FromContext(ctx).Errorf("Unable to wait for running orders: %s", err)
+			}
+			return membershipClient.Stop(ctx)
+		},
+	})
+}
+
+// SetDebugFn switches the log level of the agent between debug and info.
+type SetDebugFn func(debug bool)
+
 func NewModule(
 	debug bool,
-	serverAddress string,
+	setDebug SetDebugFn,
+	serverAddresses []string,
 	authenticator Authenticator,
 	clientInfo ClientInfo,
+	connectionConfig ConnectionConfig,
 	resyncPeriod time.Duration,
 	opts ...grpc.DialOption,
 ) fx.Option {
@@ -243,22 +390,56 @@ func NewModule(
 		}),
 		fx.Provide(RetrieveModuleList),
 		fx.Provide(CreateRestMapper),
-		fx.Provide(func(modules modules, eeModules eeModules) *membershipClient {
-			return NewMembershipClient(authenticator, clientInfo, serverAddress, modules, eeModules, opts...)
+		fx.Provide(func(lc fx.Lifecycle) (*outbox, error) {
+			return newOutbox(lc, connectionConfig)
+		}),
+		fx.Provide(NewInventory),
+		fx.Provide(func(logger logging.Logger) (*runtimeConfig, error) {
+			return loadRuntimeConfig(logger, connectionConfig.StateDir, &generated.AgentConfig{
+				Debug:             proto.Bool(debug),
+				WorkerConcurrency: proto.Uint32(defaultWorkerConcurrency),
+				SendRate:          proto.Float64(connectionConfig.SendRate),
+				SendBurst:         proto.Uint32(uint32(connectionConfig.SendBurst)),
+				Outdated:          proto.Bool(clientInfo.Outdated),
+			}, connectionConfig.ResetRuntimeConfig)
+		}),
+		fx.Provide(func(modules modules, eeModules eeModules, outbox *outbox, inventory Inventory) *membershipClient {
+			return NewMembershipClient(debug, authenticator, clientInfo, connectionConfig, serverAddresses, modules, eeModules, outbox, inventory, opts...)
 		}),
 		fx.Provide(func(membershipClient *membershipClient) MembershipClient {
 			return membershipClient
 		}),
+		fx.Provide(func(config *rest.Config) (kubernetes.Interface, error) {
+			return kubernetes.NewForConfig(config)
+		}),
 		fx.Provide(NewMembershipListener),
 		fx.Invoke(CreateVersionsInformer),
+		fx.Invoke(CreateDerivedVersionsInformer),
 		fx.Invoke(CreateStacksInformer),
+		fx.Invoke(CreateSettingsInformer),
+		fx.Invoke(CreateIngressesInformer),
+		fx.Invoke(CreateNamespacesInformer),
+		fx.Invoke(runStackExpirer),
 		fx.Invoke(func(factory dynamicinformer.DynamicSharedInformerFactory, modules modules, logger logging.Logger, client MembershipClient) error {
 			return CreateModulesInformers(factory, modules, logger, client)
 		}),
-		fx.Invoke(func(lc fx.Lifecycle, membershipClient *membershipClient, logger logging.Logger, config *rest.Config) {
-			runMembershipClient(lc, debug, membershipClient, logger, config)
+		// Informers must be started before the membership client, which waits
+		// for their caches to build the inventory snapshot.
+		fx.Invoke(func(config *runtimeConfig, membershipClient *membershipClient, listener *membershipListener) {
+			config.OnChange(func(config *generated.AgentConfig) {
+				if setDebug != nil {
+					setDebug(config.GetDebug())
+				}
+			})
+			config.OnChange(membershipClient.applyConfig)
+			config.OnChange(listener.applyConfig)
+			config.Apply()
 		}),
-		fx.Invoke(runMembershipListener),
 		fx.Invoke(runInformers),
+		fx.Invoke(runMembershipClient),
+		fx.Invoke(runMembershipListener),
+		fx.Invoke(func(lc fx.Lifecycle, membershipClient *membershipClient, listener *membershipListener) {
+			runShutdown(lc, membershipClient, listener, connectionConfig.ShutdownTimeout)
+		}),
 	)
 }
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// restartedAtAnnotation is the pod template annotation set by kubectl
+	// rollout restart.
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	defaultRestartTimeout = 5 * time.Minute
+	// maxRolloutTimeout bounds the time an order holds a worker waiting
+	// for objects to be rolled out.
+	maxRolloutTimeout   = 10 * time.Minute
+	rolloutPollInterval = 2 * time.Second
+)
+
+// rolloutContext bounds the wait for a rollout to the timeout of the order,
+// capped to maxRolloutTimeout, and cancels it when the listener stops so that
+// the shutdown is not delayed.
+func (c *membershipListener) rolloutContext(ctx context.Context, timeoutSeconds uint32, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if timeoutSeconds > 0 {
+		timeout = min(time.Duration(timeoutSeconds)*time.Second, maxRolloutTimeout)
+	}
+	ctx, stop := context.WithCancelCause(ctx)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errors.Errorf("not rolled out after %s", timeout))
+	go func() {
+		select {
+		case <-c.stop:
+			stop(errors.New("agent stopping"))
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		stop(nil)
+	}
+}
+
+// waitError replaces the error of a wait interrupted by its context with the
+// cause of the interruption.
+func waitError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// rolloutComplete tells whether all the replicas of the deployment run its
+// latest template, as kubectl rollout status does.
+func rolloutComplete(deployment *appsv1.Deployment, generation int64) (bool, error) {
+	if deployment.Status.ObservedGeneration < generation {
+		return false, nil
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, errors.New("rollout exceeded its progress deadline")
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.UpdatedReplicas >= replicas &&
+		deployment.Status.Replicas == deployment.Status.UpdatedReplicas &&
+		deployment.Status.AvailableReplicas >= deployment.Status.UpdatedReplicas, nil
+}
+
+func (c *membershipListener) waitRollout(ctx context.Context, namespace, name string, generation int64) error {
+	err := wait.PollUntilContextCancel(ctx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+		deployment, err := c.kube.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return rolloutComplete(deployment, generation)
+	})
+	return errors.Wrap(waitError(ctx, err), "waiting for rollout")
+}
+
+// restartModule restarts the deployments controlled by a module of a stack,
+// they are deployed in the namespace named after the stack.
+func (c *membershipListener) restartModule(ctx context.Context, order *generated.RestartModule) {
+	logger := logging.FromContext(ctx)
+
+	gvk := formanceGroupVersion.WithKind(order.Kind)
+	var resource string
+	for _, crd := range c.modules {
+		if strings.EqualFold(crd.Spec.Names.Kind, order.Kind) {
+			gvk = schema.GroupVersionKind{
+				Group:   crd.Spec.Group,
+				Version: crd.Spec.Versions[0].Name,
+				Kind:    crd.Spec.Names.Kind,
+			}
+			resource = crd.Status.AcceptedNames.Plural
+			break
+		}
+	}
+	if resource == "" {
+		err := errors.Errorf("unknown module %s", order.Kind)
+		logger.Errorf("Unable to restart module: %s", err)
+		recordObject(ctx, gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+	if c.kube == nil {
+		err := errors.New("kubernetes client not available")
+		logger.Errorf("Unable to restart module: %s", err)
+		recordObject(ctx, gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+
+	module, err := c.client.Get(ctx, resource, order.ClusterName)
+	if err != nil {
+		logger.Errorf("Unable to read module: %s", err)
+		recordObject(ctx, gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+
+	deployments := c.kube.AppsV1().Deployments(order.ClusterName)
+	list, err := deployments.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logger.Errorf("Unable to list deployments: %s", err)
+		recordObject(ctx, gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, errors.Wrap(err, "listing deployments"))
+		return
+	}
+
+	deploymentGVK := appsv1.SchemeGroupVersion.WithKind("Deployment")
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		restartedAtAnnotation, time.Now().Format(time.RFC3339)))
+
+	// Generation of each restarted deployment, reached once the rollout of
+	// the restart is observed
+	restarted := map[string]int64{}
+	controlled := 0
+	for _, deployment := range list.Items {
+		if !metav1.IsControlledBy(&deployment, module) {
+			continue
+		}
+		controlled++
+
+		logger.Infof("Restarting deployment %s", deployment.Name)
+		patched, err := deployments.Patch(ctx, deployment.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			logger.Errorf("Unable to restart deployment %s: %s", deployment.Name, err)
+			recordObject(ctx, deploymentGVK, deployment.Name, generated.ObjectAction_ObjectUnchanged, errors.Wrap(err, "patching deployment"))
+			continue
+		}
+		restarted[deployment.Name] = patched.Generation
+	}
+	if controlled == 0 {
+		err := errors.New("no deployment found for the module")
+		logger.Errorf("Unable to restart module: %s", err)
+		recordObject(ctx, gvk, order.ClusterName, generated.ObjectAction_ObjectUnchanged, err)
+		return
+	}
+
+	waitCtx, cancel := c.rolloutContext(ctx, order.TimeoutSeconds, defaultRestartTimeout)
+	defer cancel()
+
+	for name, generation := range restarted {
+		err := c.waitRollout(waitCtx, order.ClusterName, name, generation)
+		if err != nil {
+			logger.Errorf("Deployment %s not restarted: %s", name, err)
+		}
+		recordObject(ctx, deploymentGVK, name, generated.ObjectAction_ObjectUpdated, err)
+	}
+}
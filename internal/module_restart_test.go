@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRolloutContext(t *testing.T) {
+	t.Parallel()
+
+	listener := NewMembershipListener(newFakeK8SClient(), ClientInfo{}, nil, NewMembershipClientMock(), nil, nil, nil, nil)
+
+	// Timeouts sent by membership are capped
+	ctx, cancel := listener.rolloutContext(context.Background(), 24*3600, defaultRestartTimeout)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(maxRolloutTimeout), deadline, time.Second)
+
+	// The wait is interrupted when the listener stops
+	close(listener.stop)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the context to be cancelled")
+	}
+	require.EqualError(t, context.Cause(ctx), "agent stopping")
+}
+
+func TestRestartModule(t *testing.T) {
+	t.Parallel()
+
+	crd := v1.CustomResourceDefinition{}
+	crd.Spec.Group = formanceGroupVersion.Group
+	crd.Spec.Names.Kind = "Ledger"
+	crd.Spec.Versions = []v1.CustomResourceDefinitionVersion{{Name: formanceGroupVersion.Version}}
+	crd.Status.AcceptedNames = v1.CustomResourceDefinitionNames{Singular: "ledger", Plural: "ledgers"}
+
+	ledger := newTestObject("Ledger", "stack1", nil, nil)
+	ledger.SetUID("ledger-uid")
+	client := newFakeK8SClient()
+	require.NoError(t, client.Create(context.Background(), "ledgers", ledger))
+
+	newDeployment := func(name string, ready bool) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "stack1",
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: formanceGroupVersion.String(),
+					Kind:       "Ledger",
+					Name:       "stack1",
+					UID:        "ledger-uid",
+					Controller: proto.Bool(true),
+				}},
+			},
+			Spec: appsv1.DeploymentSpec{Replicas: proto.Int32(1)},
+		}
+		if ready {
+			deployment.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+		}
+		return deployment
+	}
+	kube := k8sfake.NewClientset(newDeployment("ledger", true))
+	membershipClient := startTestListener(t, client, nil, kube, crd)
+
+	restart := func(correlationID, kind string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_RestartModule{
+				RestartModule: &generated.RestartModule{
+					ClusterName:    "stack1",
+					Kind:           kind,
+					TimeoutSeconds: 1,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+
+	result := restart("restart", "ledger")
+	require.True(t, result.Success)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "Deployment", result.Objects[0].Gvk.Kind)
+	require.Equal(t, generated.ObjectAction_ObjectUpdated, result.Objects[0].Action)
+	deployment, err := kube.AppsV1().Deployments("stack1").Get(context.Background(), "ledger", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, deployment.Spec.Template.Annotations, restartedAtAnnotation)
+
+	result = restart("unknown", "Payments")
+	require.False(t, result.Success)
+
+	// The rollout of the worker never completes
+	_, err = kube.AppsV1().Deployments("stack1").Create(context.Background(), newDeployment("ledger-worker", false), metav1.CreateOptions{})
+	require.NoError(t, err)
+	result = restart("timeout", "Ledger")
+	require.False(t, result.Success)
+	require.True(t, slices.ContainsFunc(result.Objects, func(object *generated.ObjectResult) bool {
+		return object.Name == "ledger-worker" && object.Error != ""
+	}))
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sjson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// lastAppliedSpecAnnotation holds the spec sent by membership for a module
+// when it was last applied, so that the keys it no longer sends are removed.
+const lastAppliedSpecAnnotation = "formance.com/last-applied-spec"
+
+// lastAppliedSpec returns the spec sent by membership when the module was last
+// applied, nil if unknown.
+func lastAppliedSpec(module *unstructured.Unstructured) map[string]any {
+	value, ok := module.GetAnnotations()[lastAppliedSpecAnnotation]
+	if !ok {
+		return nil
+	}
+	previous := map[string]any{}
+	if err := json.Unmarshal([]byte(value), &previous); err != nil {
+		return nil
+	}
+	return previous
+}
+
+// withRemovedKeys sets to nil the keys of previous missing from spec, nested
+// ones included, so that the spec used as a merge patch removes them.
+func withRemovedKeys(spec, previous map[string]any) {
+	for key, previousValue := range previous {
+		value, ok := spec[key]
+		if !ok {
+			spec[key] = nil
+			continue
+		}
+		previousNested, ok := previousValue.(map[string]any)
+		if !ok {
+			continue
+		}
+		if nested, ok := value.(map[string]any); ok {
+			withRemovedKeys(nested, previousNested)
+		}
+	}
+}
+
+// moduleSpec merges the spec sent by membership for a module with the keys
+// owned by the agent, which take precedence. The keys of previous, the spec
+// last sent by membership, which are no longer sent are set to nil. It
+// returns the user keys which were overridden.
+func moduleSpec(spec *structpb.Struct, owned, previous map[string]any) (map[string]any, []string, error) {
+	merged := map[string]any{}
+	if spec != nil {
+		// Round trip through JSON so that numbers are decoded as the API
+		// server returns them, integers included
+		data, err := json.Marshal(spec.AsMap())
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "marshalling module spec")
+		}
+		if err := k8sjson.Unmarshal(data, &merged); err != nil {
+			return nil, nil, errors.Wrap(err, "unmarshalling module spec")
+		}
+	}
+
+	overridden := make([]string, 0)
+	for key, value := range owned {
+		if _, ok := merged[key]; ok {
+			overridden = append(overridden, key)
+		}
+		merged[key] = value
+	}
+	slices.Sort(overridden)
+	withRemovedKeys(merged, previous)
+
+	return merged, overridden, nil
+}
+
+// validateModuleSpec checks a spec against the OpenAPI schema of the served
+// version of the CRD. CRDs without schema accept any spec.
+func validateModuleSpec(crd v1.CustomResourceDefinition, spec map[string]any) error {
+	if len(crd.Spec.Versions) == 0 || crd.Spec.Versions[0].Schema == nil || crd.Spec.Versions[0].Schema.OpenAPIV3Schema == nil {
+		return nil
+	}
+	specSchema, ok := crd.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties["spec"]
+	if !ok {
+		return nil
+	}
+
+	internalSchema := &apiextensions.JSONSchemaProps{}
+	if err := v1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(&specSchema, internalSchema, nil); err != nil {
+		return errors.Wrap(err, "converting schema")
+	}
+	validator, _, err := validation.NewSchemaValidator(internalSchema)
+	if err != nil {
+		return errors.Wrap(err, "building schema validator")
+	}
+
+	if errs := validation.ValidateCustomResource(field.NewPath("spec"), spec, validator); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	return nil
+}
+
+// specFieldSupported tells whether the served version of the CRD keeps a
+// field of the spec, nested under path. Fields unknown to the schema are
+// pruned by the API server, unless the object holding them preserves them.
+// CRDs without schema keep any field.
+func specFieldSupported(crd v1.CustomResourceDefinition, path ...string) bool {
+	if len(crd.Spec.Versions) == 0 || crd.Spec.Versions[0].Schema == nil || crd.Spec.Versions[0].Schema.OpenAPIV3Schema == nil {
+		return true
+	}
+	schema, ok := crd.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties["spec"]
+	if !ok {
+		return false
+	}
+	for _, name := range path {
+		if schema.XPreserveUnknownFields != nil && *schema.XPreserveUnknownFields {
+			return true
+		}
+		if schema, ok = schema.Properties[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
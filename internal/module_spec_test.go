@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestModuleSpec(t *testing.T) {
+	t.Parallel()
+
+	spec, err := structpb.NewStruct(map[string]any{
+		"stack":    "other",
+		"replicas": 3,
+		"service": map[string]any{
+			"annotations": map[string]any{"a": "b"},
+		},
+	})
+	require.NoError(t, err)
+
+	merged, overridden, err := moduleSpec(spec, map[string]any{"stack": "stack1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"stack"}, overridden)
+	require.Equal(t, map[string]any{
+		"stack":    "stack1",
+		"replicas": int64(3),
+		"service": map[string]any{
+			"annotations": map[string]any{"a": "b"},
+		},
+	}, merged)
+
+	merged, overridden, err = moduleSpec(nil, map[string]any{"stack": "stack1"}, nil)
+	require.NoError(t, err)
+	require.Empty(t, overridden)
+	require.Equal(t, map[string]any{"stack": "stack1"}, merged)
+
+	// Keys previously sent are removed, nested ones included
+	spec, err = structpb.NewStruct(map[string]any{
+		"service": map[string]any{},
+	})
+	require.NoError(t, err)
+	merged, _, err = moduleSpec(spec, map[string]any{"stack": "stack1"}, map[string]any{
+		"replicas": 3,
+		"service": map[string]any{
+			"annotations": map[string]any{"a": "b"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{
+		"stack":    "stack1",
+		"replicas": nil,
+		"service": map[string]any{
+			"annotations": nil,
+		},
+	}, merged)
+}
+
+func TestValidateModuleSpec(t *testing.T) {
+	t.Parallel()
+
+	crd := v1.CustomResourceDefinition{}
+	crd.Spec.Versions = []v1.CustomResourceDefinitionVersion{{
+		Name: "v1beta1",
+		Schema: &v1.CustomResourceValidation{
+			OpenAPIV3Schema: &v1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]v1.JSONSchemaProps{
+					"spec": {
+						Type:     "object",
+						Required: []string{"stack"},
+						Properties: map[string]v1.JSONSchemaProps{
+							"stack":    {Type: "string"},
+							"replicas": {Type: "integer"},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	require.NoError(t, validateModuleSpec(crd, map[string]any{"stack": "stack1", "replicas": int64(3)}))
+	require.Error(t, validateModuleSpec(crd, map[string]any{"stack": "stack1", "replicas": "three"}))
+	require.Error(t, validateModuleSpec(crd, map[string]any{"replicas": int64(3)}))
+
+	// CRDs without schema accept any spec
+	require.NoError(t, validateModuleSpec(v1.CustomResourceDefinition{}, map[string]any{"replicas": "three"}))
+}
+
+func TestSpecFieldSupported(t *testing.T) {
+	t.Parallel()
+
+	crd := func(spec v1.JSONSchemaProps) v1.CustomResourceDefinition {
+		crd := v1.CustomResourceDefinition{}
+		crd.Spec.Versions = []v1.CustomResourceDefinitionVersion{{
+			Name: "v1beta1",
+			Schema: &v1.CustomResourceValidation{
+				OpenAPIV3Schema: &v1.JSONSchemaProps{
+					Type:       "object",
+					Properties: map[string]v1.JSONSchemaProps{"spec": spec},
+				},
+			},
+		}}
+		return crd
+	}
+	preserve := true
+
+	require.True(t, specFieldSupported(crd(v1.JSONSchemaProps{
+		Type:       "object",
+		Properties: map[string]v1.JSONSchemaProps{"disabled": {Type: "boolean"}},
+	}), "disabled"))
+	require.False(t, specFieldSupported(crd(v1.JSONSchemaProps{
+		Type:       "object",
+		Properties: map[string]v1.JSONSchemaProps{"stack": {Type: "string"}},
+	}), "disabled"))
+	require.True(t, specFieldSupported(crd(v1.JSONSchemaProps{
+		Type:                   "object",
+		XPreserveUnknownFields: &preserve,
+	}), "disabled"))
+	require.True(t, specFieldSupported(v1.CustomResourceDefinition{}, "disabled"))
+
+	// Nested fields are looked up in the schema of each parent
+	ingress := crd(v1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]v1.JSONSchemaProps{"ingress": {
+			Type:       "object",
+			Properties: map[string]v1.JSONSchemaProps{"host": {Type: "string"}},
+		}},
+	})
+	require.True(t, specFieldSupported(ingress, "ingress", "host"))
+	require.False(t, specFieldSupported(ingress, "ingress", "additionalHosts"))
+	require.True(t, specFieldSupported(crd(v1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]v1.JSONSchemaProps{"ingress": {
+			Type:                   "object",
+			XPreserveUnknownFields: &preserve,
+		}},
+	}), "ingress", "additionalHosts"))
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// orderResult collects the outcome of an order on every object it touched.
+type orderResult struct {
+	mu      sync.Mutex
+	objects []*generated.ObjectResult
+	failed  bool
+	// unsupported is set when the order type is unknown to the agent.
+	unsupported bool
+	// config is the effective configuration reported to configUpdate orders.
+	config *generated.AgentConfig
+	// warnings do not make the order fail.
+	warnings []string
+	// notExecuted is set when the agent stopped before starting the order.
+	notExecuted bool
+}
+
+func (r *orderResult) record(gvk schema.GroupVersionKind, name string, action generated.ObjectAction, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	object := &generated.ObjectResult{
+		Gvk: &generated.GroupVersionKind{
+			Group:   gvk.Group,
+			Version: gvk.Version,
+			Kind:    gvk.Kind,
+		},
+		Name:   name,
+		Action: action,
+	}
+	if err != nil {
+		object.Error = err.Error()
+		r.failed = true
+	}
+	r.objects = append(r.objects, object)
+}
+
+func (r *orderResult) warn(warning string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.warnings = append(r.warnings, warning)
+}
+
+func (r *orderResult) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failed = true
+}
+
+func (r *orderResult) message(order *generated.Order) *generated.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &generated.Message{
+		Message: &generated.Message_OrderResult{
+			OrderResult: &generated.OrderResult{
+				CorrelationId: order.CorrelationId,
+				Sequence:      order.Sequence,
+				Success:       !r.failed && !r.unsupported && !r.notExecuted,
+				Unsupported:   r.unsupported,
+				NotExecuted:   r.notExecuted,
+				Objects:       r.objects,
+				Config:        r.config,
+				Warnings:      r.warnings,
+			},
+		},
+	}
+}
+
+type orderResultKey struct{}
+
+func contextWithOrderResult(ctx context.Context, result *orderResult) context.Context {
+	return context.WithValue(ctx, orderResultKey{}, result)
+}
+
+// recordObject adds the outcome of an action on an object to the result of
+// the order being executed, if any.
+func recordObject(ctx context.Context, gvk schema.GroupVersionKind, name string, action generated.ObjectAction, err error) {
+	result, ok := ctx.Value(orderResultKey{}).(*orderResult)
+	if !ok {
+		return
+	}
+	result.record(gvk, name, action, err)
+}
+
+// recordFailure marks the order being executed as failed, for errors which
+// are not related to a specific object.
+func recordFailure(ctx context.Context) {
+	result, ok := ctx.Value(orderResultKey{}).(*orderResult)
+	if !ok {
+		return
+	}
+	result.fail()
+}
+
+// recordWarning reports an issue to membership without failing the order
+// being executed.
+func recordWarning(ctx context.Context, warning string) {
+	result, ok := ctx.Value(orderResultKey{}).(*orderResult)
+	if !ok {
+		return
+	}
+	result.warn(warning)
+}
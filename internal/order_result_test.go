@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/alitto/pond"
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestOrderResult(t *testing.T) {
+	t.Parallel()
+
+	stack := newTestObject("Stack", "stack", nil, nil)
+	client := newFakeK8SClient(stack)
+	client.errors["broken"] = errors.New("patch failed")
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_DisabledStack{
+			DisabledStack: &generated.DisabledStack{ClusterName: "stack"},
+		},
+		CorrelationId: "disable",
+	}
+	result := waitOrderResult(t, membershipClient, "disable")
+	require.True(t, result.Success)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "Stack", result.Objects[0].Gvk.Kind)
+	require.Equal(t, "stack", result.Objects[0].Name)
+	require.Equal(t, generated.ObjectAction_ObjectUpdated, result.Objects[0].Action)
+	require.Empty(t, result.Objects[0].Error)
+
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_EnabledStack{
+			EnabledStack: &generated.EnabledStack{ClusterName: "broken"},
+		},
+		CorrelationId: "enable",
+	}
+	result = waitOrderResult(t, membershipClient, "enable")
+	require.False(t, result.Success)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "patch failed", result.Objects[0].Error)
+
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_DeletedStack{
+			DeletedStack: &generated.DeletedStack{ClusterName: "stack"},
+		},
+		CorrelationId: "delete",
+	}
+	result = waitOrderResult(t, membershipClient, "delete")
+	require.True(t, result.Success)
+	require.Equal(t, generated.ObjectAction_ObjectDeleted, result.Objects[0].Action)
+
+	// Orders added to the protocol after this version of the agent are
+	// reported as unsupported
+	membershipClient.Orders() <- &generated.Order{CorrelationId: "unknown"}
+	result = waitOrderResult(t, membershipClient, "unknown")
+	require.False(t, result.Success)
+	require.True(t, result.Unsupported)
+}
+
+func TestOrderResultNotExecuted(t *testing.T) {
+	t.Parallel()
+
+	membershipClient := NewMembershipClientMock()
+	listener := NewMembershipListener(newFakeK8SClient(), ClientInfo{}, nil, membershipClient, nil, nil, nil, nil)
+	listener.wp = pond.New(1, 1)
+	// Keep the only worker busy, so that the order stays queued
+	release := make(chan struct{})
+	listener.wp.Submit(func() {
+		<-release
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listener.Start(logging.TestingContext())
+	}()
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_DisabledStack{
+			DisabledStack: &generated.DisabledStack{ClusterName: "stack"},
+		},
+		CorrelationId: "disable",
+		Sequence:      1,
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- listener.Stop(context.Background())
+	}()
+	<-listener.stop
+	close(release)
+	require.NoError(t, <-stopped)
+	<-done
+
+	result := waitOrderResult(t, membershipClient, "disable")
+	require.False(t, result.Success)
+	require.True(t, result.NotExecuted)
+	require.Equal(t, uint64(1), result.Sequence)
+	require.Empty(t, result.Objects)
+}
+
+func TestOrderResultMissingGateway(t *testing.T) {
+	t.Parallel()
+
+	crd := v1.CustomResourceDefinition{}
+	crd.Spec.Group = formanceGroupVersion.Group
+	crd.Spec.Names.Kind = "Gateway"
+	crd.Spec.Versions = []v1.CustomResourceDefinitionVersion{{Name: formanceGroupVersion.Version}}
+	crd.Status.AcceptedNames = v1.CustomResourceDefinitionNames{Singular: "gateway", Plural: "gateways"}
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{formanceGroupVersion})
+	mapper.AddSpecific(formanceGroupVersion.WithKind("Gateway"),
+		formanceGroupVersion.WithResource("gateways"), formanceGroupVersion.WithResource("gateway"), meta.RESTScopeRoot)
+
+	stack := newTestObject("Stack", "stack", nil, nil)
+	client := newFakeK8SClient(stack)
+	client.errors["stack"] = apierrors.NewNotFound(formanceGroupVersion.WithResource("gateways").GroupResource(), "stack")
+	listener := NewMembershipListener(client, ClientInfo{
+		BaseUrl: &url.URL{Scheme: "https", Host: "example.com"},
+	}, mapper, NewMembershipClientMock(), modules{crd}, nil, nil, nil)
+
+	// The agent ignores a gateway missing from the cluster, so does the
+	// result of the order
+	result := &orderResult{}
+	listener.syncModules(contextWithOrderResult(logging.TestingContext(), result), map[string]any{}, stack, &generated.Stack{
+		ClusterName: "stack",
+		Modules:     []*generated.Module{{Name: "Gateway"}},
+	})
+	orderResult := result.message(&generated.Order{}).GetOrderResult()
+	require.True(t, orderResult.Success)
+	require.Empty(t, orderResult.Objects)
+}
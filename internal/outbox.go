@@ -0,0 +1,723 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/proto"
+)
+
+// outboxSequenceBlock is the number of sequences reserved on disk at once, so
+// that a restart never reuses a sequence without syncing on every send.
+const outboxSequenceBlock = 1024
+
+var errOutboxFull = errors.New("outbox full")
+
+type outboxPriority int
+
+const (
+	outboxPriorityDeletion outboxPriority = iota
+	outboxPriorityStatus
+	outboxPriorityVersion
+
+	outboxPriorities
+)
+
+func (p outboxPriority) String() string {
+	switch p {
+	case outboxPriorityDeletion:
+		return "deletion"
+	case outboxPriorityStatus:
+		return "status"
+	default:
+		return "version"
+	}
+}
+
+// priorityOf ranks messages so that deletions are sent before status updates,
+// and status updates before version events.
+func priorityOf(message *generated.Message) outboxPriority {
+	switch message.Message.(type) {
+	case *generated.Message_StackDeleted, *generated.Message_ModuleDeleted:
+		return outboxPriorityDeletion
+	case *generated.Message_AddedVersion, *generated.Message_UpdatedVersion, *generated.Message_DeletedVersion:
+		return outboxPriorityVersion
+	default:
+		return outboxPriorityStatus
+	}
+}
+
+type outboxEntry struct {
+	id       uint64
+	key      string
+	priority outboxPriority
+	message  *generated.Message
+	// sequence is assigned when the entry is first taken to be sent, 0
+	// while the entry was never sent. It is kept when the entry is requeued
+	// so that membership can recognize a message sent again.
+	sequence uint64
+}
+
+// outbox stores the messages sent to membership until they are acknowledged.
+// Pending messages wait in one queue per priority. A message replaces any
+// pending message about the same object, so the outbox holds at most one
+// pending entry per object. When full, the oldest entry of the lowest
+// priority is dropped.
+// Taken entries are given a sequence number, increasing in the order they are
+// sent, and stay in flight until the server acknowledges them. Entries
+// requeued after a session ended, or replayed after a restart, are sent again
+// first, with their sequence.
+// When created with a directory, entries are persisted in a segment log and
+// replayed on the next start. Appended entries are synced to disk in the
+// background, so that pushing never waits for the disk: the ones appended
+// while a sync runs are synced together by the next one.
+type outbox struct {
+	mu       sync.Mutex
+	pending  [outboxPriorities][]outboxEntry
+	inflight []outboxEntry
+	maxSize  int
+	dropped  [outboxPriorities]uint64
+	nextID   uint64
+	sequence uint64
+	reserved uint64
+	ready    chan struct{}
+	log      *segmentLog
+	// segmentSize is the size above which the log is compacted
+	segmentSize int64
+	// syncMu serializes the syncs of the log, so that a sync returns only
+	// once every record written before it is on disk
+	syncMu sync.Mutex
+	// syncWake is signaled when appended entries need to be synced
+	syncWake chan struct{}
+	syncStop chan struct{}
+	syncDone chan struct{}
+	// syncErr is the error of the last failed sync, reported by the next
+	// push
+	syncErr error
+}
+
+// outboxKey identifies the object a message is about. Messages with an empty
+// key are never compacted.
+func outboxKey(message *generated.Message) string {
+	switch msg := message.Message.(type) {
+	case *generated.Message_StatusChanged:
+		return "stack/" + msg.StatusChanged.ClusterName
+	case *generated.Message_StackDeleted:
+		return "stack/" + msg.StackDeleted.ClusterName
+	case *generated.Message_ModuleStatusChanged:
+		return "module/" + msg.ModuleStatusChanged.GetVk().GetKind() + "/" + msg.ModuleStatusChanged.ClusterName
+	case *generated.Message_ModuleDeleted:
+		return "module/" + msg.ModuleDeleted.GetVk().GetKind() + "/" + msg.ModuleDeleted.ClusterName
+	case *generated.Message_AddedVersion:
+		return "versions/" + msg.AddedVersion.Name
+	case *generated.Message_UpdatedVersion:
+		return "versions/" + msg.UpdatedVersion.Name
+	case *generated.Message_DeletedVersion:
+		return "versions/" + msg.DeletedVersion.Name
+	case *generated.Message_GatewayHostsChanged:
+		return "gatewayHosts/" + msg.GatewayHostsChanged.ClusterName
+	case *generated.Message_Snapshot:
+		return "snapshot"
+	default:
+		return ""
+	}
+}
+
+// supersede returns the message to keep when next is queued while previous is
+// still pending. An update of versions membership has not been told about yet
+// must still be announced as an addition.
+func supersede(previous, next *generated.Message) *generated.Message {
+	added := previous.GetAddedVersion()
+	updated := next.GetUpdatedVersion()
+	if added == nil || updated == nil {
+		return next
+	}
+	return &generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{
+				Name:       updated.Name,
+				Versions:   updated.Versions,
+				Deprecated: updated.Deprecated,
+			},
+		},
+		Metadata: next.Metadata,
+	}
+}
+
+func (o *outbox) size() int {
+	size := 0
+	for _, entries := range o.pending {
+		size += len(entries)
+	}
+	return size
+}
+
+// findPending returns the position of the pending entry about the given key.
+func (o *outbox) findPending(key string) (outboxPriority, int, bool) {
+	if key == "" {
+		return 0, 0, false
+	}
+	for priority, entries := range o.pending {
+		for i, entry := range entries {
+			if entry.key == key {
+				return outboxPriority(priority), i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// findID returns the position of the pending entry with the given id.
+func (o *outbox) findID(id uint64) (outboxPriority, int, bool) {
+	for priority, entries := range o.pending {
+		for i, entry := range entries {
+			if entry.id == id {
+				return outboxPriority(priority), i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (o *outbox) removePending(priority outboxPriority, i int) outboxEntry {
+	entry := o.pending[priority][i]
+	o.pending[priority] = append(o.pending[priority][:i], o.pending[priority][i+1:]...)
+	return entry
+}
+
+// insert queues a message, returning the entry dropped to make room for it
+// if any.
+func (o *outbox) insert(id uint64, message *generated.Message) (*outboxEntry, error) {
+	if id >= o.nextID {
+		o.nextID = id + 1
+	}
+
+	entry := outboxEntry{
+		id:       id,
+		key:      outboxKey(message),
+		priority: priorityOf(message),
+		message:  message,
+	}
+	if priority, i, ok := o.findPending(entry.key); ok {
+		entry.message = supersede(o.removePending(priority, i).message, message)
+		o.pending[entry.priority] = append(o.pending[entry.priority], entry)
+		return nil, nil
+	}
+
+	var dropped *outboxEntry
+	if o.maxSize > 0 && o.size() >= o.maxSize {
+		victim := outboxPriorities - 1
+		for victim > entry.priority && len(o.pending[victim]) == 0 {
+			victim--
+		}
+		if len(o.pending[victim]) == 0 {
+			o.dropped[entry.priority]++
+			return nil, errOutboxFull
+		}
+		evicted := o.removePending(victim, 0)
+		o.dropped[victim]++
+		dropped = &evicted
+	}
+	o.pending[entry.priority] = append(o.pending[entry.priority], entry)
+	return dropped, nil
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) remove(id uint64) error {
+	if o.log == nil {
+		return nil
+	}
+	return o.log.append(outboxRecord{
+		kind: outboxRecordRemove,
+		id:   id,
+	})
+}
+
+// Push queues a message and wakes up the sender. It never blocks on the
+// stream, and fails with errOutboxFull when the message is dropped.
+func (o *outbox) Push(message *generated.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.syncErr != nil {
+		err := o.syncErr
+		o.syncErr = nil
+		return errors.Wrap(err, "syncing outbox")
+	}
+
+	if !o.admits(message) {
+		o.dropped[priorityOf(message)]++
+		return errOutboxFull
+	}
+
+	// The message is queued only once persisted, an id is never reused in
+	// case the failed record was partially written
+	id := o.nextID
+	o.nextID++
+	if o.log != nil {
+		if err := o.log.append(outboxRecord{
+			kind:    outboxRecordAppend,
+			id:      id,
+			message: message,
+		}); err != nil {
+			return errors.Wrap(err, "persisting message")
+		}
+	}
+	dropped, err := o.insert(id, message)
+	if err != nil {
+		return err
+	}
+	if o.log != nil {
+		if dropped != nil {
+			// Losing the removal only means the dropped message is sent
+			// after a restart
+			_ = o.remove(dropped.id)
+		}
+		// Syncing and compacting the log are left to the background
+		select {
+		case o.syncWake <- struct{}{}:
+		default:
+		}
+	}
+
+	o.signal()
+	return nil
+}
+
+// admits tells whether insert would keep a message: either it replaces a
+// pending message, or there is room for it, or an entry of lower or equal
+// priority can be dropped to make room.
+func (o *outbox) admits(message *generated.Message) bool {
+	if _, _, ok := o.findPending(outboxKey(message)); ok {
+		return true
+	}
+	if o.maxSize <= 0 || o.size() < o.maxSize {
+		return true
+	}
+	for victim := outboxPriorities - 1; victim >= priorityOf(message); victim-- {
+		if len(o.pending[victim]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// syncLog syncs the records written since the previous sync. The lock is
+// released while syncing, so that pushes and acks do not wait for the disk.
+func (o *outbox) syncLog() error {
+	o.syncMu.Lock()
+	defer o.syncMu.Unlock()
+
+	o.mu.Lock()
+	if !o.log.dirty {
+		o.mu.Unlock()
+		return nil
+	}
+	file := o.log.file
+	o.log.dirty = false
+	o.mu.Unlock()
+
+	// The log may be closed meanwhile when the agent stops
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		o.mu.Lock()
+		o.log.dirty = true
+		o.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// compact rewrites the log once it outgrows its segment size. The lock is only
+// held to list the entries and to install the new segment: the records
+// appended meanwhile are copied to it when installing.
+func (o *outbox) compact() error {
+	o.syncMu.Lock()
+	defer o.syncMu.Unlock()
+
+	o.mu.Lock()
+	if o.log.size <= o.segmentSize {
+		o.mu.Unlock()
+		return nil
+	}
+	reserved, entries := o.reserved, o.entries()
+	o.log.tail = make([]outboxRecord, 0)
+	log := *o.log
+	o.mu.Unlock()
+
+	next, err := log.nextSegment(reserved, entries)
+	o.mu.Lock()
+	if err == nil {
+		err = o.log.install(next)
+	}
+	o.log.tail = nil
+	file := o.log.file
+	o.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "compacting outbox")
+	}
+
+	return errors.Wrap(removeSegments(next.dir, next.segment, file), "compacting outbox")
+}
+
+func (o *outbox) runSync() {
+	defer close(o.syncDone)
+	for {
+		select {
+		case <-o.syncStop:
+			return
+		case <-o.syncWake:
+			err := o.syncLog()
+			if err == nil {
+				err = o.compact()
+			}
+			if err != nil {
+				o.mu.Lock()
+				o.syncErr = err
+				o.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (o *outbox) nextSequence() (uint64, error) {
+	if o.sequence == o.reserved {
+		reserved := o.reserved + outboxSequenceBlock
+		if o.log != nil {
+			if err := o.log.append(outboxRecord{
+				kind: outboxRecordSequence,
+				id:   reserved,
+			}); err != nil {
+				return 0, errors.Wrap(err, "reserving sequences")
+			}
+		}
+		o.reserved = reserved
+	}
+	o.sequence++
+	return o.sequence, nil
+}
+
+// take moves the first pending entry of a priority in flight, giving it a
+// sequence if it was never sent, and returns a copy of it. The sequence is
+// written to the log, so that the entry keeps it after a restart.
+func (o *outbox) take(priority outboxPriority) (outboxEntry, error) {
+	if o.pending[priority][0].sequence == 0 {
+		sequence, err := o.nextSequence()
+		if err != nil {
+			return outboxEntry{}, err
+		}
+		if o.log != nil {
+			if err := o.log.append(outboxRecord{
+				kind:     outboxRecordTaken,
+				id:       o.pending[priority][0].id,
+				sequence: sequence,
+			}); err != nil {
+				return outboxEntry{}, errors.Wrap(err, "persisting sequence")
+			}
+		}
+		o.pending[priority][0].sequence = sequence
+	}
+	entry := o.removePending(priority, 0)
+	o.inflight = append(o.inflight, entry)
+
+	entry.message = proto.Clone(entry.message).(*generated.Message)
+	entry.message.Sequence = entry.sequence
+	return entry, nil
+}
+
+// Take moves up to max pending entries in flight and returns copies of them
+// with their sequence set on the message. Requeued entries are taken first in
+// sequence order, so that sequences keep increasing on the stream, then the
+// other ones highest priority first. The sender is free to modify the
+// returned messages. The sequences given to the entries are synced to disk
+// before returning.
+func (o *outbox) Take(max int) ([]outboxEntry, error) {
+	o.mu.Lock()
+	entries, err := o.takeEntries(max)
+	o.mu.Unlock()
+	if err != nil {
+		return entries, err
+	}
+
+	if o.log != nil {
+		if err := o.syncLog(); err != nil {
+			return entries, errors.Wrap(err, "syncing outbox")
+		}
+	}
+	return entries, nil
+}
+
+func (o *outbox) takeEntries(max int) ([]outboxEntry, error) {
+	entries := make([]outboxEntry, 0, max)
+	for len(entries) < max {
+		// Requeued entries are in front of their queue
+		next := outboxPriority(-1)
+		for priority, pending := range o.pending {
+			if len(pending) == 0 || pending[0].sequence == 0 {
+				continue
+			}
+			if next < 0 || pending[0].sequence < o.pending[next][0].sequence {
+				next = outboxPriority(priority)
+			}
+		}
+		if next < 0 {
+			break
+		}
+		entry, err := o.take(next)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	for priority := range o.pending {
+		for len(o.pending[priority]) > 0 && len(entries) < max {
+			entry, err := o.take(outboxPriority(priority))
+			if err != nil {
+				return entries, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// InFlight counts the entries sent but not acknowledged yet.
+func (o *outbox) InFlight() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.inflight)
+}
+
+// Ack removes every entry in flight up to the given sequence once membership
+// has received them, and wakes up the sender if more entries are pending.
+func (o *outbox) Ack(sequence uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	acked := 0
+	for ; acked < len(o.inflight) && o.inflight[acked].sequence <= sequence; acked++ {
+		if err := o.remove(o.inflight[acked].id); err != nil {
+			o.inflight = o.inflight[acked:]
+			return err
+		}
+	}
+	o.inflight = o.inflight[acked:]
+	if o.size() > 0 {
+		o.signal()
+	}
+	return nil
+}
+
+// Requeue puts the entries left in flight by a previous session back in
+// front of their queue with their sequence, unless a newer message about the
+// same object is pending, and wakes up the sender.
+func (o *outbox) Requeue() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := len(o.inflight) - 1; i >= 0; i-- {
+		entry := o.inflight[i]
+		if priority, j, ok := o.findPending(entry.key); ok {
+			pending := &o.pending[priority][j]
+			pending.message = supersede(entry.message, pending.message)
+			if err := o.remove(entry.id); err != nil {
+				o.inflight = o.inflight[:i+1]
+				return err
+			}
+			continue
+		}
+		o.pending[entry.priority] = append([]outboxEntry{entry}, o.pending[entry.priority]...)
+	}
+	o.inflight = nil
+	if o.size() > 0 {
+		o.signal()
+	}
+	return nil
+}
+
+// Ready is signaled when entries are waiting to be sent.
+func (o *outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Wake signals Ready if entries are pending.
+func (o *outbox) Wake() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.size() > 0 {
+		o.signal()
+	}
+}
+
+// Len counts the pending entries.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.size()
+}
+
+// Depth counts the pending entries of each priority.
+func (o *outbox) Depth() [outboxPriorities]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var depth [outboxPriorities]int
+	for priority, entries := range o.pending {
+		depth[priority] = len(entries)
+	}
+	return depth
+}
+
+// Dropped counts the messages of each priority dropped because the outbox
+// was full.
+func (o *outbox) Dropped() [outboxPriorities]uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.dropped
+}
+
+// entries lists the entries in flight and pending in id order, which
+// replaying them in preserves the queues.
+func (o *outbox) entries() []outboxEntry {
+	entries := append([]outboxEntry{}, o.inflight...)
+	for _, pending := range o.pending {
+		entries = append(entries, pending...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+	return entries
+}
+
+// registerMetrics reports the depth of the outbox and the number of dropped
+// messages, by priority.
+func (o *outbox) registerMetrics() (metric.Registration, error) {
+	depth, err := meter.Int64ObservableGauge("agent.outbox.depth",
+		metric.WithDescription("Number of messages waiting to be sent to membership"))
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := meter.Int64ObservableCounter("agent.outbox.dropped",
+		metric.WithDescription("Number of messages dropped because the outbox was full"))
+	if err != nil {
+		return nil, err
+	}
+
+	return meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		depths := o.Depth()
+		drops := o.Dropped()
+		for priority := outboxPriority(0); priority < outboxPriorities; priority++ {
+			attributes := metric.WithAttributes(attribute.String("priority", priority.String()))
+			observer.ObserveInt64(depth, int64(depths[priority]), attributes)
+			observer.ObserveInt64(dropped, int64(drops[priority]), attributes)
+		}
+		return nil
+	}, depth, dropped)
+}
+
+func (o *outbox) Close() error {
+	if o.log == nil {
+		return nil
+	}
+	close(o.syncStop)
+	<-o.syncDone
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.log.dirty {
+		if err := o.log.file.Sync(); err != nil {
+			_ = o.log.close()
+			return err
+		}
+	}
+	return o.log.close()
+}
+
+// NewOutbox creates an outbox persisted in dir, holding at most maxSize
+// pending entries. An empty dir keeps the messages in memory only, and a
+// zero maxSize does not bound the outbox.
+func NewOutbox(dir string, maxSize int) (*outbox, error) {
+	o := &outbox{
+		nextID:      1,
+		ready:       make(chan struct{}, 1),
+		segmentSize: outboxMaxSegmentSize,
+	}
+	if dir == "" {
+		o.maxSize = maxSize
+		return o, nil
+	}
+
+	log, records, err := openSegmentLog(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening outbox")
+	}
+	for _, record := range records {
+		switch record.kind {
+		case outboxRecordAppend:
+			// A compaction interrupted before removing the previous
+			// segments leaves entries written twice
+			if _, _, ok := o.findID(record.id); ok {
+				continue
+			}
+			// The outbox is not bounded yet, entries dropped when it was
+			// full are removed by a following record
+			_, _ = o.insert(record.id, record.message)
+		case outboxRecordRemove:
+			if priority, i, ok := o.findID(record.id); ok {
+				o.removePending(priority, i)
+			}
+		case outboxRecordSequence:
+			if record.id > o.reserved {
+				o.reserved = record.id
+			}
+		case outboxRecordTaken:
+			if priority, i, ok := o.findID(record.id); ok {
+				o.pending[priority][i].sequence = record.sequence
+			}
+		}
+	}
+	// Entries sent by the previous run go first, as if they were requeued
+	for _, entries := range o.pending {
+		sort.SliceStable(entries, func(i, j int) bool {
+			if entries[j].sequence == 0 {
+				return entries[i].sequence != 0
+			}
+			return entries[i].sequence != 0 && entries[i].sequence < entries[j].sequence
+		})
+	}
+	// Sequences of the previous run may have been used up to the reserved
+	// bound, the next ones start after it
+	o.sequence = o.reserved
+	o.maxSize = maxSize
+
+	if err := log.rewrite(o.reserved, o.entries()); err != nil {
+		_ = log.close()
+		return nil, errors.Wrap(err, "compacting outbox")
+	}
+	o.log = log
+	o.syncWake = make(chan struct{}, 1)
+	o.syncStop = make(chan struct{})
+	o.syncDone = make(chan struct{})
+	go o.runSync()
+	if o.size() > 0 {
+		o.signal()
+	}
+
+	return o, nil
+}
@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	outboxRecordAppend   byte = 1
+	outboxRecordRemove   byte = 2
+	outboxRecordSequence byte = 3
+	outboxRecordTaken    byte = 4
+
+	outboxMaxSegmentSize = 4 << 20
+	outboxSegmentSuffix  = ".log"
+
+	// length + crc32
+	outboxRecordHeaderSize = 8
+	// kind + id
+	outboxRecordPrefixSize = 9
+	outboxSequenceSize     = 8
+)
+
+type outboxRecord struct {
+	kind    byte
+	id      uint64
+	message *generated.Message
+	// sequence given to the entry when it was first taken, only set on
+	// taken records
+	sequence uint64
+}
+
+// segmentLog is an append-only log of outbox records split in numbered
+// segment files. Records are framed with their length and a CRC so that a
+// record torn by a crash is detected and ignored when reading.
+type segmentLog struct {
+	dir     string
+	file    *os.File
+	segment uint64
+	size    int64
+	// dirty is set while appended messages are not synced to disk
+	dirty bool
+	// tail holds the records appended while the next segment is written,
+	// nil when the log is not being compacted
+	tail []outboxRecord
+}
+
+func segmentName(segment uint64) string {
+	return fmt.Sprintf("%020d%s", segment, outboxSegmentSuffix)
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), outboxSegmentSuffix) {
+			continue
+		}
+		var segment uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(file.Name(), outboxSegmentSuffix), "%d", &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+func readSegment(path string) ([]outboxRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	reader := bufio.NewReader(f)
+	records := make([]outboxRecord, 0)
+	header := make([]byte, outboxRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// EOF or a torn header, the segment ends here
+			return records, nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return records, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) ||
+			len(payload) < outboxRecordPrefixSize {
+			return records, nil
+		}
+
+		record := outboxRecord{
+			kind: payload[0],
+			id:   binary.BigEndian.Uint64(payload[1:outboxRecordPrefixSize]),
+		}
+		switch record.kind {
+		case outboxRecordAppend:
+			record.message = &generated.Message{}
+			if err := proto.Unmarshal(payload[outboxRecordPrefixSize:], record.message); err != nil {
+				return nil, errors.Wrapf(err, "decoding record %d of %s", record.id, path)
+			}
+		case outboxRecordTaken:
+			if len(payload) < outboxRecordPrefixSize+outboxSequenceSize {
+				return nil, errors.Errorf("decoding record %d of %s: missing sequence", record.id, path)
+			}
+			record.sequence = binary.BigEndian.Uint64(payload[outboxRecordPrefixSize:])
+		}
+		records = append(records, record)
+	}
+}
+
+func encodeRecord(record outboxRecord) ([]byte, error) {
+	payload := make([]byte, outboxRecordPrefixSize)
+	payload[0] = record.kind
+	binary.BigEndian.PutUint64(payload[1:], record.id)
+	if record.message != nil {
+		data, err := proto.Marshal(record.message)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+	if record.kind == outboxRecordTaken {
+		payload = binary.BigEndian.AppendUint64(payload, record.sequence)
+	}
+
+	data := make([]byte, outboxRecordHeaderSize, outboxRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+	return append(data, payload...), nil
+}
+
+func (l *segmentLog) write(record outboxRecord) error {
+	data, err := encodeRecord(record)
+	if err != nil {
+		return errors.Wrap(err, "encoding record")
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// append writes a record to the active segment. Reserved sequences are synced
+// to disk before returning. Appended and taken messages are synced later, in
+// groups, by the outbox. Removals are not synced: losing one only means the
+// message is sent again after a restart.
+func (l *segmentLog) append(record outboxRecord) error {
+	if err := l.write(record); err != nil {
+		return err
+	}
+	if l.tail != nil {
+		l.tail = append(l.tail, record)
+	}
+	switch record.kind {
+	case outboxRecordAppend, outboxRecordTaken:
+		l.dirty = true
+	case outboxRecordSequence:
+		l.dirty = false
+		return l.file.Sync()
+	}
+	return nil
+}
+
+// syncDir makes the creation and renaming of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// nextSegment writes a new segment holding only the reserved sequences and
+// the remaining entries, with the sequence of the ones already sent, to a
+// temporary file. It does not modify the log, the new segment is made active
+// by install.
+func (l *segmentLog) nextSegment(reserved uint64, entries []outboxEntry) (*segmentLog, error) {
+	segment := l.segment + 1
+	file, err := os.OpenFile(l.tmpPath(segment), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &segmentLog{
+		dir:     l.dir,
+		file:    file,
+		segment: segment,
+	}
+	records := []outboxRecord{{
+		kind: outboxRecordSequence,
+		id:   reserved,
+	}}
+	for _, entry := range entries {
+		records = append(records, outboxRecord{
+			kind:    outboxRecordAppend,
+			id:      entry.id,
+			message: entry.message,
+		})
+		if entry.sequence != 0 {
+			records = append(records, outboxRecord{
+				kind:     outboxRecordTaken,
+				id:       entry.id,
+				sequence: entry.sequence,
+			})
+		}
+	}
+	for _, record := range records {
+		if err := next.write(record); err != nil {
+			next.discard()
+			return nil, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		next.discard()
+		return nil, err
+	}
+	return next, nil
+}
+
+func (l *segmentLog) tmpPath(segment uint64) string {
+	return filepath.Join(l.dir, segmentName(segment)+".tmp")
+}
+
+// discard removes a segment which was never installed.
+func (l *segmentLog) discard() {
+	_ = l.file.Close()
+	_ = os.Remove(l.tmpPath(l.segment))
+}
+
+// install makes next the active segment, after copying to it the records
+// appended since the log started keeping its tail. The previous segments are
+// kept until removed by removeSegments, once the new one is synced.
+func (l *segmentLog) install(next *segmentLog) error {
+	for _, record := range l.tail {
+		if err := next.write(record); err != nil {
+			next.discard()
+			return err
+		}
+	}
+	if err := os.Rename(l.tmpPath(next.segment), filepath.Join(l.dir, segmentName(next.segment))); err != nil {
+		next.discard()
+		return err
+	}
+
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	*l = *next
+	l.dirty = true
+	return nil
+}
+
+// removeSegments syncs the active segment then removes the previous ones.
+// It does not modify the log, so it can run while records are appended.
+func removeSegments(dir string, segment uint64, file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s < segment {
+			if err := os.Remove(filepath.Join(dir, segmentName(s))); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(dir)
+}
+
+// rewrite replaces the segments of the log with a single one holding the
+// given entries.
+func (l *segmentLog) rewrite(reserved uint64, entries []outboxEntry) error {
+	next, err := l.nextSegment(reserved, entries)
+	if err != nil {
+		return err
+	}
+	if err := l.install(next); err != nil {
+		return err
+	}
+	if err := removeSegments(l.dir, l.segment, l.file); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+func (l *segmentLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// openSegmentLog reads every record stored in dir, oldest first. The caller
+// is expected to rewrite the log before appending to it.
+func openSegmentLog(dir string) (*segmentLog, []outboxRecord, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]outboxRecord, 0)
+	for _, segment := range segments {
+		segmentRecords, err := readSegment(filepath.Join(dir, segmentName(segment)))
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, segmentRecords...)
+	}
+
+	log := &segmentLog{
+		dir: dir,
+	}
+	if len(segments) > 0 {
+		log.segment = segments[len(segments)-1]
+	}
+	return log, records, nil
+}
@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+)
+
+func newStatusChanged(stackName string, status generated.StackStatus) *generated.Message {
+	return &generated.Message{
+		Message: &generated.Message_StatusChanged{
+			StatusChanged: &generated.StatusChanged{
+				ClusterName: stackName,
+				Status:      status,
+			},
+		},
+	}
+}
+
+func drainOutbox(t *testing.T, o *outbox) []*generated.Message {
+	t.Helper()
+	messages := make([]*generated.Message, 0)
+	for {
+		entries, err := o.Take(1)
+		require.NoError(t, err)
+		if len(entries) == 0 {
+			return messages
+		}
+		messages = append(messages, entries[0].message)
+		require.NoError(t, o.Ack(entries[0].sequence))
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox("", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Progressing)))
+	require.NoError(t, o.Push(newStatusChanged("stack2", generated.StackStatus_Progressing)))
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{Name: "v1"},
+		},
+	}))
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_UpdatedVersion{
+			UpdatedVersion: &generated.UpdatedVersion{Name: "v1", Deprecated: true},
+		},
+	}))
+
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 3)
+	require.Equal(t, "stack2", messages[0].GetStatusChanged().ClusterName)
+	require.Equal(t, "stack1", messages[1].GetStatusChanged().ClusterName)
+	require.Equal(t, generated.StackStatus_Ready, messages[1].GetStatusChanged().Status)
+	require.NotNil(t, messages[2].GetAddedVersion())
+	require.True(t, messages[2].GetAddedVersion().Deprecated)
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.NoError(t, o.Push(newStatusChanged("stack2", generated.StackStatus_Ready)))
+	require.NoError(t, o.Push(newStatusChanged("stack3", generated.StackStatus_Ready)))
+
+	entries, err := o.Take(2)
+	require.NoError(t, err)
+	require.NoError(t, o.Ack(entries[0].sequence))
+	require.NoError(t, o.Close())
+
+	o, err = NewOutbox(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push(newStatusChanged("stack4", generated.StackStatus_Ready)))
+
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 3)
+	require.Equal(t, "stack2", messages[0].GetStatusChanged().ClusterName)
+	require.Equal(t, "stack3", messages[1].GetStatusChanged().ClusterName)
+	require.Equal(t, "stack4", messages[2].GetStatusChanged().ClusterName)
+	// The message sent by the previous run keeps its sequence, the other
+	// ones never reuse a sequence reserved by the previous run
+	require.Equal(t, entries[1].sequence, messages[0].Sequence)
+	require.Greater(t, messages[1].Sequence, uint64(outboxSequenceBlock))
+	require.NoError(t, o.Close())
+
+	o, err = NewOutbox(dir, 0)
+	require.NoError(t, err)
+	require.Zero(t, o.Len())
+	require.NoError(t, o.Close())
+}
+
+func TestOutboxSyncInBackground(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, o.Close())
+	}()
+
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return !o.log.dirty
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestOutboxCompactionInBackground(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0)
+	require.NoError(t, err)
+	o.mu.Lock()
+	o.segmentSize = 1024
+	o.mu.Unlock()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, o.Push(newStatusChanged(fmt.Sprintf("stack%d", i%10), generated.StackStatus_Ready)))
+	}
+	require.Eventually(t, func() bool {
+		segments, err := listSegments(dir)
+		require.NoError(t, err)
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return len(segments) == 1 && o.log.size <= o.segmentSize
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, o.Close())
+
+	o, err = NewOutbox(dir, 0)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, o.Close())
+	}()
+	require.Len(t, drainOutbox(t, o), 10)
+}
+
+func TestOutboxPushFailure(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	// A message which could not be persisted is not queued
+	require.Error(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.Zero(t, o.Len())
+}
+
+func TestOutboxTornRecord(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.NoError(t, o.Push(newStatusChanged("stack2", generated.StackStatus_Ready)))
+	require.NoError(t, o.Close())
+
+	segments, err := listSegments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	path := filepath.Join(dir, segmentName(segments[0]))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	o, err = NewOutbox(dir, 0)
+	require.NoError(t, err)
+
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 1)
+	require.Equal(t, "stack1", messages[0].GetStatusChanged().ClusterName)
+	require.NoError(t, o.Close())
+}
+
+func TestOutboxPriorities(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox("", 3)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{Name: "v1"},
+		},
+	}))
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_StackDeleted{
+			StackDeleted: &generated.DeletedStack{ClusterName: "stack2"},
+		},
+	}))
+
+	// The outbox is full, the version event is dropped first
+	require.NoError(t, o.Push(newStatusChanged("stack3", generated.StackStatus_Ready)))
+	require.Equal(t, [outboxPriorities]uint64{0, 0, 1}, o.Dropped())
+	require.Equal(t, [outboxPriorities]int{1, 2, 0}, o.Depth())
+
+	// No lower priority message is left to drop
+	require.ErrorIs(t, o.Push(&generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{Name: "v2"},
+		},
+	}), errOutboxFull)
+
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 3)
+	require.Equal(t, "stack2", messages[0].GetStackDeleted().ClusterName)
+	require.Equal(t, "stack1", messages[1].GetStatusChanged().ClusterName)
+	require.Equal(t, "stack3", messages[2].GetStatusChanged().ClusterName)
+}
+
+func TestOutboxRequeue(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox("", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Progressing)))
+	require.NoError(t, o.Push(newStatusChanged("stack2", generated.StackStatus_Progressing)))
+	entries, err := o.Take(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, o.InFlight())
+
+	// stack1 changed while its previous status was in flight
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	require.NoError(t, o.Requeue())
+	require.Zero(t, o.InFlight())
+
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 2)
+	require.Equal(t, "stack2", messages[0].GetStatusChanged().ClusterName)
+	require.Equal(t, entries[1].sequence, messages[0].Sequence)
+	require.Equal(t, "stack1", messages[1].GetStatusChanged().ClusterName)
+	require.Equal(t, generated.StackStatus_Ready, messages[1].GetStatusChanged().Status)
+}
+
+func TestOutboxRequeueKeepsSequenceOrder(t *testing.T) {
+	t.Parallel()
+
+	o, err := NewOutbox("", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{Name: "v1"},
+		},
+	}))
+	entries, err := o.Take(1)
+	require.NoError(t, err)
+	require.NoError(t, o.Requeue())
+
+	// A deletion queued after the requeue has a higher priority, but must
+	// not overtake the message already sent with a lower sequence
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_StackDeleted{
+			StackDeleted: &generated.DeletedStack{ClusterName: "stack1"},
+		},
+	}))
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 2)
+	require.Equal(t, entries[0].sequence, messages[0].Sequence)
+	require.NotNil(t, messages[0].GetAddedVersion())
+	require.Greater(t, messages[1].Sequence, messages[0].Sequence)
+}
+
+func TestOutboxReopenKeepsSequence(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_AddedVersion{
+			AddedVersion: &generated.AddedVersion{Name: "v1"},
+		},
+	}))
+	require.NoError(t, o.Push(newStatusChanged("stack1", generated.StackStatus_Ready)))
+	entries, err := o.Take(2)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	o, err = NewOutbox(dir, 0)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, o.Close())
+	}()
+	require.NoError(t, o.Push(&generated.Message{
+		Message: &generated.Message_StackDeleted{
+			StackDeleted: &generated.DeletedStack{ClusterName: "stack2"},
+		},
+	}))
+
+	// Messages sent before the restart go first, in their sequence order
+	messages := drainOutbox(t, o)
+	require.Len(t, messages, 3)
+	require.Equal(t, "stack1", messages[0].GetStatusChanged().ClusterName)
+	require.Equal(t, entries[0].sequence, messages[0].Sequence)
+	require.NotNil(t, messages[1].GetAddedVersion())
+	require.Equal(t, entries[1].sequence, messages[1].Sequence)
+	require.NotNil(t, messages[2].GetStackDeleted())
+	require.Greater(t, messages[2].Sequence, messages[1].Sequence)
+}
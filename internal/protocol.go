@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"slices"
+
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// protocolVersion is the version of agent.proto implemented by the agent,
+// sent in the connection metadata. Servers replying without a version are
+// considered as implementing version 0, which has no optional features.
+const protocolVersion = 1
+
+const (
+	capabilityEE         = "EE"
+	capabilityModuleList = "MODULE_LIST"
+
+	// Optional features, enabled on a session only when both the agent and
+	// the server advertise them.
+	capabilityAck          = "ACK"
+	capabilityMessageBatch = "MESSAGE_BATCH"
+)
+
+var (
+	// supportedOrders and supportedMessages list the types of orders and
+	// messages known to the agent, as named in agent.proto.
+	supportedOrders   = oneofNames((&generated.Order{}).ProtoReflect().Descriptor())
+	supportedMessages = oneofNames((&generated.Message{}).ProtoReflect().Descriptor())
+)
+
+func oneofNames(descriptor protoreflect.MessageDescriptor) []string {
+	fields := descriptor.Oneofs().ByName("message").Fields()
+	names := make([]string, 0, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		names = append(names, string(fields.Get(i).Name()))
+	}
+	return names
+}
+
+// negotiate returns the optional features advertised by both sides.
+func negotiate(agent, server []string) []string {
+	features := make([]string, 0, len(agent))
+	for _, capability := range agent {
+		if slices.Contains(server, capability) {
+			features = append(features, capability)
+		}
+	}
+	return features
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	runtimeConfigFile = "config.json"
+
+	defaultWorkerConcurrency = 5
+)
+
+// runtimeConfig holds the settings updated by membership with configUpdate
+// orders. They override the ones given on the command line, and are
+// persisted in the state dir so that they survive a restart, until reset.
+type runtimeConfig struct {
+	mu        sync.Mutex
+	path      string
+	initial   *generated.AgentConfig
+	overrides *generated.AgentConfig
+	appliers  []func(config *generated.AgentConfig)
+}
+
+// Effective returns the configuration currently applied.
+func (c *runtimeConfig) Effective() *generated.AgentConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.effective()
+}
+
+func (c *runtimeConfig) effective() *generated.AgentConfig {
+	config := proto.Clone(c.initial).(*generated.AgentConfig)
+	proto.Merge(config, c.overrides)
+	return config
+}
+
+// OnChange registers a function called with the effective configuration on
+// Apply and on each update.
+func (c *runtimeConfig) OnChange(fn func(config *generated.AgentConfig)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.appliers = append(c.appliers, fn)
+}
+
+// Apply applies the effective configuration, it is called once everything
+// is registered so that the persisted overrides are in effect at startup.
+func (c *runtimeConfig) Apply() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apply()
+}
+
+func (c *runtimeConfig) apply() {
+	config := c.effective()
+	for _, fn := range c.appliers {
+		fn(config)
+	}
+}
+
+// Update merges the set fields of update into the overrides, persists them
+// and applies the resulting configuration.
+func (c *runtimeConfig) Update(update *generated.AgentConfig) (*generated.AgentConfig, error) {
+	if err := validateAgentConfig(update); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	overrides := proto.Clone(c.overrides).(*generated.AgentConfig)
+	proto.Merge(overrides, update)
+	if err := c.persist(overrides); err != nil {
+		return nil, err
+	}
+	c.overrides = overrides
+	c.apply()
+
+	return c.effective(), nil
+}
+
+func (c *runtimeConfig) persist(overrides *generated.AgentConfig) error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := protojson.Marshal(overrides)
+	if err != nil {
+		return errors.Wrap(err, "marshalling config")
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return errors.Wrap(err, "writing config")
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return errors.Wrap(err, "renaming config")
+	}
+	return errors.Wrap(syncDir(filepath.Dir(c.path)), "syncing state dir")
+}
+
+// writeFileSync writes a file and syncs it, so that renaming it afterwards
+// never exposes an empty file after a crash.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Reset drops the persisted overrides, the initial configuration is in
+// effect again.
+func (c *runtimeConfig) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path != "" {
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrap(err, "removing config")
+		}
+		if err := syncDir(filepath.Dir(c.path)); err != nil {
+			return errors.Wrap(err, "syncing state dir")
+		}
+	}
+	c.overrides = &generated.AgentConfig{}
+	c.apply()
+	return nil
+}
+
+// Shadowed describes the overrides which differ from the initial
+// configuration, given on the command line.
+func (c *runtimeConfig) Shadowed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	initial := c.initial.ProtoReflect()
+	shadowed := make([]string, 0)
+	c.overrides.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if initial.Has(field) && initial.Get(field).Equal(value) {
+			return true
+		}
+		shadowed = append(shadowed, fmt.Sprintf("%s=%v (command line: %v)", field.JSONName(), value, initial.Get(field)))
+		return true
+	})
+	// Fields are ranged in an undefined order
+	slices.Sort(shadowed)
+	return shadowed
+}
+
+func validateAgentConfig(config *generated.AgentConfig) error {
+	if config.WorkerConcurrency != nil && config.GetWorkerConcurrency() == 0 {
+		return errors.New("worker concurrency must be positive")
+	}
+	if config.SendRate != nil && config.GetSendRate() < 0 {
+		return errors.New("send rate must not be negative")
+	}
+	return nil
+}
+
+// newRuntimeConfig loads the overrides persisted in stateDir, if any, on top
+// of the initial configuration.
+func newRuntimeConfig(stateDir string, initial *generated.AgentConfig) (*runtimeConfig, error) {
+	config := &runtimeConfig{
+		initial:   initial,
+		overrides: &generated.AgentConfig{},
+	}
+	if stateDir == "" {
+		return config, nil
+	}
+
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating state dir")
+	}
+	config.path = filepath.Join(stateDir, runtimeConfigFile)
+
+	data, err := os.ReadFile(config.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return config, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "reading config")
+	}
+	if err := protojson.Unmarshal(data, config.overrides); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling config")
+	}
+	if err := validateAgentConfig(config.overrides); err != nil {
+		return nil, errors.Wrap(err, "validating persisted config")
+	}
+
+	return config, nil
+}
+
+// loadRuntimeConfig loads the runtime configuration and reports the
+// persisted overrides taking precedence over the command line. With reset,
+// the overrides are dropped instead.
+func loadRuntimeConfig(logger logging.Logger, stateDir string, initial *generated.AgentConfig, reset bool) (*runtimeConfig, error) {
+	config, err := newRuntimeConfig(stateDir, initial)
+	if err != nil {
+		return nil, err
+	}
+
+	shadowed := config.Shadowed()
+	switch {
+	case reset:
+		if len(shadowed) > 0 {
+			logger.Infof("Dropping configuration updated by the server: %s", strings.Join(shadowed, ", "))
+		}
+		if err := config.Reset(); err != nil {
+			return nil, err
+		}
+	case len(shadowed) > 0:
+		logger.Infof("Configuration updated by the server takes precedence over the command line: %s", strings.Join(shadowed, ", "))
+	}
+	return config, nil
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRuntimeConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	initial := &generated.AgentConfig{
+		Debug:             proto.Bool(false),
+		WorkerConcurrency: proto.Uint32(defaultWorkerConcurrency),
+		SendRate:          proto.Float64(100),
+		SendBurst:         proto.Uint32(100),
+		Outdated:          proto.Bool(false),
+	}
+
+	config, err := newRuntimeConfig(dir, initial)
+	require.NoError(t, err)
+
+	var applied *generated.AgentConfig
+	config.OnChange(func(config *generated.AgentConfig) {
+		applied = config
+	})
+	config.Apply()
+	require.True(t, proto.Equal(initial, applied))
+
+	effective, err := config.Update(&generated.AgentConfig{
+		Debug:    proto.Bool(true),
+		SendRate: proto.Float64(10),
+	})
+	require.NoError(t, err)
+	require.True(t, effective.GetDebug())
+	require.Equal(t, float64(10), effective.GetSendRate())
+	require.Equal(t, uint32(100), effective.GetSendBurst())
+	require.True(t, proto.Equal(effective, applied))
+
+	_, err = config.Update(&generated.AgentConfig{SendRate: proto.Float64(-1)})
+	require.Error(t, err)
+	require.Equal(t, float64(10), config.Effective().GetSendRate())
+
+	// Overrides are persisted and take precedence over the initial
+	// configuration on restart
+	config, err = newRuntimeConfig(dir, initial)
+	require.NoError(t, err)
+	require.True(t, config.Effective().GetDebug())
+	require.Equal(t, float64(10), config.Effective().GetSendRate())
+	require.Equal(t, uint32(defaultWorkerConcurrency), config.Effective().GetWorkerConcurrency())
+	require.Equal(t, []string{"debug=true (command line: false)", "sendRate=10 (command line: 100)"}, config.Shadowed())
+
+	// Overrides equal to the command line do not shadow it
+	initial.SendRate = proto.Float64(10)
+	config, err = loadRuntimeConfig(logging.Testing(), dir, initial, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"debug=true (command line: false)"}, config.Shadowed())
+
+	// Resetting drops the persisted overrides
+	config, err = loadRuntimeConfig(logging.Testing(), dir, initial, true)
+	require.NoError(t, err)
+	require.Empty(t, config.Shadowed())
+	require.True(t, proto.Equal(initial, config.Effective()))
+	config, err = newRuntimeConfig(dir, initial)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(initial, config.Effective()))
+}
+
+func TestConfigUpdateOrder(t *testing.T) {
+	t.Parallel()
+
+	config, err := newRuntimeConfig("", &generated.AgentConfig{
+		Debug:             proto.Bool(false),
+		WorkerConcurrency: proto.Uint32(defaultWorkerConcurrency),
+	})
+	require.NoError(t, err)
+	membershipClient := startTestListener(t, newFakeK8SClient(), config, nil)
+
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_ConfigUpdate{
+			ConfigUpdate: &generated.AgentConfig{WorkerConcurrency: proto.Uint32(2)},
+		},
+		CorrelationId: "update",
+	}
+	result := waitOrderResult(t, membershipClient, "update")
+	require.True(t, result.Success)
+	require.Equal(t, uint32(2), result.Config.GetWorkerConcurrency())
+	require.False(t, result.Config.GetDebug())
+
+	// Rejected updates report the configuration left in effect
+	membershipClient.Orders() <- &generated.Order{
+		Message: &generated.Order_ConfigUpdate{
+			ConfigUpdate: &generated.AgentConfig{
+				Debug:             proto.Bool(true),
+				WorkerConcurrency: proto.Uint32(0),
+			},
+		},
+		CorrelationId: "invalid",
+	}
+	result = waitOrderResult(t, membershipClient, "invalid")
+	require.False(t, result.Success)
+	require.Equal(t, uint32(2), result.Config.GetWorkerConcurrency())
+	require.False(t, result.Config.GetDebug())
+}
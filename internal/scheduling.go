@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// Keys of the Settings holding the scheduling constraints of a stack, their
+// values are JSON encoded. They address the fields of the pod template of
+// every deployment of the stack, and must match the keys read by the
+// operator: a key it does not know is ignored without error, so a mismatch
+// leaves the stack unconstrained while the agent reports it as scheduled.
+const (
+	nodeSelectorSettingKey = "deployments.*.spec.template.spec.nodeSelector"
+	tolerationsSettingKey  = "deployments.*.spec.template.spec.tolerations"
+	affinitySettingKey     = "deployments.*.spec.template.spec.affinity"
+)
+
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// nodeSelectorTerm is a term of a required node affinity. Only the name of
+// nodes can be matched by fields.
+type nodeSelectorTerm struct {
+	labels labels.Selector
+	fields labels.Selector
+}
+
+func (t nodeSelectorTerm) matches(node *corev1.Node) bool {
+	return t.labels.Matches(labels.Set(node.Labels)) &&
+		t.fields.Matches(labels.Set{"metadata.name": node.Name})
+}
+
+func newNodeSelectorSelector(requirements []corev1.NodeSelectorRequirement) (labels.Selector, error) {
+	selector := labels.NewSelector()
+	for _, requirement := range requirements {
+		operator, ok := nodeSelectorOperators[requirement.Operator]
+		if !ok {
+			return nil, errors.Errorf("unknown operator %q", requirement.Operator)
+		}
+		r, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*r)
+	}
+	return selector, nil
+}
+
+// stackScheduling holds the constraints on the nodes the deployments of a
+// stack are scheduled on.
+type stackScheduling struct {
+	nodeSelector map[string]string
+	tolerations  []corev1.Toleration
+	affinity     *corev1.Affinity
+	// required are the terms of the required node affinity, a node must
+	// match one of them
+	required []nodeSelectorTerm
+}
+
+// newStackScheduling validates the scheduling constraints sent by membership.
+func newStackScheduling(stack *generated.Stack) (*stackScheduling, error) {
+	scheduling := &stackScheduling{
+		nodeSelector: stack.NodeSelector,
+	}
+	if _, err := labels.ValidatedSelectorFromSet(stack.NodeSelector); err != nil {
+		return nil, errors.Wrap(err, "validating node selector")
+	}
+
+	for _, t := range stack.Tolerations {
+		toleration := corev1.Toleration{
+			Key:               t.Key,
+			Operator:          corev1.TolerationOperator(t.Operator),
+			Value:             t.Value,
+			Effect:            corev1.TaintEffect(t.Effect),
+			TolerationSeconds: t.TolerationSeconds,
+		}
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				return nil, errors.Errorf("toleration of key %q with operator Exists must not have a value", toleration.Key)
+			}
+		default:
+			return nil, errors.Errorf("toleration of key %q has unknown operator %q", toleration.Key, toleration.Operator)
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, errors.Errorf("toleration of key %q has unknown effect %q", toleration.Key, toleration.Effect)
+		}
+		scheduling.tolerations = append(scheduling.tolerations, toleration)
+	}
+
+	if stack.Affinity != nil {
+		data, err := json.Marshal(stack.Affinity.AsMap())
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling affinity")
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		scheduling.affinity = &corev1.Affinity{}
+		if err := decoder.Decode(scheduling.affinity); err != nil {
+			return nil, errors.Wrap(err, "decoding affinity")
+		}
+
+		if nodeAffinity := scheduling.affinity.NodeAffinity; nodeAffinity != nil && nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+			for _, term := range nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+				// Like the scheduler, empty terms match no node
+				if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+					scheduling.required = append(scheduling.required, nodeSelectorTerm{
+						labels: labels.Nothing(),
+						fields: labels.Nothing(),
+					})
+					continue
+				}
+				labelsSelector, err := newNodeSelectorSelector(term.MatchExpressions)
+				if err != nil {
+					return nil, errors.Wrap(err, "validating node affinity")
+				}
+				fieldsSelector, err := newNodeSelectorSelector(term.MatchFields)
+				if err != nil {
+					return nil, errors.Wrap(err, "validating node affinity")
+				}
+				scheduling.required = append(scheduling.required, nodeSelectorTerm{
+					labels: labelsSelector,
+					fields: fieldsSelector,
+				})
+			}
+			if len(scheduling.required) == 0 {
+				return nil, errors.New("required node affinity has no term")
+			}
+		}
+	}
+
+	return scheduling, nil
+}
+
+// constrained tells whether the constraints restrict the nodes the stack can
+// be scheduled on.
+func (s *stackScheduling) constrained() bool {
+	return len(s.nodeSelector) > 0 || len(s.required) > 0
+}
+
+// settings returns the Settings applying the constraints.
+func (s *stackScheduling) settings() ([]*generated.StackSetting, error) {
+	values := map[string]any{}
+	if len(s.nodeSelector) > 0 {
+		values[nodeSelectorSettingKey] = s.nodeSelector
+	}
+	if len(s.tolerations) > 0 {
+		values[tolerationsSettingKey] = s.tolerations
+	}
+	if s.affinity != nil {
+		values[affinitySettingKey] = s.affinity
+	}
+
+	ret := make([]*generated.StackSetting, 0, len(values))
+	for _, key := range []string{nodeSelectorSettingKey, tolerationsSettingKey, affinitySettingKey} {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshalling %s", key)
+		}
+		ret = append(ret, &generated.StackSetting{
+			Key:   key,
+			Value: string(data),
+		})
+	}
+	return ret, nil
+}
+
+// schedulable tells whether the deployments of the stack can be scheduled on
+// the node. Only the required constraints are taken into account.
+func (s *stackScheduling) schedulable(ctx context.Context, node *corev1.Node) bool {
+	logger := logr.New(&logrSink{logger: logging.FromContext(ctx)})
+
+	if !labels.SelectorFromSet(s.nodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		if !slices.ContainsFunc(s.tolerations, func(toleration corev1.Toleration) bool {
+			return toleration.ToleratesTaint(logger, &taint, false)
+		}) {
+			return false
+		}
+	}
+
+	if len(s.required) > 0 {
+		return slices.ContainsFunc(s.required, func(term nodeSelectorTerm) bool {
+			return term.matches(node)
+		})
+	}
+	return true
+}
+
+// withSchedulingSettings adds the scheduling settings to the ones of the
+// stack, replacing settings with the same key.
+func withSchedulingSettings(settings, scheduling []*generated.StackSetting) []*generated.StackSetting {
+	ret := slices.DeleteFunc(slices.Clone(settings), func(setting *generated.StackSetting) bool {
+		return slices.ContainsFunc(scheduling, func(s *generated.StackSetting) bool {
+			return s.Key == setting.Key
+		})
+	})
+	return append(ret, scheduling...)
+}
+
+// logrSink writes the logs of the Kubernetes helpers, which take a logr
+// logger, to the logger of the agent.
+type logrSink struct {
+	logger logging.Logger
+}
+
+func (s *logrSink) Init(logr.RuntimeInfo) {}
+
+func (s *logrSink) Enabled(int) bool {
+	return true
+}
+
+func (s *logrSink) Info(level int, msg string, keysAndValues ...any) {
+	if level > 0 {
+		s.withValues(keysAndValues).Debug(msg)
+		return
+	}
+	s.withValues(keysAndValues).Info(msg)
+}
+
+func (s *logrSink) Error(err error, msg string, keysAndValues ...any) {
+	s.withValues(keysAndValues).Errorf("%s: %s", msg, err)
+}
+
+func (s *logrSink) WithValues(keysAndValues ...any) logr.LogSink {
+	return &logrSink{logger: s.withValues(keysAndValues)}
+}
+
+func (s *logrSink) WithName(name string) logr.LogSink {
+	return &logrSink{logger: s.logger.WithField("logger", name)}
+}
+
+func (s *logrSink) withValues(keysAndValues []any) logging.Logger {
+	fields := make(map[string]any, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			continue
+		}
+		fields[key] = keysAndValues[i+1]
+	}
+	if len(fields) == 0 {
+		return s.logger
+	}
+	return s.logger.WithFields(fields)
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStackScheduling(t *testing.T) {
+	t.Parallel()
+
+	affinity, err := structpb.NewStruct(map[string]any{
+		"nodeAffinity": map[string]any{
+			"requiredDuringSchedulingIgnoredDuringExecution": map[string]any{
+				"nodeSelectorTerms": []any{
+					map[string]any{
+						"matchExpressions": []any{
+							map[string]any{"key": "zone", "operator": "In", "values": []any{"a", "b"}},
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	scheduling, err := newStackScheduling(&generated.Stack{
+		NodeSelector: map[string]string{"pool": "premium"},
+		Tolerations: []*generated.Toleration{{
+			Key:      "dedicated",
+			Operator: "Equal",
+			Value:    "premium",
+			Effect:   "NoSchedule",
+		}},
+		Affinity: affinity,
+	})
+	require.NoError(t, err)
+	require.True(t, scheduling.constrained())
+
+	settings, err := scheduling.settings()
+	require.NoError(t, err)
+	require.Len(t, settings, 3)
+	require.Equal(t, nodeSelectorSettingKey, settings[0].Key)
+	require.JSONEq(t, `{"pool":"premium"}`, settings[0].Value)
+	require.Equal(t, tolerationsSettingKey, settings[1].Key)
+	require.JSONEq(t, `[{"key":"dedicated","operator":"Equal","value":"premium","effect":"NoSchedule"}]`, settings[1].Value)
+	require.Equal(t, affinitySettingKey, settings[2].Key)
+
+	node := func(labels map[string]string, taints ...corev1.Taint) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: labels},
+			Spec:       corev1.NodeSpec{Taints: taints},
+		}
+	}
+	dedicated := corev1.Taint{Key: "dedicated", Value: "premium", Effect: corev1.TaintEffectNoSchedule}
+	gpu := corev1.Taint{Key: "gpu", Effect: corev1.TaintEffectNoExecute}
+
+	require.True(t, scheduling.schedulable(logging.TestingContext(), node(map[string]string{"pool": "premium", "zone": "a"}, dedicated)))
+	require.False(t, scheduling.schedulable(logging.TestingContext(), node(map[string]string{"pool": "sandbox", "zone": "a"})))
+	require.False(t, scheduling.schedulable(logging.TestingContext(), node(map[string]string{"pool": "premium", "zone": "c"})))
+	require.False(t, scheduling.schedulable(logging.TestingContext(), node(map[string]string{"pool": "premium", "zone": "a"}, gpu)))
+	require.True(t, scheduling.schedulable(logging.TestingContext(), node(map[string]string{"pool": "premium", "zone": "a"},
+		corev1.Taint{Key: "gpu", Effect: corev1.TaintEffectPreferNoSchedule})))
+}
+
+func TestStackSchedulingValidation(t *testing.T) {
+	t.Parallel()
+
+	for name, stack := range map[string]*generated.Stack{
+		"invalid node selector": {
+			NodeSelector: map[string]string{"invalid key!": "value"},
+		},
+		"unknown toleration operator": {
+			Tolerations: []*generated.Toleration{{Key: "dedicated", Operator: "Like"}},
+		},
+		"exists toleration with value": {
+			Tolerations: []*generated.Toleration{{Key: "dedicated", Operator: "Exists", Value: "premium"}},
+		},
+		"unknown toleration effect": {
+			Tolerations: []*generated.Toleration{{Key: "dedicated", Effect: "Never"}},
+		},
+		"unknown affinity field": {
+			Affinity: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"nodeAfinity": structpb.NewStructValue(&structpb.Struct{}),
+			}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newStackScheduling(stack)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWithSchedulingSettings(t *testing.T) {
+	t.Parallel()
+
+	settings := withSchedulingSettings([]*generated.StackSetting{
+		{Key: "gateway.ingress.annotations", Value: "a=b"},
+		{Key: nodeSelectorSettingKey, Value: `{"pool":"sandbox"}`},
+	}, []*generated.StackSetting{
+		{Key: nodeSelectorSettingKey, Value: `{"pool":"premium"}`},
+	})
+	require.Equal(t, []*generated.StackSetting{
+		{Key: "gateway.ingress.annotations", Value: "a=b"},
+		{Key: nodeSelectorSettingKey, Value: `{"pool":"premium"}`},
+	}, settings)
+}
+
+func TestSyncStackScheduling(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	kube := k8sfake.NewClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{"pool": "sandbox"},
+		},
+	})
+	membershipClient := startTestListener(t, client, nil, kube)
+
+	syncStack := func(correlationID string, nodeSelector map[string]string) *generated.OrderResult {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName:  "stack1",
+					NodeSelector: nodeSelector,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		return waitOrderResult(t, membershipClient, correlationID)
+	}
+
+	result := syncStack("sandbox", map[string]string{"pool": "sandbox"})
+	require.True(t, result.Success)
+	require.Empty(t, result.Warnings)
+	setting, err := client.Get(context.Background(), "settings", settingName("stack1", nodeSelectorSettingKey))
+	require.NoError(t, err)
+	value, _, _ := unstructured.NestedString(setting.Object, "spec", "value")
+	require.JSONEq(t, `{"pool":"sandbox"}`, value)
+
+	// The settings are applied, but membership is warned that no node
+	// matches
+	result = syncStack("premium", map[string]string{"pool": "premium"})
+	require.True(t, result.Success)
+	require.Len(t, result.Warnings, 1)
+
+	result = syncStack("invalid", map[string]string{"invalid key!": "premium"})
+	require.False(t, result.Success)
+
+	result = syncStack("unconstrained", nil)
+	require.True(t, result.Success)
+	_, err = client.Get(context.Background(), "settings", settingName("stack1", nodeSelectorSettingKey))
+	require.True(t, apierrors.IsNotFound(err))
+}
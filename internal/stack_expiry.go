@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// stackExpiresAtAnnotation holds the time after which a stack is deleted by
+// the agent, formatted as RFC 3339.
+const stackExpiresAtAnnotation = "formance.com/expires-at"
+
+// stackDeletionReasonAnnotation is set by the expirer on the stacks it is
+// about to delete, so that the deletion is reported as an expiry.
+const (
+	stackDeletionReasonAnnotation = "formance.com/deletion-reason"
+	stackDeletionReasonExpired    = "expired"
+)
+
+// stackDeletionReason returns the reason of the deletion of a stack.
+func stackDeletionReason(stack *unstructured.Unstructured) generated.DeletionReason {
+	if stack.GetAnnotations()[stackDeletionReasonAnnotation] == stackDeletionReasonExpired {
+		return generated.DeletionReason_DeletionExpired
+	}
+	return generated.DeletionReason_DeletionRequested
+}
+
+// stackExpiresAt returns the expiry time of a stack, if it has one.
+func stackExpiresAt(stack *unstructured.Unstructured) (time.Time, bool) {
+	value, ok := stack.GetAnnotations()[stackExpiresAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
+
+// stackExpirer deletes the stacks once they expire. Stacks are read from the
+// informer cache, so that they are deleted even while membership is
+// unreachable. The deletion is then reported by the stack informer.
+type stackExpirer struct {
+	logger logging.Logger
+	client K8SClient
+	stacks cache.GenericLister
+	// wake is signaled when a stack changes, to reschedule the timer
+	wake chan struct{}
+	now  func() time.Time
+}
+
+func (e *stackExpirer) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deleteExpired deletes the expired stacks and returns the time the next one
+// expires, the zero time if there is none.
+func (e *stackExpirer) deleteExpired(ctx context.Context) time.Time {
+	objects, err := e.stacks.List(labels.SelectorFromSet(labels.Set{
+		"formance.com/created-by-agent": "true",
+	}))
+	if err != nil {
+		e.logger.Errorf("Unable to list stacks: %s", err)
+		return time.Time{}
+	}
+
+	now := e.now()
+	var next time.Time
+	for _, object := range objects {
+		stack := object.(*unstructured.Unstructured)
+		expiresAt, ok := stackExpiresAt(stack)
+		if !ok || stack.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if expiresAt.After(now) {
+			if next.IsZero() || expiresAt.Before(next) {
+				next = expiresAt
+			}
+			continue
+		}
+
+		logger := e.logger.WithField("stack", stack.GetName())
+		logger.Infof("Deleting stack expired at %s", expiresAt.Format(time.RFC3339))
+		// The stack informer reports the deletion with the reason recorded
+		// on the stack
+		if err := e.client.Patch(ctx, "Stacks", stack.GetName(), expiredStackPatch); err != nil {
+			if !apierrors.IsNotFound(err) {
+				logger.Errorf("Unable to mark expired stack: %s", err)
+			}
+			continue
+		}
+		if err := e.client.Delete(ctx, "Stacks", stack.GetName()); err != nil && !apierrors.IsNotFound(err) {
+			logger.Errorf("Unable to delete expired stack: %s", err)
+		}
+	}
+	return next
+}
+
+var expiredStackPatch = []byte(`{"metadata":{"annotations":{"` + stackDeletionReasonAnnotation + `":"` + stackDeletionReasonExpired + `"}}}`)
+
+// Run deletes the stacks as they expire, until ctx is done. Deletions which
+// failed are retried once a minute.
+func (e *stackExpirer) Run(ctx context.Context) {
+	const retryPeriod = time.Minute
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-e.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		wait := retryPeriod
+		if next := e.deleteExpired(ctx); !next.IsZero() {
+			wait = min(wait, next.Sub(e.now()))
+		}
+		timer.Reset(wait)
+	}
+}
+
+func newStackExpirer(logger logging.Logger, client K8SClient, stacks cache.GenericLister) *stackExpirer {
+	return &stackExpirer{
+		logger: logger,
+		client: client,
+		stacks: stacks,
+		wake:   make(chan struct{}, 1),
+		now:    time.Now,
+	}
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/formancehq/go-libs/v2/logging"
+	"github.com/formancehq/stack/components/agent/internal/generated"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// deletionRecordingClient keeps the last state of the objects it deletes.
+type deletionRecordingClient struct {
+	*fakeK8SClient
+	deleted []*unstructured.Unstructured
+}
+
+func (c *deletionRecordingClient) Delete(ctx context.Context, resource, name string) error {
+	if object, err := c.Get(ctx, resource, name); err == nil {
+		c.deleted = append(c.deleted, object)
+	}
+	return c.fakeK8SClient.Delete(ctx, resource, name)
+}
+
+func TestStackExpirer(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newStack := func(name string, createdByAgent bool, expiresAt time.Time) *unstructured.Unstructured {
+		stack := newTestObject("Stack", name, nil, nil)
+		if createdByAgent {
+			stack.SetLabels(map[string]string{"formance.com/created-by-agent": "true"})
+		}
+		if !expiresAt.IsZero() {
+			stack.SetAnnotations(map[string]string{stackExpiresAtAnnotation: expiresAt.Format(time.RFC3339)})
+		}
+		return stack
+	}
+	stacks := []*unstructured.Unstructured{
+		newStack("expired", true, now.Add(-time.Minute)),
+		newStack("expiring", true, now.Add(time.Hour)),
+		newStack("expiring-soon", true, now.Add(time.Minute)),
+		newStack("permanent", true, time.Time{}),
+		newStack("foreign", false, now.Add(-time.Minute)),
+	}
+
+	client := &deletionRecordingClient{fakeK8SClient: newFakeK8SClient(stacks...)}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, stack := range stacks {
+		require.NoError(t, indexer.Add(stack))
+	}
+	expirer := newStackExpirer(logging.Testing(), client,
+		cache.NewGenericLister(indexer, formanceGroupVersion.WithResource("stacks").GroupResource()))
+	expirer.now = func() time.Time {
+		return now
+	}
+
+	next := expirer.deleteExpired(context.Background())
+	require.Equal(t, now.Add(time.Minute), next)
+
+	_, err := client.Get(context.Background(), "Stacks", "expired")
+	require.True(t, apierrors.IsNotFound(err))
+	for _, name := range []string{"expiring", "expiring-soon", "permanent", "foreign"} {
+		_, err := client.Get(context.Background(), "Stacks", name)
+		require.NoError(t, err, name)
+	}
+
+	// The stack informer reports the deletion as an expiry
+	require.Len(t, client.deleted, 1)
+	require.Equal(t, generated.DeletionReason_DeletionExpired, stackDeletionReason(client.deleted[0]))
+}
+
+func TestSyncStackExpiry(t *testing.T) {
+	t.Parallel()
+
+	client := newFakeK8SClient()
+	membershipClient := startTestListener(t, client, nil, nil)
+
+	syncStack := func(correlationID string, expiresAt *timestamppb.Timestamp) {
+		membershipClient.Orders() <- &generated.Order{
+			Message: &generated.Order_ExistingStack{
+				ExistingStack: &generated.Stack{
+					ClusterName: "stack1",
+					ExpiresAt:   expiresAt,
+				},
+			},
+			CorrelationId: correlationID,
+		}
+		require.True(t, waitOrderResult(t, membershipClient, correlationID).Success)
+	}
+	annotations := func() map[string]string {
+		stack, err := client.Get(context.Background(), "stacks", "stack1")
+		require.NoError(t, err)
+		return stack.GetAnnotations()
+	}
+
+	syncStack("permanent", nil)
+	require.NotContains(t, annotations(), stackExpiresAtAnnotation)
+
+	expiresAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	syncStack("expiring", timestamppb.New(expiresAt))
+	require.Equal(t, "2026-01-01T12:00:00Z", annotations()[stackExpiresAtAnnotation])
+
+	syncStack("extended", nil)
+	require.NotContains(t, annotations(), stackExpiresAtAnnotation)
+
+	// A stack whose deletion by the expirer failed, then synced again, is no
+	// longer reported as expired once deleted
+	require.NoError(t, client.Patch(context.Background(), "stacks", "stack1", expiredStackPatch))
+	syncStack("retained", nil)
+	require.NotContains(t, annotations(), stackDeletionReasonAnnotation)
+}
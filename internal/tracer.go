@@ -4,4 +4,5 @@ import "go.opentelemetry.io/otel"
 
 var (
 	tracer = otel.Tracer("com.formance.agent")
+	meter  = otel.Meter("com.formance.agent")
 )
@@ -72,3 +72,41 @@ func getStatus(unstructuredModule *unstructured.Unstructured) (*structpb.Struct,
 	}
 	return protoStatus, nil
 }
+
+// removesFields reports whether content, used as a merge patch, removes a
+// field of object: as for the patch, a nil value means the field is removed.
+func removesFields(content, object map[string]any) bool {
+	for key, value := range content {
+		current, ok := object[key]
+		if !ok {
+			continue
+		}
+		if value == nil {
+			return true
+		}
+		nested, ok := value.(map[string]any)
+		if !ok {
+			continue
+		}
+		if currentNested, ok := current.(map[string]any); ok && removesFields(nested, currentNested) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutRemovedFields returns a copy of content without the fields removed by
+// it as a merge patch, to create an object from it.
+func withoutRemovedFields(content map[string]any) map[string]any {
+	ret := make(map[string]any, len(content))
+	for key, value := range content {
+		switch value := value.(type) {
+		case nil:
+		case map[string]any:
+			ret[key] = withoutRemovedFields(value)
+		default:
+			ret[key] = value
+		}
+	}
+	return ret
+}
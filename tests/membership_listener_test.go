@@ -34,7 +34,7 @@ var _ = Describe("Membership listener", func() {
 
 		modules, _, err := internal.RetrieveModuleList(ctx, restConfig)
 		Expect(err).To(BeNil())
-		listener := internal.NewMembershipListener(internal.NewDefaultK8SClient(k8sClient), clientInfo, mapper, membershipClient, modules)
+		listener := internal.NewMembershipListener(internal.NewDefaultK8SClient(k8sClient), clientInfo, mapper, membershipClient, modules, nil, nil, nil)
 		done := make(chan struct{})
 		DeferCleanup(func() {
 			<-done